@@ -1,42 +1,103 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/naoina/toml"
 )
 
 // Config is an object created from a configuration file
-// It is a list of HTTP and/or UDP relays
+// It is a list of HTTP, UDP and/or Graphite relays
 // Each relay has its own list of backends
 type Config struct {
-	HTTPRelays []HTTPConfig `toml:"http"`
-	UDPRelays  []UDPConfig  `toml:"udp"`
-	Filters    Filters      `toml:"filter"`
-	Verbose    bool
+	HTTPRelays     []HTTPConfig     `toml:"http"`
+	UDPRelays      []UDPConfig      `toml:"udp"`
+	GraphiteRelays []GraphiteConfig `toml:"graphite"`
+	Filters        Filters          `toml:"filter"`
+	Transforms     Transforms       `toml:"transform"`
+	Log            LogConfig        `toml:"log"`
+	Verbose        bool
 }
 
+// LogConfig sets how the relays write their logs
+type LogConfig struct {
+	// Format of the log lines: "logfmt" or "json" (default: "logfmt")
+	Format string `toml:"format"`
+
+	// Lowest level of the lines written: "debug", "info", "warn" or "error"
+	// (default: "info", or "debug" when the relay runs with -v)
+	Level string `toml:"level"`
+}
+
+// Types of the filters
+const (
+	// FilterInclude filters send only the points matching them to their outputs
+	FilterInclude = "include"
+
+	// FilterExclude filters send only the points not matching them to their outputs
+	FilterExclude = "exclude"
+)
+
 // Filter represents a regex which may be
 // applied to the incoming requests
+// A point matches a filter when it matches all the criteria it sets
 type Filter struct {
-	// Type is how the regex result will be interpreted
+	// Type is how the regex result will be interpreted:
+	// "include" or "exclude" (default: "include")
 	Type string `toml:"type"`
 
 	// TagExpression is a valid Go regex
-	// It will be applied on each tag of any request to the backend
+	// It will be applied on each tag key of the points, all of them must match
 	TagExpression string `toml:"tag-expression"`
 
 	// MeasurementExpression is a valid Go regex
-	// It will be applied on the measurement of any request to the backend
+	// It will be applied on the measurement of the points
 	MeasurementExpression string `toml:"measurement-expression"`
 
+	// Tags maps tag keys to valid Go regexes, applied on the tag values
+	// A point without one of the tags does not match
+	Tags map[string]string `toml:"tags"`
+
+	// FieldExpression is a valid Go regex
+	// A point matches when the key of one of its fields matches it
+	FieldExpression string `toml:"field-expression"`
+
+	// DatabaseExpression is a valid Go regex
+	// It will be applied on the db query parameter of the writes
+	DatabaseExpression string `toml:"database-expression"`
+
+	// RetentionPolicyExpression is a valid Go regex
+	// It will be applied on the rp query parameter of the writes
+	RetentionPolicyExpression string `toml:"retention-policy-expression"`
+
+	// MaxAge is the age of the oldest points matching, such as "24h"
+	MaxAge string `toml:"max-age"`
+
 	// TagRegexp is the compiled tag regexp
 	TagRegexp *regexp.Regexp
 
 	// MeasurementRegexp is the compiled measurement regexp
 	MeasurementRegexp *regexp.Regexp
 
+	// TagValueRegexps are the compiled regexps of the tags
+	TagValueRegexps map[string]*regexp.Regexp
+
+	// FieldRegexp is the compiled field regexp
+	FieldRegexp *regexp.Regexp
+
+	// DatabaseRegexp is the compiled database regexp
+	DatabaseRegexp *regexp.Regexp
+
+	// RetentionPolicyRegexp is the compiled retention policy regexp
+	RetentionPolicyRegexp *regexp.Regexp
+
+	// MaxAgeDuration is the parsed max age, 0 when unset
+	MaxAgeDuration time.Duration
+
 	// Outputs are the endoints the regex are applied on
 	Outputs []string `toml:"outputs"`
 }
@@ -44,6 +105,42 @@ type Filter struct {
 // Filters is a type representing an array of Filter, wow
 type Filters []Filter
 
+// Transform rewrites the points written to the relays
+type Transform struct {
+	// MeasurementExpression is a valid Go regex
+	// The transform only applies to the points whose measurement matches it
+	MeasurementExpression string `toml:"measurement-expression"`
+
+	// MeasurementReplace replaces the matches of the measurement expression,
+	// it may refer to its groups with $1 or ${name}
+	MeasurementReplace string `toml:"measurement-replace"`
+
+	// AddTags are set on the points, replacing the tags of the same keys
+	AddTags map[string]string `toml:"add-tags"`
+
+	// DropTags are the keys of the tags removed from the points
+	DropTags []string `toml:"drop-tags"`
+
+	// RenameTags maps the keys of the tags to their new keys
+	RenameTags map[string]string `toml:"rename-tags"`
+
+	// DropFields are the keys of the fields removed from the points
+	DropFields []string `toml:"drop-fields"`
+
+	// RenameFields maps the keys of the fields to their new keys
+	RenameFields map[string]string `toml:"rename-fields"`
+
+	// MeasurementRegexp is the compiled measurement regexp
+	MeasurementRegexp *regexp.Regexp
+
+	// Outputs are the endpoints the transform is applied on,
+	// it applies to every output of the relays when empty
+	Outputs []string `toml:"outputs"`
+}
+
+// Transforms is an array of Transform, applied in order
+type Transforms []Transform
+
 // HTTPConfig represents an HTTP relay
 type HTTPConfig struct {
 	// Name identifies the HTTP relay
@@ -69,7 +166,76 @@ type HTTPConfig struct {
 	// Outputs is a list of backed servers where writes will be forwarded
 	Outputs []HTTPOutputConfig `toml:"output"`
 
+	// Users allowed to use the relay, every client is when none is defined
+	Users []UserConfig `toml:"user"`
+
 	HealthTimeout int64 `toml:"health-timeout-ms"`
+
+	// Log every request served by the relay (default: false, true when the relay runs with -v)
+	AccessLog bool `toml:"access-log"`
+
+	// Interval of the background checks of the outputs (default: "", no background checks)
+	// The format used is the same seen in time.ParseDuration
+	// Writes to an output which is down go straight to its retry buffer, or are not sent
+	HealthCheckInterval string `toml:"health-check-interval"`
+
+	// Consecutive failed checks after which an output is down (default: 3)
+	HealthCheckFailures int `toml:"health-check-failures"`
+
+	// Consecutive successful checks after which an output is up again (default: 2)
+	HealthCheckSuccesses int `toml:"health-check-successes"`
+
+	// Number of backends which must acknowledge a write before answering the client:
+	// "any", "one", "quorum" or "all" (default: "any")
+	// It can be overridden per request with the consistency query parameter
+	Consistency string `toml:"consistency"`
+
+	// ShardKey is what points are sharded on: "measurement", "series" or "tag:<key>"
+	// (default: "measurement", only used when shards are defined)
+	ShardKey string `toml:"shard-key"`
+
+	// Shards are groups of outputs sharing a part of the points
+	// Outputs which do not belong to any shard receive every point
+	Shards []ShardConfig `toml:"shard"`
+
+	// How /query requests are balanced over the outputs:
+	// "round-robin", "least-latency" or "priority" (default: "round-robin")
+	QueryBalancing string `toml:"query-balancing"`
+
+	// Never send queries to an output which still has buffered writes (default: false)
+	QueryExcludeBuffering bool `toml:"query-exclude-buffering"`
+
+	// Delay during which an output which failed a query is only tried last (default: 10s)
+	// The format used is the same seen in time.ParseDuration
+	QueryRetryInterval string `toml:"query-retry-interval"`
+}
+
+// ShardConfig represents a group of outputs holding the same part of the points
+type ShardConfig struct {
+	// Name identifies the shard, it is used to place it on the hash ring
+	Name string `toml:"name"`
+
+	// Outputs are the names of the outputs the points of this shard are replicated to
+	Outputs []string `toml:"outputs"`
+}
+
+// UserConfig represents a client allowed to use an HTTP relay
+type UserConfig struct {
+	// Name of the user, given with the password
+	Name string `toml:"name"`
+
+	// Password is the bcrypt hash of the password of the user
+	Password string `toml:"password"`
+
+	// Token authenticates the user without a name or password
+	Token string `toml:"token"`
+
+	// Databases the user can write to and query (default: every database)
+	Databases []string `toml:"databases"`
+
+	// Routes the user can use: "write", "prom", "query", "admin", "flush",
+	// "status" or "metrics" (default: every route)
+	Routes []string `toml:"routes"`
 }
 
 // HTTPOutputConfig represents the specification of an HTTP backend target
@@ -80,6 +246,34 @@ type HTTPOutputConfig struct {
 	// Location should be set to the hostname for the influxdb endpoint (for example https://influxdb.com/)
 	Location string `toml:"location"`
 
+	// Type of the backend: "influxdb" or "influxdb-v2" (default: "influxdb")
+	Type string `toml:"type"`
+
+	// Organization the points are written to, for an "influxdb-v2" backend
+	Org string `toml:"org"`
+
+	// Credentials of the backend, either a username and password or a token
+	// Each of them can reference an environment variable ("env:NAME") or a file ("file:/path")
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
+
+	// What is done with the credentials of the clients: "passthrough" forwards them,
+	// the credentials of the backend only being used when a client sent none,
+	// "override" replaces them with the credentials of the backend and "strip" sends
+	// no credentials at all (default: "override" with credentials, "passthrough" otherwise)
+	AuthPolicy string `toml:"auth-policy"`
+
+	// Bucket the points of a database and retention policy are written to, for an
+	// "influxdb-v2" backend, {db} and {rp} being replaced by them (default: "{db}/{rp}")
+	// The retention policy is "autogen" when the write does not name one
+	Bucket string `toml:"bucket"`
+
+	// Rules renaming the database and the retention policy of the writes sent
+	// to the backend, the first matching rule of each list applies
+	DBMap []NameMapping `toml:"db-map"`
+	RPMap []NameMapping `toml:"rp-map"`
+
 	// Endpoints should contain the path to the different influxdb endpoints used
 	Endpoints HTTPEndpointConfig `toml:"endpoints"`
 
@@ -90,6 +284,28 @@ type HTTPOutputConfig struct {
 	// Buffer failed writes up to maximum count (default: 0, retry/buffering disabled)
 	BufferSizeMB int `toml:"buffer-size-mb"`
 
+	// Directory where failed writes are persisted (default: "", buffer kept in RAM)
+	// When set, buffer-size-mb is the maximum disk space used by the buffer
+	BufferPath string `toml:"buffer-path"`
+
+	// When to fsync the persisted buffer: "always", "segment" or "never" (default: "segment")
+	BufferFsync string `toml:"buffer-fsync"`
+
+	// Keep buffering new writes until the whole buffer is drained (default: false)
+	// This prevents new writes from overtaking buffered ones
+	BufferStrictOrdering bool `toml:"buffer-strict-ordering"`
+
+	// Number of attempts after which a buffered batch is considered poisoned (default: 0, unlimited)
+	// The lines rejected by the backend are then isolated and moved to the dead letters
+	BufferMaxAttempts int `toml:"buffer-max-attempts"`
+
+	// Age after which a buffered batch is considered poisoned (default: "", unlimited)
+	// The format used is the same seen in time.ParseDuration
+	BufferMaxAge string `toml:"buffer-max-age"`
+
+	// Maximum size of the dead letters in MB (default: 10)
+	DeadLetterSizeMB int `toml:"dead-letter-size-mb"`
+
 	// Maximum batch size in KB (default: 512)
 	MaxBatchKB int `toml:"max-batch-kb"`
 
@@ -97,17 +313,36 @@ type HTTPOutputConfig struct {
 	// The format used is the same seen in time.ParseDuration (default: 10s)
 	MaxDelayInterval string `toml:"max-delay-interval"`
 
+	// Priority of the output for queries with the "priority" balancing, lowest first (default: 0)
+	QueryPriority int `toml:"query-priority"`
+
 	// Skip TLS verification in order to use self signed certificate
 	// WARNING: It's insecure, use it only for developing and don't use in production
 	SkipTLSVerification bool `toml:"skip-tls-verification"`
 }
 
+// NameMapping renames a database or a retention policy
+type NameMapping struct {
+	// From is the name renamed, an empty retention policy
+	// being the one of the writes which do not name any
+	From string `toml:"from"`
+
+	// Regex is a valid Go regex, used instead of From when set
+	// Its matches in the names are replaced with To
+	Regex string `toml:"regex"`
+
+	// To is the new name, it may refer to the groups of Regex with $1 or ${name}
+	To string `toml:"to"`
+}
+
 //HTTPEndpointConfig details the remote endpoints to use
 type HTTPEndpointConfig struct {
 	// Must be the standard write endpoint in influxdb.
 	Write string `toml:"write"`
 	// Must be the prometheus specific influxdb endpoint
 	PromWrite string `toml:"write_prom"`
+	// Must be the prometheus specific influxdb read endpoint
+	PromRead string `toml:"read_prom"`
 	// Must be the ping endpoint
 	Ping string `toml:"ping"`
 	// Must be the query influxdb endpoint
@@ -128,6 +363,17 @@ type UDPConfig struct {
 	// ReadBuffer sets the socket buffer for incoming connections
 	ReadBuffer int `toml:"read-buffer"`
 
+	// Readers is the number of sockets receiving the packets, sharing the
+	// address with SO_REUSEPORT, which is only supported on Linux (default: 1)
+	Readers int `toml:"readers"`
+
+	// Workers is the number of packets parsed and forwarded concurrently (default: 1)
+	Workers int `toml:"workers"`
+
+	// QueueSize is the number of packets waiting for a worker, the packets
+	// received while the queue is full are dropped (default: 1024)
+	QueueSize int `toml:"queue-size"`
+
 	// Outputs is a list of backend servers where writes will be forwarded
 	Outputs []UDPOutputConfig `toml:"output"`
 }
@@ -137,13 +383,82 @@ type UDPOutputConfig struct {
 	// Name identifies the UDP backend
 	Name string `toml:"name"`
 
-	// Location should be set to the host:port of the backend server
+	// Location should be set to the host:port of the backend server,
+	// or to the URL of an InfluxDB server to write the points over HTTP
 	Location string `toml:"location"`
 
 	// MTU sets the maximum output payload size, default is 1024
 	MTU int `toml:"mtu"`
+
+	// The settings below only apply to the HTTP outputs
+
+	// Database and retention policy the points are written to, the database is required
+	DB string `toml:"db"`
+	RP string `toml:"rp"`
+
+	// Credentials of the backend, as for the outputs of the HTTP relays
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
+
+	// Maximum size in KB of the batches of points sent to the backend (default: 64)
+	BatchSizeKB int `toml:"batch-size-kb"`
+
+	// Maximum delay before the points received are sent to the backend (default: 1s)
+	// The format used is the same seen in time.ParseDuration
+	BatchInterval string `toml:"batch-interval"`
+
+	// Timeout sets a timeout for write requests (default: 10s)
+	// The format used is the same seen in time.ParseDuration
+	Timeout string `toml:"timeout"`
+
+	// Buffer failed writes up to maximum count (default: 0, retry/buffering disabled)
+	BufferSizeMB int `toml:"buffer-size-mb"`
+
+	// Directory where failed writes are persisted (default: "", buffer kept in RAM)
+	BufferPath string `toml:"buffer-path"`
+
+	// Maximum delay between retry attempts
+	// The format used is the same seen in time.ParseDuration (default: 10s)
+	MaxDelayInterval string `toml:"max-delay-interval"`
+
+	// Skip TLS verification in order to use self signed certificate
+	// WARNING: It's insecure, use it only for developing and don't use in production
+	SkipTLSVerification bool `toml:"skip-tls-verification"`
+}
+
+// GraphiteConfig represents a relay receiving the Graphite plaintext protocol
+type GraphiteConfig struct {
+	// Name identifies the Graphite relay
+	Name string `toml:"name"`
+
+	// Addr is where the Graphite relay will listen for the metrics
+	Addr string `toml:"bind-addr"`
+
+	// Protocol of the listener: "tcp" or "udp" (default: "tcp")
+	Protocol string `toml:"protocol"`
+
+	// ReadBuffer sets the socket buffer for incoming UDP packets
+	ReadBuffer int `toml:"read-buffer"`
+
+	// Separator joins the parts of the paths in the measurements and the fields (default: ".")
+	Separator string `toml:"separator"`
+
+	// Templates map the paths to measurements, tags and fields, as
+	// "[filter] template [tag=value,...]" (default: "measurement*")
+	Templates []string `toml:"templates"`
+
+	// Tags added to every point, as "tag=value"
+	Tags []string `toml:"tags"`
+
+	// Outputs are the InfluxDB servers the points are written to over HTTP
+	Outputs []GraphiteOutputConfig `toml:"output"`
 }
 
+// GraphiteOutputConfig represents an InfluxDB server the points of a Graphite
+// relay are written to, with the settings of the HTTP outputs of the UDP relays
+type GraphiteOutputConfig = UDPOutputConfig
+
 // LoadRegexps will try to compile all the eventual regular expressions
 // for each filter
 // Any error here is critical
@@ -152,12 +467,78 @@ func (fs Filters) LoadRegexps() error {
 
 	for i := range fs {
 		f := &fs[i]
-		f.TagRegexp, err = regexp.Compile(f.TagExpression)
-		if err != nil {
-			return err
+		switch f.Type {
+		case "":
+			f.Type = FilterInclude
+		case FilterInclude, FilterExclude:
+		default:
+			return fmt.Errorf("invalid filter type %q", f.Type)
+		}
+
+		for _, c := range []struct {
+			expr string
+			re   **regexp.Regexp
+		}{
+			{f.TagExpression, &f.TagRegexp},
+			{f.MeasurementExpression, &f.MeasurementRegexp},
+			{f.FieldExpression, &f.FieldRegexp},
+			{f.DatabaseExpression, &f.DatabaseRegexp},
+			{f.RetentionPolicyExpression, &f.RetentionPolicyRegexp},
+		} {
+			if c.expr == "" {
+				continue
+			}
+			if *c.re, err = regexp.Compile(c.expr); err != nil {
+				return err
+			}
+		}
+
+		if len(f.Tags) > 0 {
+			f.TagValueRegexps = make(map[string]*regexp.Regexp, len(f.Tags))
+			for k, expr := range f.Tags {
+				if f.TagValueRegexps[k], err = regexp.Compile(expr); err != nil {
+					return err
+				}
+			}
+		}
+
+		if f.MaxAge != "" {
+			if f.MaxAgeDuration, err = time.ParseDuration(f.MaxAge); err != nil {
+				return fmt.Errorf("error parsing filter max age: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadRegexps compiles the regular expressions of the transforms
+// Any error here is critical
+func (ts Transforms) LoadRegexps() error {
+	for i := range ts {
+		t := &ts[i]
+		for k, v := range t.AddTags {
+			if k == "" || v == "" {
+				return fmt.Errorf("invalid tag added by a transform: %q=%q", k, v)
+			}
+		}
+		for _, m := range []map[string]string{t.RenameTags, t.RenameFields} {
+			for k, nk := range m {
+				if nk == "" {
+					return fmt.Errorf("empty new key for %q in a transform", k)
+				}
+			}
+		}
+
+		if t.MeasurementExpression == "" {
+			if t.MeasurementReplace != "" {
+				return errors.New("measurement-replace is set without a measurement-expression")
+			}
+			continue
 		}
 
-		f.MeasurementRegexp, err = regexp.Compile(f.MeasurementExpression)
+		var err error
+		t.MeasurementRegexp, err = regexp.Compile(t.MeasurementExpression)
 		if err != nil {
 			return err
 		}
@@ -171,6 +552,10 @@ func checkDoubleSlash(endpoint HTTPEndpointConfig) HTTPEndpointConfig {
 		endpoint.PromWrite = endpoint.PromWrite[1:]
 	}
 
+	if endpoint.PromRead != "" && endpoint.PromRead[0] == '/' {
+		endpoint.PromRead = endpoint.PromRead[1:]
+	}
+
 	if endpoint.Ping != "" && endpoint.Ping[0] == '/' {
 		endpoint.Ping = endpoint.Ping[1:]
 	}
@@ -207,5 +592,8 @@ func LoadConfigFile(filename string) (Config, error) {
 		}
 		err = cfg.Filters.LoadRegexps()
 	}
+	if err == nil {
+		err = cfg.Transforms.LoadRegexps()
+	}
 	return cfg, err
 }
@@ -0,0 +1,263 @@
+// Package logging writes leveled and structured log lines, in the logfmt or
+// JSON format, so that they can be parsed by log pipelines
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Levels of the log lines, the lines below the level of a logger are dropped
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of its name, info when empty
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+// Formats of the log lines
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// output is where the lines of a logger and of those derived from it go
+type output struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+}
+
+// Logger writes log lines with a set of fields
+type Logger struct {
+	o      *output
+	fields []interface{}
+}
+
+// now is replaced by the tests
+var now = time.Now
+
+// std is the logger used by the functions of the package
+var std = &Logger{o: &output{out: os.Stderr, format: FormatLogfmt, level: LevelInfo}}
+
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return FormatLogfmt, nil
+	case FormatLogfmt, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid log format %q", format)
+}
+
+// New creates a logger writing to out, or to the standard error when nil
+func New(out io.Writer, format string, level Level) (*Logger, error) {
+	format, err := checkFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	if out == nil {
+		out = os.Stderr
+	}
+	return &Logger{o: &output{out: out, format: format, level: level}}, nil
+}
+
+// Default returns the logger used by the functions of the package
+func Default() *Logger {
+	return std
+}
+
+// Configure changes the format and level of the default logger, as
+// well as the ones of the loggers which were derived from it
+func Configure(format string, level Level) error {
+	format, err := checkFormat(format)
+	if err != nil {
+		return err
+	}
+
+	std.o.mu.Lock()
+	std.o.format, std.o.level = format, level
+	std.o.mu.Unlock()
+	return nil
+}
+
+// SetOutput sets the output of the default logger, and
+// of the loggers which were derived from it
+func SetOutput(w io.Writer) {
+	std.o.mu.Lock()
+	std.o.out = w
+	std.o.mu.Unlock()
+}
+
+// With returns a logger adding the key-value pairs to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+	return &Logger{o: l.o, fields: fields}
+}
+
+// Enabled tells whether the lines of a level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.o.mu.Lock()
+	defer l.o.mu.Unlock()
+	return level >= l.o.level
+}
+
+// Debug writes a debug line
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.write(LevelDebug, msg, kv) }
+
+// Info writes an info line
+func (l *Logger) Info(msg string, kv ...interface{}) { l.write(LevelInfo, msg, kv) }
+
+// Warn writes a warning line
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.write(LevelWarn, msg, kv) }
+
+// Error writes an error line
+func (l *Logger) Error(msg string, kv ...interface{}) { l.write(LevelError, msg, kv) }
+
+// Debug writes a debug line with the default logger
+func Debug(msg string, kv ...interface{}) { std.write(LevelDebug, msg, kv) }
+
+// Info writes an info line with the default logger
+func Info(msg string, kv ...interface{}) { std.write(LevelInfo, msg, kv) }
+
+// Warn writes a warning line with the default logger
+func Warn(msg string, kv ...interface{}) { std.write(LevelWarn, msg, kv) }
+
+// Error writes an error line with the default logger
+func Error(msg string, kv ...interface{}) { std.write(LevelError, msg, kv) }
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	l.o.mu.Lock()
+	defer l.o.mu.Unlock()
+
+	if level < l.o.level {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv)+1)
+	fields = append(fields, "time", now().UTC().Format("2006-01-02T15:04:05.000Z07:00"), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	if l.o.format == FormatJSON {
+		encodeJSON(&buf, fields)
+	} else {
+		encodeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	_, _ = l.o.out.Write(buf.Bytes())
+}
+
+func encodeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		v := fields[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		var s string
+		switch v := fields[i+1].(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		case fmt.Stringer:
+			s = v.String()
+		case nil:
+			s = "null"
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		if needsQuotes(s) {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func needsQuotes(s string) bool {
+	if s == "" {
+		return true
+	}
+
+	for _, r := range s {
+		if r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
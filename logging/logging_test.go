@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	now = func() time.Time { return time.Date(2019, 3, 4, 5, 6, 7, 8000000, time.UTC) }
+}
+
+type pair struct{ a, b string }
+
+func (p pair) String() string { return p.a + "," + p.b }
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatLogfmt, LevelInfo)
+	assert.Nil(t, err)
+
+	l = l.With("relay", "http")
+	l.Debug("dropped")
+	l.Info("request served", "path", "/write", "status", 204, "error", errors.New("some error"), "pair", pair{"a", "b"}, "empty", "")
+	l.Warn("odd", "key")
+
+	assert.Equal(t, `time=2019-03-04T05:06:07.008Z level=info msg="request served" relay=http path=/write status=204 error="some error" pair=a,b empty=""
+time=2019-03-04T05:06:07.008Z level=warn msg=odd relay=http key=(MISSING)
+`, buf.String())
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatJSON, LevelDebug)
+	assert.Nil(t, err)
+
+	l.Error("request served", "status", 500, "error", errors.New("some error"), "pair", pair{"a", "b"}, "list", []int{1, 2})
+
+	assert.Equal(t, `{"time":"2019-03-04T05:06:07.008Z","level":"error","msg":"request served","status":500,"error":"some error","pair":{},"list":[1,2]}
+`, buf.String())
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, expected := range map[string]Level{"": LevelInfo, "debug": LevelDebug, "WARN": LevelWarn, "error": LevelError} {
+		l, err := ParseLevel(s)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, l)
+	}
+
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err)
+
+	_, err = New(nil, "text", LevelInfo)
+	assert.NotNil(t, err)
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 	"github.com/veepee-moc/influxdb-relay/relayservice"
 )
 
@@ -29,18 +30,40 @@ var (
 func runRelay(cfg config.Config) {
 	relay, err := relayservice.New(cfg)
 	if err != nil {
-		log.Fatal(err)
+		logging.Error("unable to start relays", "error", err)
+		os.Exit(1)
+	}
+
+	// Reload the configuration file on SIGHUP or through /admin/reload
+	reload := func() error {
+		cfg, err := config.LoadConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+
+		cfg.Verbose = *verbose
+		return relay.Reload(cfg)
 	}
+	relay.SetReloadFunc(reload)
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP)
 
 	go func() {
-		<-sigChan
-		relay.Stop()
+		for sig := range sigChan {
+			if sig != syscall.SIGHUP {
+				relay.Stop()
+				return
+			}
+
+			logging.Info("reloading configuration")
+			if err := reload(); err != nil {
+				logging.Error("unable to reload configuration", "error", err)
+			}
+		}
 	}()
 
-	log.Println("starting relays...")
+	logging.Info("starting relays", "version", relayVersion)
 	relay.Run()
 }
 
@@ -63,8 +86,8 @@ func main() {
 	// And it has to be loaded in order to continue
 	cfg, err := config.LoadConfigFile(*configFile)
 	if err != nil {
-		log.Println("Version: " + relayVersion)
-		log.Fatal(err.Error())
+		logging.Error("unable to load configuration", "version", relayVersion, "error", err)
+		os.Exit(1)
 	}
 
 	cfg.Verbose = *verbose
@@ -0,0 +1,445 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veepee-moc/influxdb-relay/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Routes the users can be allowed to use
+const (
+	RouteWrite   = "write"
+	RouteProm    = "prom"
+	RouteQuery   = "query"
+	RouteAdmin   = "admin"
+	RouteFlush   = "flush"
+	RouteStatus  = "status"
+	RouteMetrics = "metrics"
+)
+
+// authRoutes gives the route of each path, the paths
+// which are not listed do not need any authentication
+var authRoutes = map[string]string{
+	"/write":             RouteWrite,
+	"/api/v2/write":      RouteWrite,
+	"/api/v1/prom/write": RouteProm,
+	"/api/v1/prom/read":  RouteProm,
+	"/query":             RouteQuery,
+	"/status":            RouteStatus,
+	"/metrics":           RouteMetrics,
+	"/admin":             RouteAdmin,
+	"/admin/reload":      RouteAdmin,
+	"/admin/flush":       RouteFlush,
+
+	"/admin/dead-letters":          RouteAdmin,
+	"/admin/dead-letters/download": RouteAdmin,
+	"/admin/dead-letters/resubmit": RouteAdmin,
+
+	"/admin/backends":        RouteAdmin,
+	"/admin/backends/pause":  RouteAdmin,
+	"/admin/backends/resume": RouteAdmin,
+}
+
+var (
+	errNoCredentials      = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errUncheckedQuery     = errors.New("the databases of the query cannot be checked")
+)
+
+type authUser struct {
+	name      string
+	hash      []byte
+	databases map[string]bool
+	routes    map[string]bool
+
+	// SHA-256 of the last password which matched the hash, as checking
+	// the bcrypt hash of every request would be far too slow
+	mu       sync.Mutex
+	verified []byte
+}
+
+// authenticator checks the credentials of the requests
+type authenticator struct {
+	users  map[string]*authUser
+	tokens map[string]*authUser
+}
+
+func newAuthenticator(users []config.UserConfig) (*authenticator, error) {
+	a := &authenticator{
+		users:  make(map[string]*authUser),
+		tokens: make(map[string]*authUser),
+	}
+
+	valid := make(map[string]bool)
+	for _, r := range authRoutes {
+		valid[r] = true
+	}
+
+	for _, cfg := range users {
+		if cfg.Password == "" && cfg.Token == "" {
+			return nil, fmt.Errorf("user %q has neither a password nor a token", cfg.Name)
+		}
+
+		u := &authUser{name: cfg.Name}
+
+		if cfg.Password != "" {
+			if cfg.Name == "" {
+				return nil, errors.New("a user with a password must have a name")
+			}
+			if _, ok := a.users[cfg.Name]; ok {
+				return nil, fmt.Errorf("duplicate user %q", cfg.Name)
+			}
+			if _, err := bcrypt.Cost([]byte(cfg.Password)); err != nil {
+				return nil, fmt.Errorf("invalid password hash for user %q: %v", cfg.Name, err)
+			}
+			u.hash = []byte(cfg.Password)
+			a.users[cfg.Name] = u
+		}
+
+		if cfg.Token != "" {
+			if _, ok := a.tokens[cfg.Token]; ok {
+				return nil, fmt.Errorf("duplicate token for user %q", cfg.Name)
+			}
+			a.tokens[cfg.Token] = u
+		}
+
+		if len(cfg.Databases) > 0 {
+			u.databases = make(map[string]bool)
+			for _, db := range cfg.Databases {
+				u.databases[db] = true
+			}
+		}
+
+		if len(cfg.Routes) > 0 {
+			u.routes = make(map[string]bool)
+			for _, r := range cfg.Routes {
+				if !valid[r] {
+					return nil, fmt.Errorf("invalid route %q for user %q", r, cfg.Name)
+				}
+				u.routes[r] = true
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// credentials returns the credentials of a request, given the way InfluxDB
+// accepts them: basic authentication, a "Token" or "Bearer" authorization
+// header, or the u and p query parameters
+func credentials(r *http.Request) (user, password, token string) {
+	if u, p, ok := r.BasicAuth(); ok {
+		return u, p, ""
+	}
+
+	auth := r.Header.Get("Authorization")
+	for _, scheme := range []string{"Token ", "Bearer "} {
+		if strings.HasPrefix(auth, scheme) {
+			t := auth[len(scheme):]
+			if i := strings.IndexByte(t, ':'); i >= 0 && scheme == "Token " {
+				return t[:i], t[i+1:], ""
+			}
+			return "", "", t
+		}
+	}
+
+	q := r.URL.Query()
+	return q.Get("u"), q.Get("p"), ""
+}
+
+// authenticate returns the user sending a request
+func (a *authenticator) authenticate(r *http.Request) (*authUser, error) {
+	name, password, token := credentials(r)
+
+	if token != "" {
+		for t, u := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return u, nil
+			}
+		}
+		return nil, errInvalidCredentials
+	}
+
+	if name == "" {
+		return nil, errNoCredentials
+	}
+
+	u, ok := a.users[name]
+	if !ok || !u.check(password) {
+		return nil, errInvalidCredentials
+	}
+	return u, nil
+}
+
+// check checks the password of the user
+func (u *authUser) check(password string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	u.mu.Lock()
+	verified := u.verified
+	u.mu.Unlock()
+
+	if verified != nil && subtle.ConstantTimeCompare(verified, sum[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	u.verified = sum[:]
+	u.mu.Unlock()
+	return true
+}
+
+// allowed checks whether the user can use a route on a database, an empty
+// database is allowed for any user allowed on the route, but the queries
+// of a user restricted to some databases must name one of them
+func (u *authUser) allowed(route string, db string) bool {
+	if u.routes != nil && !u.routes[route] {
+		return false
+	}
+
+	if u.databases == nil {
+		return true
+	}
+	if db == "" {
+		return route != RouteQuery && route != RouteProm
+	}
+	return u.databases[db]
+}
+
+// queryForm returns the parameters of a query, the ones of a form body
+// taking precedence as they do with InfluxDB, the body being kept for
+// the handler. A multipart body, which may hold the statements as a
+// file, cannot be checked
+func queryForm(r *http.Request) (url.Values, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return nil, errUncheckedQuery
+	}
+
+	if r.Method != http.MethodPost || r.Body == nil {
+		return r.URL.Query(), nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	err = r.ParseForm()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return r.Form, err
+}
+
+// maxQueryReadings bounds the ways a query is read, see tokenizeQuery
+const maxQueryReadings = 16
+
+// queryToken is an identifier, a keyword or a punctuation of a query
+type queryToken struct {
+	text  string
+	ident bool
+
+	// quoted identifiers are never keywords
+	quoted bool
+}
+
+// tokenizeQuery splits the statements of a query into tokens, leaving out
+// the strings and the comments, and calls fn with the tokens of every way
+// the query may be read: a slash either starts a regular expression or is a
+// division depending on the statement, which makes a difference when the
+// text up to the next slash holds a quote or a comment. Otherwise the text of
+// a regular expression is read as tokens as well
+func tokenizeQuery(q string, fn func([]queryToken)) error {
+	readings := 0
+
+	var scan func(i int, tokens []queryToken) error
+	scan = func(i int, tokens []queryToken) error {
+		for ; i < len(q); i++ {
+			c := q[i]
+			switch {
+			case c == '\'' || c == '"':
+				j := i + 1
+				var b strings.Builder
+				for ; j < len(q) && q[j] != c; j++ {
+					if q[j] == '\\' && j+1 < len(q) {
+						j++
+					}
+					b.WriteByte(q[j])
+				}
+				if c == '"' {
+					tokens = append(tokens, queryToken{text: b.String(), ident: true, quoted: true})
+				}
+				i = j
+
+			case c == '-' && strings.HasPrefix(q[i:], "--"):
+				if j := strings.IndexByte(q[i:], '\n'); j >= 0 {
+					i += j
+				} else {
+					i = len(q)
+				}
+
+			case c == '/' && strings.HasPrefix(q[i:], "/*"):
+				if j := strings.Index(q[i+2:], "*/"); j >= 0 {
+					i += j + 3
+				} else {
+					i = len(q)
+				}
+
+			case c == '/':
+				tokens = append(tokens, queryToken{text: "/"})
+
+				end := -1
+				for j := i + 1; j < len(q) && end < 0; j++ {
+					if q[j] == '\\' {
+						j++
+					} else if q[j] == '/' {
+						end = j
+					}
+				}
+
+				span := ""
+				if end > 0 {
+					span = q[i+1 : end]
+				}
+				if strings.ContainsAny(span, "'\"") || strings.Contains(span, "--") {
+					// The regular expression is read first, then the division
+					readings++
+					if readings > maxQueryReadings {
+						return errUncheckedQuery
+					}
+					if err := scan(end+1, append([]queryToken(nil), tokens...)); err != nil {
+						return err
+					}
+				}
+
+			case isIdentChar(c):
+				j := i
+				for j < len(q) && isIdentChar(q[j]) {
+					j++
+				}
+				tokens = append(tokens, queryToken{text: q[i:j], ident: c < '0' || c > '9'})
+				i = j - 1
+
+			case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+
+			default:
+				tokens = append(tokens, queryToken{text: string(c)})
+			}
+		}
+
+		fn(tokens)
+		return nil
+	}
+
+	return scan(0, nil)
+}
+
+// queryDatabases returns the databases named by the statements of a query:
+// the ones of the fully qualified measurements, "db".."m" or "db"."rp"."m",
+// and the ones following the ON and DATABASE keywords
+func queryDatabases(q string) ([]string, error) {
+	var dbs []string
+	seen := make(map[string]bool)
+	add := func(db string) {
+		if !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+
+	err := tokenizeQuery(q, func(tokens []queryToken) {
+		at := func(i int) queryToken {
+			if i < len(tokens) {
+				return tokens[i]
+			}
+			return queryToken{}
+		}
+		dot := func(t queryToken) bool { return !t.ident && t.text == "." }
+
+		for i, t := range tokens {
+			if !t.ident {
+				continue
+			}
+
+			keyword := !t.quoted && (strings.EqualFold(t.text, "ON") || strings.EqualFold(t.text, "DATABASE"))
+			switch {
+			case keyword && at(i+1).ident:
+				add(at(i + 1).text)
+			case dot(at(i+1)) && (dot(at(i+2)) || at(i+2).ident && dot(at(i+3))):
+				add(t.text)
+			}
+		}
+	})
+	return dbs, err
+}
+
+// requestDatabase returns the database a request writes to or reads from
+func requestDatabase(r *http.Request) string {
+	q := r.URL.Query()
+	if r.URL.Path == "/api/v2/write" {
+		bucket := q.Get("bucket")
+		if i := strings.IndexByte(bucket, '/'); i >= 0 {
+			return bucket[:i]
+		}
+		return bucket
+	}
+	return q.Get("db")
+}
+
+func (h *HTTP) authMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		route, ok := authRoutes[r.URL.Path]
+		if h.auth == nil || !ok {
+			next(h, w, r, start)
+			return
+		}
+
+		u, err := h.auth.authenticate(r)
+		if err != nil {
+			h.logger.Debug("authentication failed", "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="influxdb-relay"`)
+			jsonResponse(w, response{http.StatusUnauthorized, err.Error()})
+			return
+		}
+
+		dbs := []string{requestDatabase(r)}
+		if route == RouteQuery && u.databases != nil {
+			// The statements may name other databases than the db parameter
+			params, err := queryForm(r)
+			var names []string
+			if err == nil {
+				names, err = queryDatabases(params.Get("q"))
+			}
+			if err != nil {
+				h.logger.Debug("query not allowed", "user", u.name, "error", err)
+				jsonResponse(w, response{http.StatusForbidden, err.Error()})
+				return
+			}
+			dbs = append([]string{params.Get("db")}, names...)
+		}
+
+		for _, db := range dbs {
+			if !u.allowed(route, db) {
+				h.logger.Debug("user not allowed", "user", u.name, "path", r.URL.Path, "db", db)
+				jsonResponse(w, response{http.StatusForbidden, http.StatusText(http.StatusForbidden)})
+				return
+			}
+		}
+
+		next(h, w, r, start)
+	})
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testUsers(t *testing.T) []config.UserConfig {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []config.UserConfig{
+		{Name: "telegraf", Password: string(hash), Databases: []string{"telegraf"}, Routes: []string{RouteWrite}},
+		{Name: "ops", Token: "ops-token"},
+		{Name: "grafana", Token: "grafana-token", Databases: []string{"telegraf"}, Routes: []string{RouteQuery, RouteProm}},
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	a, err := newAuthenticator(testUsers(t))
+	assert.Nil(t, err)
+
+	for _, c := range []struct {
+		url    string
+		header string
+		user   string
+		err    error
+	}{
+		{"/write?db=telegraf", "", "", errNoCredentials},
+		{"/write?db=telegraf&u=telegraf&p=secret", "", "telegraf", nil},
+		{"/write?db=telegraf&u=telegraf&p=wrong", "", "", errInvalidCredentials},
+		{"/write?db=telegraf", "Basic dGVsZWdyYWY6c2VjcmV0", "telegraf", nil},
+		{"/write?db=telegraf", "Token telegraf:secret", "telegraf", nil},
+		{"/write?db=telegraf", "Token ops-token", "ops", nil},
+		{"/write?db=telegraf", "Bearer ops-token", "ops", nil},
+		{"/write?db=telegraf", "Bearer wrong", "", errInvalidCredentials},
+	} {
+		r, _ := http.NewRequest(http.MethodPost, c.url, nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+
+		u, err := a.authenticate(r)
+		assert.Equal(t, c.err, err, c.url+" "+c.header)
+		if err == nil {
+			assert.Equal(t, c.user, u.name)
+		}
+	}
+
+	// The password is checked against its hash once
+	u := a.users["telegraf"]
+	assert.NotNil(t, u.verified)
+	assert.True(t, u.check("secret"))
+	assert.False(t, u.check("wrong"))
+
+	assert.True(t, u.allowed(RouteWrite, "telegraf"))
+	assert.False(t, u.allowed(RouteWrite, "other"))
+	assert.False(t, u.allowed(RouteAdmin, ""))
+	assert.True(t, a.tokens["ops-token"].allowed(RouteAdmin, "other"))
+}
+
+func TestAuthenticatorInvalid(t *testing.T) {
+	for _, users := range [][]config.UserConfig{
+		{{Name: "nothing"}},
+		{{Name: "plain", Password: "secret"}},
+		{{Name: "route", Token: "t", Routes: []string{"everything"}}},
+		{{Name: "a", Token: "t"}, {Name: "b", Token: "t"}},
+	} {
+		_, err := newAuthenticator(users)
+		assert.NotNil(t, err, users[0].Name)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+	h.auth, _ = newAuthenticator(testUsers(t))
+
+	called := false
+	var body []byte
+	next := func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		called = true
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+
+	for _, c := range []struct {
+		url    string
+		header string
+		code   int
+		body   string
+	}{
+		{"/ping", "", 0, ""},
+		{"/write?db=telegraf", "", http.StatusUnauthorized, ""},
+		{"/write?db=telegraf", "Token telegraf:secret", 0, ""},
+		{"/api/v2/write?bucket=telegraf/autogen", "Token telegraf:secret", 0, ""},
+		{"/write?db=other", "Token telegraf:secret", http.StatusForbidden, ""},
+		{"/admin/flush", "Token telegraf:secret", http.StatusForbidden, ""},
+		{"/admin/flush", "Bearer ops-token", 0, ""},
+		{"/query?q=SHOW+DATABASES", "Bearer ops-token", 0, ""},
+
+		// A user restricted to some databases must name them
+		{"/query?q=SHOW+DATABASES", "Bearer grafana-token", http.StatusForbidden, ""},
+		{"/api/v1/prom/read", "Bearer grafana-token", http.StatusForbidden, ""},
+		{"/query?db=telegraf&q=SELECT+*+FROM+cpu", "Bearer grafana-token", 0, ""},
+		{"/query?db=telegraf&q=SELECT+*+FROM+other..cpu", "Bearer grafana-token", http.StatusForbidden, ""},
+		{"/query?db=telegraf", "Bearer grafana-token", 0, "q=SELECT+*+FROM+cpu"},
+		{"/query?db=telegraf", "Bearer grafana-token", http.StatusForbidden, "db=other&q=SELECT+*+FROM+cpu"},
+		{"/query", "Bearer grafana-token", http.StatusForbidden, "q=SHOW+MEASUREMENTS+ON+other"},
+	} {
+		resetWriter()
+		called = false
+		r, _ := http.NewRequest(http.MethodPost, c.url, strings.NewReader(c.body))
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		if c.body != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		h.authMiddleware(next)(h, w, r, ti)
+		assert.Equal(t, c.code, w.code, c.url+" "+c.header+" "+c.body)
+		assert.Equal(t, c.code == 0, called, c.url+" "+c.header+" "+c.body)
+		if called {
+			// The body is still sent to the backends
+			assert.Equal(t, c.body, string(body))
+		}
+	}
+}
+
+func TestQueryDatabases(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		dbs   []string
+	}{
+		{"SELECT * FROM cpu", nil},
+		{"SELECT * FROM autogen.cpu", nil},
+		{"SELECT * FROM other..cpu", []string{"other"}},
+		{`SELECT * FROM "other"."autogen"."cpu"`, []string{"other"}},
+		{"SELECT * FROM other../cpu.*/", []string{"other"}},
+		{"SELECT * FROM (SELECT * FROM other..cpu)", []string{"other"}},
+		{"SELECT * INTO other..cpu FROM cpu", []string{"other"}},
+		{"SHOW MEASUREMENTS ON other", []string{"other"}},
+		{`DROP DATABASE "other"`, []string{"other"}},
+		{`SELECT "on" FROM cpu WHERE host = 'a.b.c'`, nil},
+		{"SELECT * -- it's\nFROM other..cpu", []string{"other"}},
+
+		// The quotes within the slashes are read both ways
+		{"SELECT a / 2 FROM cpu WHERE h = 'x' AND b / 3 > 1; SELECT * FROM other..cpu", []string{"other"}},
+		{"SELECT * FROM cpu WHERE t =~ /'/; SELECT * FROM other..cpu WHERE s = '/'", []string{"other"}},
+	} {
+		dbs, err := queryDatabases(c.query)
+		assert.Nil(t, err, c.query)
+		assert.Equal(t, c.dbs, dbs, c.query)
+	}
+
+	_, err := queryDatabases(strings.Repeat("SELECT * FROM cpu WHERE t =~ /'/;", maxQueryReadings+1))
+	assert.Equal(t, errUncheckedQuery, err)
+}
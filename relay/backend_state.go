@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of a backend, set through the admin API
+const (
+	// StateEnabled backends receive the writes and the queries
+	StateEnabled = "enabled"
+
+	// StateDisabled backends receive neither the writes nor the queries,
+	// their writes are held in the retry buffer or discarded
+	StateDisabled = "disabled"
+
+	// StateDraining backends receive neither the new writes nor the queries,
+	// but their retry buffer keeps on sending the buffered writes
+	StateDraining = "draining"
+)
+
+// What happens to the writes of a disabled backend
+const (
+	DisabledBuffer  = "buffer"
+	DisabledDiscard = "discard"
+)
+
+var (
+	errBackendDisabled = errors.New("backend is disabled")
+	errBackendDraining = errors.New("backend is draining")
+)
+
+// backendState is the state of a backend set by the administrators,
+// it is kept across reloads but not across restarts
+type backendState struct {
+	mu    sync.RWMutex
+	state string
+	mode  string
+}
+
+// get returns the state of the backend, and for a
+// disabled backend what happens to its writes
+func (s *backendState) get() (string, string) {
+	if s == nil {
+		return StateEnabled, ""
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state == "" {
+		return StateEnabled, ""
+	}
+	return s.state, s.mode
+}
+
+// setState changes the state of the backend, the retry buffer of a
+// disabled backend holds its writes until the backend is enabled again
+func (b *httpBackend) setState(state string, mode string) error {
+	r := b.getRetryBuffer()
+
+	switch state {
+	case StateEnabled, StateDraining:
+		mode = ""
+	case StateDisabled:
+		switch mode {
+		case "":
+			mode = DisabledDiscard
+			if r != nil {
+				mode = DisabledBuffer
+			}
+		case DisabledBuffer:
+			if r == nil {
+				return errors.New("backend has no retry buffer")
+			}
+		case DisabledDiscard:
+		default:
+			return errors.New("invalid mode: " + mode)
+		}
+	default:
+		return errors.New("invalid state: " + state)
+	}
+
+	b.state.mu.Lock()
+	b.state.state, b.state.mode = state, mode
+	b.state.mu.Unlock()
+
+	if r != nil {
+		r.setPaused(mode == DisabledBuffer)
+	}
+	return nil
+}
+
+// serves tells whether the backend receives the queries
+func (b *httpBackend) serves() bool {
+	state, _ := b.state.get()
+	return state == StateEnabled
+}
+
+// skipped returns why the writes are not sent to the backend, if they are not
+func (b *httpBackend) skipped() error {
+	switch state, mode := b.state.get(); {
+	case state == StateDraining:
+		return errBackendDraining
+	case state == StateDisabled && mode == DisabledDiscard:
+		return errBackendDisabled
+	}
+	return nil
+}
+
+// backendInfo describes a backend for the admin API
+type backendInfo struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	State    string `json:"state"`
+	Mode     string `json:"mode,omitempty"`
+	Down     bool   `json:"down"`
+
+	// State of the retry buffer, if any
+	Buffering *bool `json:"buffering,omitempty"`
+	Paused    *bool `json:"paused,omitempty"`
+	Size      *int  `json:"size,omitempty"`
+}
+
+func newBackendInfo(b *httpBackend) backendInfo {
+	info := backendInfo{
+		Name:     b.name,
+		Location: b.location,
+		Down:     b.health.isDown(),
+	}
+	info.State, info.Mode = b.state.get()
+
+	if r := b.getRetryBuffer(); r != nil {
+		buffering := atomic.LoadInt32(&r.buffering) == 1
+		paused := atomic.LoadInt32(&r.paused) == 1
+		size := r.list.getSize()
+		info.Buffering, info.Paused, info.Size = &buffering, &paused, &size
+	}
+	return info
+}
+
+// backend returns the backend named in the query string,
+// writing an error to the client when there is none
+func (h *HTTP) backend(w http.ResponseWriter, r *http.Request) (*httpBackend, bool) {
+	name := r.URL.Query().Get("backend")
+	if name == "" {
+		jsonResponse(w, response{http.StatusBadRequest, "missing parameter: backend"})
+		return nil, false
+	}
+
+	for _, b := range h.backends {
+		if b.name == name {
+			return b, true
+		}
+	}
+
+	jsonResponse(w, response{http.StatusNotFound, "unknown backend " + name})
+	return nil, false
+}
+
+// handleBackends lists the backends with their state, or
+// changes the state of one of them
+func (h *HTTP) handleBackends(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		list := make([]backendInfo, 0, len(h.backends))
+		for _, b := range h.backends {
+			list = append(list, newBackendInfo(b))
+		}
+
+		jsonResponse(w, response{http.StatusOK, list})
+
+	case http.MethodPost:
+		b, ok := h.backend(w, r)
+		if !ok {
+			return
+		}
+
+		queryParams := r.URL.Query()
+		if err := b.setState(queryParams.Get("state"), queryParams.Get("mode")); err != nil {
+			jsonResponse(w, response{http.StatusBadRequest, err.Error()})
+			return
+		}
+
+		h.logger.Info("backend state changed", "backend", b.name, "state", queryParams.Get("state"))
+		jsonResponse(w, response{http.StatusOK, newBackendInfo(b)})
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+	}
+}
+
+// handleBackendPause stops replaying the buffered writes of a backend,
+// its new writes are buffered until its retry buffer is resumed
+func (h *HTTP) handleBackendPause(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	h.pauseBackend(w, r, true)
+}
+
+// handleBackendResume replays the buffered writes of a backend again
+func (h *HTTP) handleBackendResume(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	h.pauseBackend(w, r, false)
+}
+
+func (h *HTTP) pauseBackend(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	b, ok := h.backend(w, r)
+	if !ok {
+		return
+	}
+
+	rb := b.getRetryBuffer()
+	if rb == nil {
+		jsonResponse(w, response{http.StatusNotFound, "no retry buffer for backend " + b.name})
+		return
+	}
+
+	// The buffer of a disabled backend is resumed by enabling it
+	if state, mode := b.state.get(); !paused && state == StateDisabled && mode == DisabledBuffer {
+		jsonResponse(w, response{http.StatusConflict, errBackendDisabled.Error()})
+		return
+	}
+
+	rb.setPaused(paused)
+	jsonResponse(w, response{http.StatusOK, newBackendInfo(b)})
+}
@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func stateBackend(name string, p poster) *httpBackend {
+	return &httpBackend{
+		poster:     p,
+		name:       name,
+		shard:      -1,
+		endpoints:  config.HTTPEndpointConfig{Write: "write", Query: "query"},
+		state:      new(backendState),
+		queryState: new(queryState),
+	}
+}
+
+func TestBackendStateWrites(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	posters := map[string]*fakePoster{"enabled": {}, "disabled": {}, "draining": {}}
+	for _, name := range []string{"enabled", "disabled", "draining"} {
+		b := stateBackend(name, posters[name])
+		assert.Nil(t, b.setState(name, ""))
+		h.backends = append(h.backends, b)
+	}
+
+	// The disabled backend has no retry buffer, its writes are discarded
+	state, mode := h.backends[1].state.get()
+	assert.Equal(t, StateDisabled, state)
+	assert.Equal(t, DisabledDiscard, mode)
+
+	// Only the enabled backend counts for the consistency
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 1\n"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&consistency=all", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleStandard(w, r, ti)
+	assert.Equal(t, http.StatusNoContent, w.code)
+	assert.Equal(t, "1", w.header.Get(HeaderBackends))
+	assert.Equal(t, 1, len(posters["enabled"].writes))
+	assert.Equal(t, 0, len(posters["disabled"].writes))
+	assert.Equal(t, 0, len(posters["draining"].writes))
+
+	// Only the enabled backend receives the queries
+	up, down := h.queries.available(h.backends, func(*httpBackend) bool { return true })
+	assert.Equal(t, []*httpBackend{h.backends[0]}, up)
+	assert.Equal(t, 0, len(down))
+}
+
+func TestBackendStateBuffer(t *testing.T) {
+	f := &fakePoster{}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Millisecond}, f)
+	r.initialInterval = time.Millisecond
+	b := stateBackend("buffered", r)
+
+	// A backend with a retry buffer holds its writes by default
+	assert.Nil(t, b.setState(StateDisabled, ""))
+	_, mode := b.state.get()
+	assert.Equal(t, DisabledBuffer, mode)
+
+	// The client is not held until the backend is enabled, and its
+	// pooled buffer may be reused before the write is sent
+	buf := getBuf()
+	buf.WriteString("cpu value=1\n")
+	resp, err := b.post(buf.Bytes(), "db=test", "", "write")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	f.Lock()
+	assert.Equal(t, 0, len(f.writes))
+	f.Unlock()
+	buf.Reset()
+	buf.WriteString("XXX garbage\n")
+	putBuf(buf)
+
+	// The buffered write is sent once the backend is enabled
+	assert.Nil(t, b.setState(StateEnabled, ""))
+	waitUntil(t, func() bool {
+		f.Lock()
+		defer f.Unlock()
+		return len(f.writes) == 1
+	})
+	assert.Equal(t, []string{"cpu value=1\n"}, f.writes)
+
+	assert.NotNil(t, b.setState("stopped", ""))
+	assert.NotNil(t, b.setState(StateDisabled, "drop"))
+	assert.NotNil(t, stateBackend("simple", &fakePoster{}).setState(StateDisabled, DisabledBuffer))
+}
+
+func TestBackendStateReload(t *testing.T) {
+	cfg := config.HTTPOutputConfig{Name: "buffered", Location: "http://127.0.0.1:8086/", BufferSizeMB: 1}
+	prev, err := newHTTPBackend(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prev.getRetryBuffer().close()
+	assert.Nil(t, prev.setState(StateDisabled, DisabledBuffer))
+
+	// Once its retry buffer is removed, the disabled backend discards its writes
+	cfg.BufferSizeMB = 0
+	b, err := reuseHTTPBackend(&cfg, nil, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, mode := b.state.get()
+	assert.Equal(t, StateDisabled, state)
+	assert.Equal(t, DisabledDiscard, mode)
+	_, err = b.post([]byte("cpu value=1\n"), "db=test", "", "write")
+	assert.Equal(t, errBackendDisabled, err)
+
+	// The running backend still holds its writes
+	_, mode = prev.state.get()
+	assert.Equal(t, DisabledBuffer, mode)
+}
+
+func TestHandleBackends(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Millisecond}, &fakePoster{})
+	h.backends = []*httpBackend{stateBackend("simple", &fakePoster{}), stateBackend("buffered", r)}
+
+	for _, c := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodPost, "/admin/backends?backend=simple&state=disabled", http.StatusOK},
+		{http.MethodPost, "/admin/backends?backend=simple&state=paused", http.StatusBadRequest},
+		{http.MethodPost, "/admin/backends?backend=unknown&state=enabled", http.StatusNotFound},
+		{http.MethodPost, "/admin/backends?state=enabled", http.StatusBadRequest},
+		{http.MethodPut, "/admin/backends", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/backends/pause?backend=buffered", http.StatusOK},
+		{http.MethodPost, "/admin/backends/pause?backend=simple", http.StatusNotFound},
+	} {
+		resetWriter()
+		req, err := http.NewRequest(c.method, ValidServer.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		captureOutput(func() {
+			handlers[req.URL.Path](h, w, req, ti)
+		})
+		assert.Equal(t, c.code, w.code, c.path)
+	}
+
+	resetWriter()
+	req, err := http.NewRequest(http.MethodGet, ValidServer.URL+"/admin/backends", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.handleBackends(w, req, ti)
+
+	var list []backendInfo
+	assert.Nil(t, json.Unmarshal(w.writeBuf.Bytes(), &list))
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, StateDisabled, list[0].State)
+	assert.Nil(t, list[0].Paused)
+	assert.Equal(t, StateEnabled, list[1].State)
+	assert.True(t, *list[1].Paused)
+
+	// The disabled backend is not checked by /health
+	resetWriter()
+	h.backends = h.backends[:1]
+	h.handleHealth(w, nil, ti)
+
+	var report healthReport
+	assert.Nil(t, json.Unmarshal(w.writeBuf.Bytes(), &report))
+	assert.Equal(t, map[string]string{"simple": StateDisabled}, report.Maintenance)
+	assert.Equal(t, 0, len(report.Problem))
+}
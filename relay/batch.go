@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+// Defaults of the batches of the HTTP outputs of the UDP and Graphite relays
+const (
+	DefaultUDPBatchSizeKB   = 64
+	DefaultUDPBatchInterval = time.Second
+)
+
+// isHTTPLocation tells whether an output of a UDP relay is written to over HTTP
+func isHTTPLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// batchRelay is the relay whose points a batch backend writes
+type batchRelay struct {
+	name      string
+	precision string
+	logger    *logging.Logger
+}
+
+// batchBackend batches the points received by a UDP or Graphite relay and
+// writes them to an InfluxDB server over HTTP, through the poster and retry
+// buffer of an HTTP backend
+type batchBackend struct {
+	*httpBackend
+
+	relay batchRelay
+
+	// Query string of the writes, and the database and retention policy it names
+	query  string
+	db, rp string
+
+	maxSize  int
+	interval time.Duration
+
+	mu     sync.Mutex
+	buf    *bytes.Buffer
+	points int
+
+	// full is signaled when the batch reached its maximum size
+	full chan struct{}
+}
+
+func newBatchBackend(r batchRelay, cfg *config.UDPOutputConfig, fs config.Filters, ts config.Transforms, prev *httpBackend) (*batchBackend, error) {
+	if cfg.DB == "" {
+		return nil, fmt.Errorf("missing db for the HTTP output %q", cfg.Name)
+	}
+
+	hcfg := config.HTTPOutputConfig{
+		Name:                cfg.Name,
+		Location:            cfg.Location,
+		Username:            cfg.Username,
+		Password:            cfg.Password,
+		Token:               cfg.Token,
+		Endpoints:           config.HTTPEndpointConfig{Write: "/write"},
+		Timeout:             cfg.Timeout,
+		BufferSizeMB:        cfg.BufferSizeMB,
+		BufferPath:          cfg.BufferPath,
+		MaxDelayInterval:    cfg.MaxDelayInterval,
+		SkipTLSVerification: cfg.SkipTLSVerification,
+	}
+	if strings.HasSuffix(hcfg.Location, "/") {
+		hcfg.Endpoints.Write = "write"
+	}
+
+	hb, err := reuseHTTPBackend(&hcfg, fs, prev)
+	if err != nil {
+		return nil, err
+	}
+	hb.transforms = outputTransforms(ts, cfg.Name)
+	if rb := hb.getRetryBuffer(); rb != nil {
+		rb.setDetached()
+	}
+
+	b := &batchBackend{
+		httpBackend: hb,
+		relay:       r,
+		db:          cfg.DB,
+		rp:          cfg.RP,
+		maxSize:     DefaultUDPBatchSizeKB * KB,
+		interval:    DefaultUDPBatchInterval,
+		buf:         getBuf(),
+		full:        make(chan struct{}, 1),
+	}
+
+	if cfg.BatchSizeKB > 0 {
+		b.maxSize = cfg.BatchSizeKB * KB
+	}
+
+	if cfg.BatchInterval != "" {
+		if b.interval, err = time.ParseDuration(cfg.BatchInterval); err != nil {
+			return nil, fmt.Errorf("error parsing batch interval of %q: %v", cfg.Name, err)
+		}
+		if b.interval <= 0 {
+			return nil, fmt.Errorf("invalid batch interval of %q: %v", cfg.Name, b.interval)
+		}
+	}
+
+	params := url.Values{"db": {cfg.DB}}
+	if cfg.RP != "" {
+		params.Set("rp", cfg.RP)
+	}
+	if r.precision != "" {
+		params.Set("precision", r.precision)
+	}
+	b.query = params.Encode()
+
+	return b, nil
+}
+
+// add queues the points for the next batch
+func (b *batchBackend) add(points models.Points, now time.Time) {
+	kept := b.filterPoints(points, b.db, b.rp, now)
+	if dropped := len(points) - len(kept); dropped > 0 {
+		metricPointsFiltered.add(float64(dropped), b.relay.name, b.name)
+	}
+
+	kept = b.transforms.apply(kept)
+	if len(kept) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	writePoints(b.buf, kept, b.relay.precision)
+	b.points += len(kept)
+	full := b.buf.Len() >= b.maxSize
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the batches until stop is closed, and then the last one
+func (b *batchBackend) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-stop:
+			b.flush()
+			return
+		}
+		b.flush()
+	}
+}
+
+// flush sends the current batch, the retry buffer of the backend holding it
+// while the backend fails. It is only called by run, so a single batch is
+// sent at a time and the last one is sent before run returns
+func (b *batchBackend) flush() {
+	b.mu.Lock()
+	if b.buf.Len() == 0 {
+		b.mu.Unlock()
+		return
+	}
+	buf, points := b.buf, b.points
+	b.buf, b.points = getBuf(), 0
+	b.mu.Unlock()
+
+	// The retry buffer copies the batch when it holds it
+	defer putBuf(buf)
+
+	start := time.Now()
+	resp, err := b.post(buf.Bytes(), b.query, "", b.endpoints.Write)
+	if err != nil {
+		b.relay.logger.Error("unable to post", "backend", b.name, "error", err)
+	} else if resp.StatusCode/100 != 2 {
+		b.relay.logger.Warn("write rejected", "backend", b.name, "status", resp.StatusCode)
+	}
+
+	observeBackendWrite(b.relay.name, b.httpBackend, points, buf.Len(), resp, err, start)
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+type udpWrite struct {
+	query string
+	body  string
+}
+
+func TestUDPHTTPOutput(t *testing.T) {
+	writes := make(chan udpWrite, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		writes <- udpWrite{r.URL.RawQuery, string(data)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	fs := config.Filters{{Type: config.FilterExclude, MeasurementExpression: "^debug$", Outputs: []string{"http"}}}
+	assert.Nil(t, fs.LoadRegexps())
+
+	cfg := config.UDPConfig{
+		Addr:      "127.0.0.1:0",
+		Precision: "s",
+		Outputs: []config.UDPOutputConfig{
+			{Name: "http", Location: server.URL, DB: "udp", RP: "short", BatchInterval: "10ms"},
+		},
+	}
+	r, err := NewUDP(cfg, fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.(*UDP)
+
+	done := make(chan error)
+	go func() { done <- u.Run() }()
+
+	c, err := net.Dial("udp", u.ls[0].LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte("cpu value=1 1\ndebug value=2 2\n"))
+	assert.Nil(t, err)
+
+	select {
+	case write := <-writes:
+		assert.Equal(t, "db=udp&precision=s&rp=short", write.query)
+		assert.Equal(t, "cpu value=1 1\n", write.body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write received")
+	}
+
+	assert.Nil(t, u.Stop())
+	assert.Nil(t, <-done)
+}
+
+func TestUDPHTTPBatches(t *testing.T) {
+	r := batchRelay{name: "udp", logger: logging.Default()}
+	b, err := newBatchBackend(r, &config.UDPOutputConfig{Name: "http", Location: "http://127.0.0.1:1/", DB: "udp", BatchSizeKB: 1}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "write", b.endpoints.Write)
+
+	points, err := models.ParsePointsString("cpu value=1 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend is signaled once its batch is full
+	for i := 0; i < 100; i++ {
+		b.add(points, time.Now())
+	}
+	assert.Equal(t, 1, len(b.full))
+	assert.Equal(t, 100, b.points)
+
+	for _, cfg := range []config.UDPOutputConfig{
+		{Name: "nodb", Location: "http://127.0.0.1:1/"},
+		{Name: "interval", Location: "http://127.0.0.1:1/", DB: "udp", BatchInterval: "often"},
+	} {
+		_, err := newBatchBackend(r, &cfg, nil, nil, nil)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestBatchBackendStop(t *testing.T) {
+	r := batchRelay{name: "udp", logger: logging.Default()}
+	b, err := newBatchBackend(r, &config.UDPOutputConfig{Name: "down", Location: "http://127.0.0.1:1/", DB: "udp", BufferSizeMB: 1}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := b.getRetryBuffer()
+	defer rb.close()
+	f := &fakePoster{down: 1}
+	rb.setTarget(f)
+	rb.initialInterval = time.Millisecond
+
+	points, err := models.ParsePointsString("cpu value=1 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.add(points, time.Now())
+
+	// The last batch is sent before run returns, and is buffered
+	// without waiting for the backend to come back
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		b.run(stop)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return")
+	}
+	assert.True(t, b.behind())
+
+	// The buffered batch is not changed when its buffer is reused
+	buf := getBuf()
+	buf.WriteString("XXX garbage\n")
+	putBuf(buf)
+
+	atomic.StoreInt32(&f.down, 0)
+	waitUntil(t, func() bool {
+		f.Lock()
+		defer f.Unlock()
+		return len(f.writes) == 1
+	})
+	assert.Equal(t, []string{"cpu value=1 1\n"}, f.writes)
+}
@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Headers reporting how many backends acknowledged a write
+const (
+	HeaderAcks     = "X-Relay-Acks"
+	HeaderBackends = "X-Relay-Backends"
+
+	// HeaderReport asks for the outcome of a write on every backend
+	HeaderReport = "X-Relay-Report"
+)
+
+// consistencyLevel returns the consistency level requested by the
+// client, or the one of the relay, and removes it from the query
+// as it only makes sense to the relay
+func (h *HTTP) consistencyLevel(queryParams url.Values) (models.ConsistencyLevel, error) {
+	level := queryParams.Get("consistency")
+	queryParams.Del("consistency")
+
+	if level == "" {
+		return h.consistency, nil
+	}
+
+	return models.ParseConsistencyLevel(level)
+}
+
+// requiredAcks is the number of backends that must
+// acknowledge a write sent to n backends
+func requiredAcks(level models.ConsistencyLevel, n int) int {
+	switch level {
+	case models.ConsistencyLevelQuorum:
+		return n/2 + 1
+	case models.ConsistencyLevelAll:
+		return n
+	default:
+		return 1
+	}
+}
+
+// backendResult is the outcome of a write on a backend
+type backendResult struct {
+	Name     string  `json:"name"`
+	Status   int     `json:"status"`
+	Latency  float64 `json:"latency_ms"`
+	Buffered bool    `json:"buffered"`
+	Filtered bool    `json:"filtered"`
+	Error    string  `json:"error,omitempty"`
+
+	resp *responseData
+}
+
+func newBackendResult(b *httpBackend, resp *responseData, err error, start time.Time) *backendResult {
+	res := &backendResult{
+		Name:    b.name,
+		Latency: float64(time.Since(start)) / float64(time.Millisecond),
+		resp:    resp,
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		res.resp = &responseData{}
+		return res
+	}
+
+	res.Status = resp.StatusCode
+	res.Buffered = resp.StatusCode == http.StatusAccepted
+	if resp.StatusCode/100 != 2 {
+		res.Error = strings.TrimSpace(string(resp.Body))
+	}
+	return res
+}
+
+// writeReport details the outcome of a write on every backend
+type writeReport struct {
+	Acks     int              `json:"acks"`
+	Backends int              `json:"backends"`
+	Error    string           `json:"error,omitempty"`
+	Outputs  []*backendResult `json:"outputs"`
+}
+
+// writeOptions returns the consistency level and whether the client asked
+// for a report, removing them from the query as they only make sense to the relay
+func (h *HTTP) writeOptions(r *http.Request, queryParams url.Values) (models.ConsistencyLevel, bool, error) {
+	report := queryParams.Get("report") == "true" || r.Header.Get(HeaderReport) == "true"
+	queryParams.Del("report")
+
+	level, err := h.consistencyLevel(queryParams)
+	return level, report, err
+}
+
+// writeResult reads the results of the n backends a write was sent to,
+// and answers the client as soon as the consistency level is met.
+// Buffered writes (202) only count for the "any" level, which answers
+// a 202 only when no backend wrote the points.
+// When a report is asked for, every result is waited for and
+// the client receives a JSON report instead of an empty body.
+// The results read before answering are returned.
+func (h *HTTP) writeResult(w http.ResponseWriter, results <-chan *backendResult, level models.ConsistencyLevel, n int, report bool) []*backendResult {
+	required := requiredAcks(level, n)
+	acks, buffered := 0, 0
+
+	var userError *backendResult
+	outputs := []*backendResult{}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set(HeaderBackends, strconv.Itoa(n))
+
+	for res := range results {
+		outputs = append(outputs, res)
+		if res.Filtered {
+			continue
+		}
+
+		switch res.Status / 100 {
+		case 2:
+			// Status accepted means buffering,
+			if res.Buffered {
+				h.logger.Debug("write buffered", "backend", res.Name)
+				buffered++
+			} else {
+				acks++
+			}
+
+		case 4:
+			// User error
+			if userError == nil {
+				userError = res
+			}
+		}
+
+		// A buffered write does not end the wait, a backend
+		// may still write the points and the client get a 204
+		if !report && (acks >= required || userError != nil) {
+			break
+		}
+	}
+
+	w.Header().Set(HeaderAcks, strconv.Itoa(acks))
+
+	var code int
+	var msg string
+	var forward *responseData
+	switch {
+	case acks >= required && acks > 0:
+		code = http.StatusNoContent
+	case level == models.ConsistencyLevelAny && buffered > 0:
+		code = http.StatusAccepted
+	case userError != nil:
+		code, msg = userError.Status, userError.Error
+		forward = userError.resp
+	case acks+buffered == 0:
+		// Failed to make any valid request...
+		code, msg = http.StatusServiceUnavailable, "unable to write points"
+	default:
+		code, msg = http.StatusInternalServerError, fmt.Sprintf("partial write: %d/%d backends acknowledged", acks, n)
+	}
+
+	if report {
+		// A 204 can't hold the report
+		if code == http.StatusNoContent {
+			code = http.StatusOK
+		}
+
+		jsonResponse(w, response{code, writeReport{Acks: acks, Backends: n, Error: msg, Outputs: outputs}})
+		return outputs
+	}
+
+	switch {
+	case forward != nil:
+		forward.Write(w)
+	case code/100 == 2:
+		w.WriteHeader(code)
+	default:
+		jsonResponse(w, response{code, msg})
+	}
+	return outputs
+}
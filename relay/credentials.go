@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// Policies of the backends on the credentials of the clients
+const (
+	AuthPassthrough = "passthrough"
+	AuthOverride    = "override"
+	AuthStrip       = "strip"
+)
+
+// backendAuth decides the credentials sent to a backend
+type backendAuth struct {
+	policy string
+
+	// Authorization header of the credentials of the backend, empty when none
+	header string
+}
+
+// resolveSecret returns the value of a secret of the configuration,
+// which may be read from an environment variable or a file
+func resolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		v, ok := os.LookupEnv(s[len("env:"):])
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", s[len("env:"):])
+		}
+		return v, nil
+
+	case strings.HasPrefix(s, "file:"):
+		data, err := ioutil.ReadFile(s[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return s, nil
+}
+
+func newBackendAuth(cfg *config.HTTPOutputConfig) (*backendAuth, error) {
+	var secrets [3]string
+	for i, s := range []string{cfg.Username, cfg.Password, cfg.Token} {
+		v, err := resolveSecret(s)
+		if err != nil {
+			return nil, fmt.Errorf("error reading credentials of %q: %v", cfg.Name, err)
+		}
+		secrets[i] = v
+	}
+	username, password, token := secrets[0], secrets[1], secrets[2]
+
+	a := &backendAuth{policy: cfg.AuthPolicy}
+	switch {
+	case token != "" && username != "":
+		return nil, fmt.Errorf("both a token and a username are set for %q", cfg.Name)
+	case token != "":
+		a.header = "Token " + token
+	case username != "":
+		a.header = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	case password != "":
+		return nil, fmt.Errorf("a password without a username is set for %q", cfg.Name)
+	}
+
+	switch a.policy {
+	case "":
+		a.policy = AuthPassthrough
+		if a.header != "" {
+			a.policy = AuthOverride
+		}
+	case AuthPassthrough, AuthStrip:
+	case AuthOverride:
+		if a.header == "" {
+			return nil, fmt.Errorf("no credentials to override those of the clients for %q", cfg.Name)
+		}
+	default:
+		return nil, fmt.Errorf("invalid auth policy %q for %q", a.policy, cfg.Name)
+	}
+
+	return a, nil
+}
+
+// apply returns the query string and authorization header sent to the backend,
+// from the ones of the client
+func (a *backendAuth) apply(query string, auth string) (string, string) {
+	if a.policy == AuthPassthrough {
+		if auth == "" && a.header != "" && !hasQueryCredentials(query) {
+			auth = a.header
+		}
+		return query, auth
+	}
+
+	query = stripQueryCredentials(query)
+	if a.policy == AuthOverride {
+		return query, a.header
+	}
+	return query, ""
+}
+
+// client returns the credentials of a client kept in its writes: only the
+// passthrough policy needs them, the credentials of the backend are added
+// when the writes are sent, so that they are never buffered
+func (a *backendAuth) client(query string, auth string) (string, string) {
+	if a.policy == AuthPassthrough {
+		return query, auth
+	}
+	return stripQueryCredentials(query), ""
+}
+
+// credentialsPoster sends the writes with the credentials of the backend,
+// resolved from those of the client when the write is sent or replayed
+type credentialsPoster struct {
+	poster
+	auth *backendAuth
+}
+
+func (c *credentialsPoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	query, auth = c.auth.apply(query, auth)
+	return c.poster.post(buf, query, auth, endpoint)
+}
+
+func hasQueryCredentials(query string) bool {
+	params, err := url.ParseQuery(query)
+	return err == nil && (params.Get("u") != "" || params.Get("p") != "")
+}
+
+// stripQueryCredentials removes the u and p parameters of a query string
+func stripQueryCredentials(query string) string {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+
+	if _, ok := params["u"]; !ok {
+		if _, ok := params["p"]; !ok {
+			return query
+		}
+	}
+
+	params.Del("u")
+	params.Del("p")
+	return params.Encode()
+}
+
+// authorize sets the credentials of a request sent to the backend
+func (b *httpBackend) authorize(req *http.Request) {
+	if b.auth == nil {
+		return
+	}
+
+	query, auth := b.auth.apply(req.URL.RawQuery, req.Header.Get("Authorization"))
+	req.URL.RawQuery = query
+	if auth == "" {
+		req.Header.Del("Authorization")
+	} else {
+		req.Header.Set("Authorization", auth)
+	}
+}
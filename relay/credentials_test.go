@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "password")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+	os.Setenv("RELAY_TEST_SECRET", "from-env")
+	defer os.Unsetenv("RELAY_TEST_SECRET")
+
+	for secret, expected := range map[string]string{
+		"plain":                 "plain",
+		"env:RELAY_TEST_SECRET": "from-env",
+		"file:" + path:          "from-file",
+	} {
+		v, err := resolveSecret(secret)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+
+	_, err = resolveSecret("env:RELAY_TEST_MISSING")
+	assert.NotNil(t, err)
+	_, err = resolveSecret("file:" + filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestBackendAuth(t *testing.T) {
+	const client = "Basic Y2xpZW50OnB3ZA=="
+	const query = "db=test&p=pwd&u=client"
+
+	for _, c := range []struct {
+		cfg   config.HTTPOutputConfig
+		query string
+		auth  string
+	}{
+		// No credentials, the ones of the client are forwarded
+		{config.HTTPOutputConfig{}, query, client},
+		// The credentials of the backend replace the ones of the client
+		{config.HTTPOutputConfig{Username: "relay", Password: "secret"}, "db=test", "Basic cmVsYXk6c2VjcmV0"},
+		{config.HTTPOutputConfig{Token: "token"}, "db=test", "Token token"},
+		// The credentials of the client are kept
+		{config.HTTPOutputConfig{Token: "token", AuthPolicy: AuthPassthrough}, query, client},
+		// No credentials at all
+		{config.HTTPOutputConfig{Token: "token", AuthPolicy: AuthStrip}, "db=test", ""},
+	} {
+		a, err := newBackendAuth(&c.cfg)
+		assert.Nil(t, err)
+
+		q, auth := a.apply(query, client)
+		assert.Equal(t, c.query, q, c.cfg.AuthPolicy)
+		assert.Equal(t, c.auth, auth, c.cfg.AuthPolicy)
+	}
+
+	// The credentials of the backend are used when the client sent none
+	a, _ := newBackendAuth(&config.HTTPOutputConfig{Token: "token", AuthPolicy: AuthPassthrough})
+	_, auth := a.apply("db=test", "")
+	assert.Equal(t, "Token token", auth)
+
+	for _, cfg := range []config.HTTPOutputConfig{
+		{Username: "relay", Token: "token"},
+		{Password: "secret"},
+		{AuthPolicy: AuthOverride},
+		{AuthPolicy: "forward"},
+		{Token: "env:RELAY_TEST_MISSING"},
+	} {
+		_, err := newBackendAuth(&cfg)
+		assert.NotNil(t, err, cfg)
+	}
+}
+
+// authPoster records the credentials of the writes
+type authPoster struct {
+	fakePoster
+	queries []string
+	auths   []string
+}
+
+func (p *authPoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	p.queries = append(p.queries, query)
+	p.auths = append(p.auths, auth)
+	return p.fakePoster.post(buf, query, auth, endpoint)
+}
+
+func TestBackendPostCredentials(t *testing.T) {
+	p := new(authPoster)
+	a, _ := newBackendAuth(&config.HTTPOutputConfig{Token: "token"})
+	b := &httpBackend{poster: p, auth: a}
+
+	// The poster, and thus the retry buffer, does not see the credentials:
+	// the writes of every client can share a batch, and the credentials
+	// of the backend are not buffered
+	b.post([]byte("cpu value=1\n"), "db=test&u=a&p=a", "", "write")
+	b.post([]byte("cpu value=2\n"), "db=test", "Basic Yjpi", "write")
+	assert.Equal(t, []string{"db=test", "db=test"}, p.queries)
+	assert.Equal(t, []string{"", ""}, p.auths)
+
+	// They are added when the writes are sent
+	p = new(authPoster)
+	b.poster = &credentialsPoster{poster: p, auth: a}
+	b.post([]byte("cpu value=1\n"), "db=test&u=a&p=a", "", "write")
+	assert.Equal(t, []string{"db=test"}, p.queries)
+	assert.Equal(t, []string{"Token token"}, p.auths)
+}
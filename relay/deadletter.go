@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+// Default size of the dead letters store
+const DefaultDeadLetterSizeMB = 10
+
+const deadLetterSuffix = ".dl"
+
+// ErrDeadLettersFull error indicates that the dead letters store is full
+var ErrDeadLettersFull = errors.New("dead letters store full")
+
+// deadLetter holds lines the backend kept on rejecting
+type deadLetter struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Query    string    `json:"query"`
+	Endpoint string    `json:"endpoint"`
+	Status   int       `json:"status"`
+	Lines    int       `json:"lines"`
+	Size     int       `json:"size"`
+
+	// query is the query string of the writes, Query the one
+	// shown by the admin API, without the credentials
+	query string
+	auth  string
+	data  []byte
+}
+
+// deadLetters stores the poison lines of a backend,
+// in memory or in a directory when a path is given
+type deadLetters struct {
+	mu sync.Mutex
+
+	dir     string
+	maxSize int
+	size    int
+
+	nextID  uint64
+	letters []*deadLetter
+}
+
+func newDeadLetters(dir string, maxSize int) (*deadLetters, error) {
+	d := &deadLetters{dir: dir, maxSize: maxSize, nextID: 1}
+	if dir == "" {
+		return d, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), deadLetterSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), deadLetterSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		l, err := d.load(id)
+		if err != nil {
+			logging.Warn("ignoring dead letter", "file", f.Name(), "error", err)
+			continue
+		}
+
+		d.letters = append(d.letters, l)
+		d.size += l.Size
+		if id >= d.nextID {
+			d.nextID = id + 1
+		}
+	}
+
+	sort.Slice(d.letters, func(i, j int) bool { return d.letters[i].ID < d.letters[j].ID })
+	return d, nil
+}
+
+func (d *deadLetters) path(id uint64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%020d%s", id, deadLetterSuffix))
+}
+
+// A dead letter file holds the time (8 bytes), the status (4 bytes),
+// then the lines stored the same way as in the persisted retry buffer
+func (d *deadLetters) load(id uint64) (*deadLetter, error) {
+	f, err := os.Open(d.path(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var header [12]byte
+	if _, err = f.ReadAt(header[:], 0); err != nil {
+		return nil, err
+	}
+
+	rec, _, err := readRecordAt(f, int64(len(header)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadLetter{
+		ID:       id,
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+		Status:   int(binary.BigEndian.Uint32(header[8:])),
+		Query:    stripQueryCredentials(rec.query),
+		Endpoint: rec.endpoint,
+		Lines:    len(splitLines(rec.data)),
+		Size:     len(rec.data),
+		query:    rec.query,
+		auth:     rec.auth,
+		data:     rec.data,
+	}, nil
+}
+
+func (d *deadLetters) save(l *deadLetter) error {
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(l.Time.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:], uint32(l.Status))
+
+	data := append(header[:], encodeRecord(l.data, l.query, l.auth, l.Endpoint)...)
+	return ioutil.WriteFile(d.path(l.ID), data, 0600)
+}
+
+func (d *deadLetters) add(buf []byte, query string, auth string, endpoint string, status int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.size+len(buf) > d.maxSize {
+		return ErrDeadLettersFull
+	}
+
+	l := &deadLetter{
+		ID:       d.nextID,
+		Time:     time.Now(),
+		Query:    stripQueryCredentials(query),
+		Endpoint: endpoint,
+		Status:   status,
+		Lines:    len(splitLines(buf)),
+		Size:     len(buf),
+		query:    query,
+		auth:     auth,
+		data:     buf,
+	}
+
+	if d.dir != "" {
+		if err := d.save(l); err != nil {
+			return err
+		}
+	}
+
+	d.nextID++
+	d.size += l.Size
+	d.letters = append(d.letters, l)
+	return nil
+}
+
+// list returns the dead letters, oldest first
+func (d *deadLetters) list() []*deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*deadLetter(nil), d.letters...)
+}
+
+// get returns a dead letter, or every dead letter when id is 0
+func (d *deadLetters) get(id uint64) []*deadLetter {
+	if id == 0 {
+		return d.list()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, l := range d.letters {
+		if l.ID == id {
+			return []*deadLetter{l}
+		}
+	}
+	return nil
+}
+
+// remove drops a dead letter, typically once it has been resubmitted
+func (d *deadLetters) remove(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, l := range d.letters {
+		if l.ID != id {
+			continue
+		}
+
+		if d.dir != "" {
+			if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+				logging.Error("unable to remove dead letter", "id", id, "error", err)
+			}
+		}
+
+		d.size -= l.Size
+		d.letters = append(d.letters[:i], d.letters[i+1:]...)
+		return true
+	}
+
+	return false
+}
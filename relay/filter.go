@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"errors"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+var errPointsFiltered = errors.New("no point matches the filters")
+
+// outputFilters returns the filters applying to the output
+func outputFilters(fs config.Filters, name string) []*config.Filter {
+	var res []*config.Filter
+	for i := range fs {
+		for _, output := range fs[i].Outputs {
+			if output == name {
+				res = append(res, &fs[i])
+				break
+			}
+		}
+	}
+	return res
+}
+
+// filterMatches tells whether a point of a write on db and rp,
+// received at now, matches all the criteria of the filter
+func filterMatches(f *config.Filter, p models.Point, db, rp string, now time.Time) bool {
+	if f.DatabaseRegexp != nil && !f.DatabaseRegexp.MatchString(db) {
+		return false
+	}
+	if f.RetentionPolicyRegexp != nil && !f.RetentionPolicyRegexp.MatchString(rp) {
+		return false
+	}
+
+	if f.MaxAgeDuration > 0 && p.Time().Before(now.Add(-f.MaxAgeDuration)) {
+		return false
+	}
+
+	if f.MeasurementRegexp != nil && !f.MeasurementRegexp.Match(p.Name()) {
+		return false
+	}
+
+	if f.TagRegexp != nil {
+		for _, t := range p.Tags() {
+			if !f.TagRegexp.Match(t.Key) {
+				return false
+			}
+		}
+	}
+
+	if len(f.TagValueRegexps) > 0 {
+		tags := p.Tags()
+		for k, r := range f.TagValueRegexps {
+			v := tags.Get([]byte(k))
+			if v == nil || !r.Match(v) {
+				return false
+			}
+		}
+	}
+
+	if f.FieldRegexp != nil {
+		matched := false
+		for it := p.FieldIterator(); !matched && it.Next(); {
+			matched = f.FieldRegexp.Match(it.FieldKey())
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// accepts tells whether a point is sent to the backend: it must match
+// all its include filters and none of its exclude filters
+func (b *httpBackend) accepts(p models.Point, db, rp string, now time.Time) bool {
+	for _, f := range b.filters {
+		if filterMatches(f, p, db, rp, now) == (f.Type == config.FilterExclude) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterPoints returns the points sent to the backend, which
+// are the points given when none of them is filtered out
+func (b *httpBackend) filterPoints(points models.Points, db, rp string, now time.Time) models.Points {
+	if len(b.filters) == 0 {
+		return points
+	}
+
+	var kept models.Points
+	for i, p := range points {
+		switch ok := b.accepts(p, db, rp, now); {
+		case kept != nil:
+			if ok {
+				kept = append(kept, p)
+			}
+		case !ok:
+			kept = make(models.Points, i, len(points))
+			copy(kept, points[:i])
+		}
+	}
+
+	if kept == nil {
+		return points
+	}
+	return kept
+}
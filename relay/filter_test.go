@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func filterLines(t *testing.T, fs config.Filters, db string, lines string) string {
+	assert.Nil(t, fs.LoadRegexps())
+
+	points, err := models.ParsePointsString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &httpBackend{name: "output", filters: outputFilters(fs, "output")}
+	var buf bytes.Buffer
+	writePoints(&buf, b.filterPoints(points, db, "", time.Unix(0, 100)), "")
+	return buf.String()
+}
+
+func TestFilters(t *testing.T) {
+	const lines = "cpu,host=web-1 value=1 90\ncpu,host=db-1 value=2 90\nmem,host=web-1 used=3 10"
+
+	for _, c := range []struct {
+		filter   config.Filter
+		db       string
+		expected string
+	}{
+		// Legacy filters keep the points whose tag keys and measurement match
+		{config.Filter{MeasurementExpression: "^cpu$"}, "", "cpu,host=web-1 value=1 90\ncpu,host=db-1 value=2 90\n"},
+		{config.Filter{TagExpression: "^region$"}, "", ""},
+
+		{config.Filter{Tags: map[string]string{"host": "^web-"}}, "", "cpu,host=web-1 value=1 90\nmem,host=web-1 used=3 10\n"},
+		{config.Filter{Type: config.FilterExclude, Tags: map[string]string{"host": "^web-"}}, "", "cpu,host=db-1 value=2 90\n"},
+		{config.Filter{Type: config.FilterExclude, FieldExpression: "^used$"}, "", "cpu,host=web-1 value=1 90\ncpu,host=db-1 value=2 90\n"},
+		{config.Filter{MaxAge: "50ns"}, "", "cpu,host=web-1 value=1 90\ncpu,host=db-1 value=2 90\n"},
+
+		// Points match when they match all the criteria of a filter
+		{config.Filter{Type: config.FilterExclude, DatabaseExpression: "^telegraf$", MeasurementExpression: "^mem$"}, "telegraf", "cpu,host=web-1 value=1 90\ncpu,host=db-1 value=2 90\n"},
+		{config.Filter{Type: config.FilterExclude, DatabaseExpression: "^telegraf$", MeasurementExpression: "^mem$"}, "other", lines + "\n"},
+	} {
+		c.filter.Outputs = []string{"output"}
+		assert.Equal(t, c.expected, filterLines(t, config.Filters{c.filter}, c.db, lines), "%+v", c.filter)
+	}
+
+	// The points must match all the include filters, and none of the exclude ones
+	fs := config.Filters{
+		{MeasurementExpression: "^cpu$", Outputs: []string{"output"}},
+		{Tags: map[string]string{"host": "^web-"}, Outputs: []string{"output"}},
+		{Type: config.FilterExclude, MeasurementExpression: ".", Outputs: []string{"other"}},
+	}
+	assert.Equal(t, "cpu,host=web-1 value=1 90\n", filterLines(t, fs, "", lines))
+
+	for _, fs := range []config.Filters{
+		{{Type: "drop"}},
+		{{FieldExpression: "("}},
+		{{Tags: map[string]string{"host": "("}}},
+		{{MaxAge: "a day"}},
+	} {
+		assert.NotNil(t, fs.LoadRegexps())
+	}
+}
+
+func TestHandleStandardFilters(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	fs := config.Filters{
+		{Type: config.FilterExclude, MeasurementExpression: "^debug$", Outputs: []string{"some"}},
+		{DatabaseExpression: "^other$", Outputs: []string{"none"}},
+	}
+	assert.Nil(t, fs.LoadRegexps())
+
+	posters := map[string]*fakePoster{"all": {}, "some": {}, "none": {}}
+	for _, name := range []string{"all", "some", "none"} {
+		b := stateBackend(name, posters[name])
+		b.filters = outputFilters(fs, name)
+		h.backends = append(h.backends, b)
+	}
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 1\ndebug value=2 2\n"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&consistency=all", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleStandard(w, r, ti)
+	assert.Equal(t, http.StatusNoContent, w.code)
+	assert.Equal(t, "2", w.header.Get(HeaderBackends))
+	assert.Equal(t, []string{"cpu value=1 1\ndebug value=2 2\n"}, posters["all"].writes)
+	assert.Equal(t, []string{"cpu value=1 1\n"}, posters["some"].writes)
+	assert.Equal(t, 0, len(posters["none"].writes))
+}
+
+func TestPointsToProm(t *testing.T) {
+	points, _, err := promToPoints(promRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := pointsToProm(points)
+	assert.Nil(t, err)
+
+	req, err := decodePromWrite(data)
+	assert.Nil(t, err)
+
+	converted, _, err := promToPoints(req)
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	writePoints(&buf, converted, "")
+	assert.Equal(t, promLines, buf.String())
+}
+
+// concurrentWrites sends the same point with a different host in
+// concurrent requests, and returns the lines the relay expects to write
+func concurrentWrites(t *testing.T, h *HTTP) []string {
+	const clients, requests = 8, 50
+
+	var wg sync.WaitGroup
+	var lines []string
+	for c := 0; c < clients; c++ {
+		for i := 0; i < requests; i++ {
+			lines = append(lines, fmt.Sprintf("cpu,host=c%d-%d value=1 1\n", c, i))
+		}
+
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				body := strings.NewReader(fmt.Sprintf("cpu,host=c%d-%d value=1 1\n", c, i))
+				r := httptest.NewRequest(http.MethodPost, "/write?db=test&consistency=all", body)
+				rec := httptest.NewRecorder()
+				h.handleStandard(rec, r, ti)
+				assert.Equal(t, http.StatusNoContent, rec.Code)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	sort.Strings(lines)
+	return lines
+}
+
+// sortedWrites returns the writes received by a poster
+func sortedWrites(f *fakePoster) []string {
+	f.Lock()
+	defer f.Unlock()
+	writes := append([]string(nil), f.writes...)
+	sort.Strings(writes)
+	return writes
+}
+
+func TestHandleStandardConcurrentFilters(t *testing.T) {
+	h := createHTTP(t, emptyConfig, false)
+
+	fs := config.Filters{{Tags: map[string]string{"host": "^c"}, Outputs: []string{"filtered"}}}
+	assert.Nil(t, fs.LoadRegexps())
+
+	// The filters read the points of the requests while the
+	// buffers of the previous requests are reused
+	f := &fakePoster{}
+	b := stateBackend("filtered", f)
+	b.filters = outputFilters(fs, "filtered")
+	h.backends = append(h.backends, b)
+
+	assert.Equal(t, concurrentWrites(t, h), sortedWrites(f))
+}
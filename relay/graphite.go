@@ -0,0 +1,326 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+// Protocols of the Graphite relays
+const (
+	GraphiteTCP = "tcp"
+	GraphiteUDP = "udp"
+)
+
+// Limits of the TCP clients: a longer line is dropped, and the points
+// of the lines received so far are written once there are this many
+const (
+	graphiteMaxLineSize = 64 * KB
+	graphiteMaxPoints   = 5000
+)
+
+// Graphite is a relay receiving the Graphite plaintext protocol over TCP or
+// UDP, and writing the points to InfluxDB servers over HTTP
+type Graphite struct {
+	name     string
+	addr     string
+	protocol string
+
+	parser *graphiteParser
+
+	closing int64
+	l       net.Listener
+	c       *net.UDPConn
+
+	// Connections of the TCP clients, closed when the relay stops
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	backends []*batchBackend
+
+	// Transforms of the points sent to every backend
+	transforms transforms
+
+	logger *logging.Logger
+}
+
+// NewGraphite creates the Graphite relay of a configuration
+func NewGraphite(cfg config.GraphiteConfig, fs config.Filters, ts config.Transforms) (Relay, error) {
+	return newGraphite(cfg, fs, ts, nil)
+}
+
+// Reload creates the relay of a new configuration, once g is stopped, sharing
+// the retry buffers of the outputs whose name and buffer settings did not change
+func (g *Graphite) Reload(cfg config.GraphiteConfig, fs config.Filters, ts config.Transforms) (Relay, error) {
+	var previous []*httpBackend
+	for _, b := range g.backends {
+		previous = append(previous, b.httpBackend)
+	}
+	return newGraphite(cfg, fs, ts, previous)
+}
+
+func newGraphite(cfg config.GraphiteConfig, fs config.Filters, ts config.Transforms, previous []*httpBackend) (_ Relay, err error) {
+	g := &Graphite{
+		name:     cfg.Name,
+		addr:     cfg.Addr,
+		protocol: cfg.Protocol,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	// The socket and the retry buffers created for a rejected configuration
+	// are closed, so that the previous relay can be brought back
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if g.l != nil {
+			g.l.Close()
+		}
+		if g.c != nil {
+			g.c.Close()
+		}
+		handOver(previous, httpBackendsOf(g))
+	}()
+	if g.protocol == "" {
+		g.protocol = GraphiteTCP
+	}
+	g.logger = logging.Default().With("relay", g.Name())
+	g.transforms = globalTransforms(ts)
+
+	if g.parser, err = newGraphiteParser(cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Outputs) == 0 {
+		return nil, errors.New("a Graphite relay needs at least one output")
+	}
+
+	for i := range cfg.Outputs {
+		out := &cfg.Outputs[i]
+		if out.Name == "" {
+			out.Name = out.Location
+		}
+		if !isHTTPLocation(out.Location) {
+			return nil, fmt.Errorf("the location of the output %q must be an HTTP URL", out.Name)
+		}
+
+		var prev *httpBackend
+		for _, b := range previous {
+			if b.name == out.Name {
+				prev = b
+			}
+		}
+
+		b, err := newBatchBackend(batchRelay{name: g.Name(), logger: g.logger}, out, fs, ts, prev)
+		if err != nil {
+			return nil, err
+		}
+		g.backends = append(g.backends, b)
+	}
+
+	switch g.protocol {
+	case GraphiteTCP:
+		g.l, err = net.Listen("tcp", g.addr)
+	case GraphiteUDP:
+		if g.c, err = listenUDP(g.addr, false); err == nil && cfg.ReadBuffer != 0 {
+			err = g.c.SetReadBuffer(cfg.ReadBuffer)
+		}
+	default:
+		err = fmt.Errorf("invalid Graphite protocol %q", g.protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Name returns the name of the relay, its address when it has none
+func (g *Graphite) Name() string {
+	if g.name == "" {
+		return g.addr
+	}
+	return g.name
+}
+
+// Run receives the metrics until the relay is stopped
+func (g *Graphite) Run() error {
+	// The batches of the backends are sent in the background
+	stop := make(chan struct{})
+	var batches sync.WaitGroup
+	for _, b := range g.backends {
+		batches.Add(1)
+		go func(b *batchBackend) {
+			defer batches.Done()
+			b.run(stop)
+		}(b)
+	}
+
+	var err error
+	if g.l != nil {
+		g.logger.Info("starting relay", "schema", "graphite", "protocol", g.protocol, "addr", g.l.Addr())
+		err = g.serveTCP()
+	} else {
+		g.logger.Info("starting relay", "schema", "graphite", "protocol", g.protocol, "addr", g.c.LocalAddr())
+		err = g.serveUDP()
+	}
+
+	// Send the last batches
+	close(stop)
+	batches.Wait()
+	return err
+}
+
+// Stop closes the listener and the connections of the clients
+func (g *Graphite) Stop() error {
+	atomic.StoreInt64(&g.closing, 1)
+
+	if g.c != nil {
+		return g.c.Close()
+	}
+
+	err := g.l.Close()
+
+	g.mu.Lock()
+	for c := range g.conns {
+		c.Close()
+	}
+	g.mu.Unlock()
+
+	return err
+}
+
+func (g *Graphite) serveTCP() error {
+	defer g.wg.Wait()
+
+	for {
+		c, err := g.l.Accept()
+		if err != nil {
+			if atomic.LoadInt64(&g.closing) == 0 {
+				g.logger.Error("unable to accept connection", "error", err)
+				return err
+			}
+			return nil
+		}
+
+		g.mu.Lock()
+		if atomic.LoadInt64(&g.closing) != 0 {
+			g.mu.Unlock()
+			c.Close()
+			continue
+		}
+		g.conns[c] = struct{}{}
+		g.wg.Add(1)
+		g.mu.Unlock()
+
+		go g.handleConn(c)
+	}
+}
+
+// handleConn reads the lines sent by a client, the points are written
+// once all the data received so far has been parsed, or once there are
+// graphiteMaxPoints of them
+func (g *Graphite) handleConn(c net.Conn) {
+	defer g.wg.Done()
+	defer func() {
+		g.mu.Lock()
+		delete(g.conns, c)
+		g.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReaderSize(c, graphiteMaxLineSize)
+	var points models.Points
+	for {
+		line, err := r.ReadSlice('\n')
+		now := time.Now()
+		if err == bufio.ErrBufferFull {
+			g.logger.Warn("dropping line too long", "client", c.RemoteAddr(), "max", graphiteMaxLineSize)
+			metricGraphiteParseErrors.add(1, g.Name())
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			line = nil
+		}
+
+		if p := g.parseLine(string(line), c.RemoteAddr(), now); p != nil {
+			points = append(points, p)
+		}
+
+		if len(points) > 0 && (err != nil || r.Buffered() == 0 || len(points) >= graphiteMaxPoints) {
+			g.write(points, now)
+			points = nil
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (g *Graphite) serveUDP() error {
+	// buffer that can hold the largest possible UDP payload
+	var buf [65536]byte
+
+	for {
+		n, remote, err := g.c.ReadFromUDP(buf[:])
+		if err != nil {
+			if atomic.LoadInt64(&g.closing) == 0 {
+				g.logger.Error("unable to read packet", "client", remote, "error", err)
+				return err
+			}
+			return nil
+		}
+
+		now := time.Now()
+		var points models.Points
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if p := g.parseLine(line, remote, now); p != nil {
+				points = append(points, p)
+			}
+		}
+
+		if len(points) > 0 {
+			g.write(points, now)
+		}
+	}
+}
+
+// parseLine returns the point of a line, nil when it is empty or invalid
+func (g *Graphite) parseLine(line string, from net.Addr, now time.Time) models.Point {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	metricBytesReceived.add(float64(len(line)), g.Name())
+
+	p, err := g.parser.parse(line, now)
+	if err != nil {
+		g.logger.Warn("unable to parse line", "client", from, "line", line, "error", err)
+		metricGraphiteParseErrors.add(1, g.Name())
+		return nil
+	}
+	return p
+}
+
+// write queues the points for the batches of the backends
+func (g *Graphite) write(points models.Points, now time.Time) {
+	metricPointsReceived.add(float64(len(points)), g.Name())
+
+	points = g.transforms.apply(points)
+	for _, b := range g.backends {
+		b.add(points, now)
+	}
+}
@@ -0,0 +1,309 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// Parts of the Graphite templates which are not tag keys
+const (
+	graphiteMeasurement       = "measurement"
+	graphiteMeasurementGreedy = "measurement*"
+	graphiteField             = "field"
+	graphiteFieldGreedy       = "field*"
+)
+
+// Defaults of the Graphite relays
+const (
+	DefaultGraphiteSeparator = "."
+	DefaultGraphiteTemplate  = graphiteMeasurementGreedy
+	DefaultGraphiteField     = "value"
+)
+
+var errGraphiteLine = errors.New("invalid Graphite line, expected \"path value [timestamp]\"")
+
+// graphiteTemplate maps the parts of the paths matching its
+// filter to the measurement, the tags and the field of the points
+type graphiteTemplate struct {
+	// filter are the patterns of the first parts of the paths, none for the default template
+	filter []string
+
+	parts []string
+	tags  map[string]string
+}
+
+// parseGraphiteTags parses tags written as "tag=value,..."
+func parseGraphiteTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("invalid tag %q, expected \"tag=value\"", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+	return tags, nil
+}
+
+// newGraphiteTemplate parses a template written as "[filter] template [tag=value,...]"
+func newGraphiteTemplate(s string) (*graphiteTemplate, error) {
+	fields := strings.Fields(s)
+
+	var filter, template, tags string
+	switch len(fields) {
+	case 1:
+		template = fields[0]
+	case 2:
+		// The last part is either the tags or the template
+		if strings.Contains(fields[1], "=") {
+			template, tags = fields[0], fields[1]
+		} else {
+			filter, template = fields[0], fields[1]
+		}
+	case 3:
+		filter, template, tags = fields[0], fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("invalid template %q", s)
+	}
+
+	t := &graphiteTemplate{parts: strings.Split(template, ".")}
+	if filter != "" {
+		t.filter = strings.Split(filter, ".")
+		for _, f := range t.filter {
+			if _, err := path.Match(f, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter of template %q: %v", s, err)
+			}
+		}
+	}
+
+	measurement := false
+	for _, p := range t.parts {
+		if p == graphiteMeasurement || p == graphiteMeasurementGreedy {
+			measurement = true
+		}
+	}
+	if !measurement {
+		return nil, fmt.Errorf("no measurement in template %q", s)
+	}
+
+	var err error
+	if t.tags, err = parseGraphiteTags(tags); err != nil {
+		return nil, fmt.Errorf("template %q: %v", s, err)
+	}
+	return t, nil
+}
+
+// match tells whether the filter of the template matches the first parts of a path
+func (t *graphiteTemplate) match(parts []string) bool {
+	if len(t.filter) > len(parts) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, parts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSpecificity ranks the parts of the filters: a literal part is more
+// specific than a pattern, which is more specific than "*"
+func filterSpecificity(f string) int {
+	switch {
+	case f == "*":
+		return 0
+	case strings.ContainsAny(f, "*?["):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// moreSpecific tells whether the filter of t is more specific than the one of
+// o: its first part which differs in specificity is more specific, or the
+// filter of o is shorter
+func (t *graphiteTemplate) moreSpecific(o *graphiteTemplate) bool {
+	for i := 0; i < len(t.filter) && i < len(o.filter); i++ {
+		if s, os := filterSpecificity(t.filter[i]), filterSpecificity(o.filter[i]); s != os {
+			return s > os
+		}
+	}
+	return len(t.filter) > len(o.filter)
+}
+
+// apply returns the measurement, the tags and the field of the parts of a path
+func (t *graphiteTemplate) apply(parts []string, separator string) (string, map[string]string, string) {
+	var measurement, field []string
+	tags := make(map[string]string)
+
+	for i, p := range t.parts {
+		if i >= len(parts) {
+			break
+		}
+
+		switch p {
+		case "":
+		case graphiteMeasurement:
+			measurement = append(measurement, parts[i])
+		case graphiteMeasurementGreedy:
+			measurement = append(measurement, parts[i:]...)
+		case graphiteField:
+			field = append(field, parts[i])
+		case graphiteFieldGreedy:
+			field = append(field, parts[i:]...)
+		default:
+			// The parts of the same tag are joined
+			if v, ok := tags[p]; ok {
+				tags[p] = v + separator + parts[i]
+			} else {
+				tags[p] = parts[i]
+			}
+		}
+
+		if p == graphiteMeasurementGreedy || p == graphiteFieldGreedy {
+			break
+		}
+	}
+
+	return strings.Join(measurement, separator), tags, strings.Join(field, separator)
+}
+
+// graphiteParser converts the lines of the Graphite plaintext protocol to points
+type graphiteParser struct {
+	separator string
+
+	// templates with a filter, and the one applied when none matches
+	templates []*graphiteTemplate
+	def       *graphiteTemplate
+
+	// tags added to every point
+	tags map[string]string
+}
+
+func newGraphiteParser(cfg config.GraphiteConfig) (*graphiteParser, error) {
+	p := &graphiteParser{separator: cfg.Separator}
+	if p.separator == "" {
+		p.separator = DefaultGraphiteSeparator
+	}
+
+	for _, s := range cfg.Templates {
+		t, err := newGraphiteTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.filter != nil {
+			p.templates = append(p.templates, t)
+			continue
+		}
+		if p.def != nil {
+			return nil, fmt.Errorf("several templates without a filter: %q", s)
+		}
+		p.def = t
+	}
+
+	if p.def == nil {
+		p.def = &graphiteTemplate{parts: []string{DefaultGraphiteTemplate}}
+	}
+
+	p.tags = make(map[string]string)
+	for _, s := range cfg.Tags {
+		tags, err := parseGraphiteTags(s)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range tags {
+			p.tags[k] = v
+		}
+	}
+
+	return p, nil
+}
+
+// template returns the most specific template matching the parts of a path
+func (p *graphiteParser) template(parts []string) *graphiteTemplate {
+	var best *graphiteTemplate
+	for _, t := range p.templates {
+		if t.match(parts) && (best == nil || t.moreSpecific(best)) {
+			best = t
+		}
+	}
+	if best == nil {
+		return p.def
+	}
+	return best
+}
+
+// parse converts a line "path value [timestamp]" to a point, the timestamp
+// being in seconds, and now when it is missing or -1
+// Tags may follow the path as "path;tag=value;..."
+func (p *graphiteParser) parse(line string, now time.Time) (models.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errGraphiteLine
+	}
+
+	name := fields[0]
+	var lineTags []string
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name, lineTags = name[:i], strings.Split(name[i+1:], ";")
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q: %v", fields[1], err)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("unsupported value %q", fields[1])
+	}
+
+	timestamp := now
+	if len(fields) == 3 && fields[2] != "-1" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %v", fields[2], err)
+		}
+		sec, frac := math.Modf(ts)
+		timestamp = time.Unix(int64(sec), int64(frac*float64(time.Second)))
+	}
+
+	parts := strings.Split(name, ".")
+	t := p.template(parts)
+	measurement, tags, field := t.apply(parts, p.separator)
+	if measurement == "" {
+		measurement = name
+	}
+	if field == "" {
+		field = DefaultGraphiteField
+	}
+
+	// The tags of the path override the ones of the template, which override the global ones
+	for _, m := range []map[string]string{t.tags, p.tags} {
+		for k, v := range m {
+			if _, ok := tags[k]; !ok {
+				tags[k] = v
+			}
+		}
+	}
+	for _, kv := range lineTags {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("invalid tag %q, expected \"tag=value\"", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+
+	return models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: value}, timestamp)
+}
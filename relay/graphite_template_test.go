@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestGraphiteParser(t *testing.T) {
+	p, err := newGraphiteParser(config.GraphiteConfig{
+		Separator: "_",
+		Tags:      []string{"dc=eu-west"},
+		Templates: []string{
+			"servers.* .host.measurement.field*",
+			"servers.db-* .host.measurement.measurement role=db",
+			"stats.*.counters .app..measurement.measurement region=us,type=counter",
+			"measurement.measurement*",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(100, 0)
+	for line, expected := range map[string]string{
+		"servers.web-1.cpu.load.1m 0.5 1700000000": "cpu,dc=eu-west,host=web-1 load_1m=0.5 1700000000000000000",
+		"servers.db-1.disk.used 3 10":              "disk_used,dc=eu-west,host=db-1,role=db value=3 10000000000",
+		"stats.shop.counters.orders.paid 2 1.5":    "orders_paid,app=shop,dc=eu-west,region=us,type=counter value=2 1500000000",
+		"collectd.host.cpu 1":                      "collectd_host_cpu,dc=eu-west value=1 100000000000",
+		"collectd.host.cpu 1 -1":                   "collectd_host_cpu,dc=eu-west value=1 100000000000",
+
+		// The tags of the path win over the others
+		"servers.web-1.cpu.idle;host=web-2;dc=us 7 1": "cpu,dc=us,host=web-2 idle=7 1000000000",
+	} {
+		point, err := p.parse(line, now)
+		if assert.Nil(t, err, line) {
+			assert.Equal(t, expected, point.String(), line)
+		}
+	}
+
+	for _, line := range []string{
+		"cpu",
+		"cpu 1 2 3",
+		"cpu one",
+		"cpu NaN",
+		"cpu 1 yesterday",
+		"cpu;host 1",
+	} {
+		_, err := p.parse(line, now)
+		assert.NotNil(t, err, line)
+	}
+
+	// Without templates, the path is the measurement
+	p, err = newGraphiteParser(config.GraphiteConfig{})
+	assert.Nil(t, err)
+	point, err := p.parse("servers.web-1.cpu 1 1", now)
+	assert.Nil(t, err)
+	assert.Equal(t, "servers.web-1.cpu value=1 1000000000", point.String())
+
+	for _, cfg := range []config.GraphiteConfig{
+		{Templates: []string{"host.field"}},
+		{Templates: []string{"measurement", "measurement*"}},
+		{Templates: []string{"a b c d"}},
+		{Templates: []string{"cpu.* measurement region"}},
+		{Templates: []string{"cpu.[ measurement"}},
+		{Tags: []string{"dc"}},
+	} {
+		_, err := newGraphiteParser(cfg)
+		assert.NotNil(t, err, "%v", cfg)
+	}
+}
@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+func TestGraphite(t *testing.T) {
+	writes := make(chan udpWrite, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		writes <- udpWrite{r.URL.RawQuery, string(data)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	fs := config.Filters{{Type: config.FilterExclude, MeasurementExpression: "^debug$", Outputs: []string{"http"}}}
+	assert.Nil(t, fs.LoadRegexps())
+
+	for _, protocol := range []string{GraphiteTCP, GraphiteUDP} {
+		cfg := config.GraphiteConfig{
+			Addr:      "127.0.0.1:0",
+			Protocol:  protocol,
+			Templates: []string{"servers.* .host.measurement.field"},
+			Outputs: []config.GraphiteOutputConfig{
+				{Name: "http", Location: server.URL, DB: "graphite", BatchInterval: "10ms"},
+			},
+		}
+		r, err := NewGraphite(cfg, fs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := r.(*Graphite)
+
+		done := make(chan error)
+		go func() { done <- g.Run() }()
+
+		var addr net.Addr
+		if g.l != nil {
+			addr = g.l.Addr()
+		} else {
+			addr = g.c.LocalAddr()
+		}
+
+		c, err := net.Dial(protocol, addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Write([]byte("servers.web-1.cpu.load 0.5 1\nservers.web-1.debug.x 1 1\ninvalid\n"))
+		assert.Nil(t, err)
+
+		select {
+		case write := <-writes:
+			assert.Equal(t, "db=graphite", write.query, protocol)
+			assert.Equal(t, "cpu,host=web-1 load=0.5 1000000000\n", write.body, protocol)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no write received", protocol)
+		}
+
+		// The connections of the clients are closed with the relay
+		assert.Nil(t, g.Stop())
+		assert.Nil(t, <-done)
+		c.Close()
+	}
+
+	for _, cfg := range []config.GraphiteConfig{
+		{Addr: "127.0.0.1:0"},
+		{Addr: "127.0.0.1:0", Outputs: []config.GraphiteOutputConfig{{Location: "127.0.0.1:8089", DB: "graphite"}}},
+		{Addr: "127.0.0.1:0", Protocol: "sctp", Outputs: []config.GraphiteOutputConfig{{Location: "http://127.0.0.1:1/", DB: "graphite"}}},
+	} {
+		_, err := NewGraphite(cfg, nil, nil)
+		assert.NotNil(t, err, "%+v", cfg)
+	}
+}
+
+func TestGraphiteLongLine(t *testing.T) {
+	cfg := config.GraphiteConfig{Name: "long"}
+	parser, err := newGraphiteParser(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBatchBackend(batchRelay{name: "long", logger: logging.Default()}, &config.UDPOutputConfig{Name: "http", Location: "http://127.0.0.1:1/", DB: "graphite"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Graphite{name: "long", parser: parser, conns: make(map[net.Conn]struct{}), backends: []*batchBackend{b}, logger: logging.Default()}
+
+	parseErrors := func() float64 {
+		metricGraphiteParseErrors.mu.Lock()
+		defer metricGraphiteParseErrors.mu.Unlock()
+		return metricGraphiteParseErrors.get([]string{"long"}).value
+	}
+
+	before := parseErrors()
+	server, client := net.Pipe()
+	g.wg.Add(1)
+	go g.handleConn(server)
+
+	// The line longer than the limit is dropped, the following one is kept
+	long := "cpu." + strings.Repeat("x", graphiteMaxLineSize) + " 1 1\n"
+	_, err = client.Write([]byte(long + "cpu.load 0.5 1\n"))
+	assert.Nil(t, err)
+	client.Close()
+	g.wg.Wait()
+
+	assert.Equal(t, before+1, parseErrors())
+	assert.Equal(t, 1, b.points)
+	assert.Equal(t, "cpu.load value=0.5 1000000000\n", b.buf.String())
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default number of consecutive checks changing the state of a backend
+const (
+	DefaultHealthCheckFailures  = 3
+	DefaultHealthCheckSuccesses = 2
+)
+
+// errBackendDown is returned for the writes not sent to a backend which is down
+var errBackendDown = errors.New("backend is down")
+
+// healthState is the state of a backend, as seen by the background checks
+// When a backend is down, its circuit breaker is open: the writes go straight
+// to its retry buffer, or are not sent at all when it has none
+type healthState struct {
+	// 1 when the backend is down
+	down int32
+
+	mu sync.Mutex
+
+	// Consecutive failed and successful checks
+	failures  int
+	successes int
+
+	last    health
+	checked time.Time
+}
+
+func (s *healthState) isDown() bool {
+	return s != nil && atomic.LoadInt32(&s.down) == 1
+}
+
+// result returns the last check of the backend, if any
+func (s *healthState) result() (health, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, !s.checked.IsZero()
+}
+
+// update records a check, and returns whether the state of the backend changed
+func (s *healthState) update(res health, failures, successes int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last, s.checked = res, time.Now()
+
+	if res.err != nil {
+		s.failures++
+		s.successes = 0
+		if s.failures >= failures && !s.isDown() {
+			atomic.StoreInt32(&s.down, 1)
+			return true
+		}
+		return false
+	}
+
+	s.successes++
+	s.failures = 0
+	if s.successes >= successes && s.isDown() {
+		atomic.StoreInt32(&s.down, 0)
+		return true
+	}
+	return false
+}
+
+// ping checks the ping endpoint of a backend
+func (h *HTTP) ping(b *httpBackend) health {
+	res := health{name: b.name}
+
+	ctx := context.Background()
+	if h.healthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.healthTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, b.location+b.endpoints.Ping, nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	start := time.Now()
+	resp, err := b.querier.Do(req.WithContext(ctx))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		res.err = fmt.Errorf("Unexpected error code %d", resp.StatusCode)
+	}
+	res.duration = time.Since(start)
+	return res
+}
+
+// startHealthChecks checks the backends in the background, when enabled
+func (h *HTTP) startHealthChecks() {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+
+	if h.healthInterval <= 0 || h.healthStop != nil {
+		return
+	}
+
+	h.healthStop = make(chan struct{})
+	for _, b := range h.backends {
+		go h.checkHealth(b, h.healthStop)
+	}
+}
+
+// stopHealthChecks stops the background checks of the backends, if running
+func (h *HTTP) stopHealthChecks() {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+
+	if h.healthStop != nil {
+		close(h.healthStop)
+		h.healthStop = nil
+	}
+}
+
+func (h *HTTP) checkHealth(b *httpBackend, stop <-chan struct{}) {
+	ticker := time.NewTicker(h.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		res := h.ping(b)
+		if b.health.update(res, h.healthFailures, h.healthSuccesses) {
+			if res.err != nil {
+				h.logger.Warn("backend is down", "backend", b.name, "error", res.err)
+			} else {
+				h.logger.Info("backend is up", "backend", b.name)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
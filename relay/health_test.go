@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthState(t *testing.T) {
+	s := new(healthState)
+	failed := health{err: errors.New("timeout")}
+
+	// The backend is down after 3 failed checks, up after 2 successful ones
+	for i, expected := range []bool{false, false, true, true} {
+		assert.Equal(t, i == 2, s.update(failed, 3, 2))
+		assert.Equal(t, expected, s.isDown())
+	}
+
+	assert.False(t, s.update(health{}, 3, 2))
+	assert.False(t, s.update(failed, 3, 2))
+	assert.False(t, s.update(health{}, 3, 2))
+	assert.True(t, s.update(health{}, 3, 2))
+	assert.False(t, s.isDown())
+
+	// A backend which was never checked is up
+	var none *healthState
+	assert.False(t, none.isDown())
+}
+
+func TestHealthChecks(t *testing.T) {
+	defer resetWriter()
+
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	h := createHTTP(t, emptyConfig, false)
+	h.healthInterval, h.healthTimeout = 5*time.Millisecond, time.Second
+	h.healthFailures, h.healthSuccesses = 1, 1
+
+	b := queryBackend(t, "checked", server.URL, 0)
+	b.endpoints.Ping = "/ping"
+	h.backends = []*httpBackend{b}
+
+	h.startHealthChecks()
+	defer h.stopHealthChecks()
+
+	wait := func(expected bool) {
+		for i := 0; i < 200 && b.health.isDown() != expected; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(t, expected, b.health.isDown())
+	}
+
+	wait(false)
+	atomic.StoreInt32(&down, 1)
+	captureOutput(func() { wait(true) })
+
+	// While the breaker is open, writes are not sent and queries try the backend last
+	_, err := b.post([]byte("cpu value=1\n"), "db=test", "", "write")
+	assert.Equal(t, errBackendDown, err)
+	up, _ := h.queries.available(h.backends, func(*httpBackend) bool { return true })
+	assert.Equal(t, 0, len(up))
+
+	// The cached state is returned
+	h.handleHealth(w, nil, ti)
+	var report healthReport
+	assert.Nil(t, json.Unmarshal(w.writeBuf.Bytes(), &report))
+	assert.Equal(t, "critical", report.Status)
+	assert.Equal(t, "KO. Unexpected error code 503", report.Problem["checked"])
+
+	atomic.StoreInt32(&down, 0)
+	captureOutput(func() { wait(false) })
+}
+
+func TestHealthBreakerBuffer(t *testing.T) {
+	f := &fakePoster{}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Millisecond}, f)
+	r.initialInterval = time.Millisecond
+	b := &httpBackend{poster: r, health: &healthState{down: 1}}
+
+	// The write goes through the retry buffer, without being tried
+	// first nor holding the client until it is replayed
+	resp, err := b.post([]byte("cpu value=1\n"), "db=test", "", "write")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	waitUntil(t, func() bool {
+		f.Lock()
+		defer f.Unlock()
+		return len(f.writes) == 1
+	})
+	assert.Equal(t, []string{"cpu value=1\n"}, f.writes)
+}
+
+func TestHealthChecksStop(t *testing.T) {
+	h := &HTTP{healthInterval: time.Hour}
+	h.startHealthChecks()
+
+	// Stopping the checks twice, as two reloads may do, is harmless
+	h.stopHealthChecks()
+	h.stopHealthChecks()
+	assert.Nil(t, h.healthStop)
+}
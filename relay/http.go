@@ -8,11 +8,9 @@ import (
 	"fmt"
 	"golang.org/x/time/rate"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"os"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +19,7 @@ import (
 
 	"github.com/influxdata/influxdb/models"
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 )
 
 // HTTP is a relay for HTTP influxdb writes
@@ -40,13 +39,43 @@ type HTTP struct {
 
 	backends []*httpBackend
 
-	start  time.Time
-	log    bool
-	logger *log.Logger
+	start time.Time
+
+	// Every request is logged when accessLog is set
+	accessLog bool
+	logger    *logging.Logger
 
 	rateLimiter *rate.Limiter
 
+	// Users allowed to use the relay, nil when authentication is disabled
+	auth *authenticator
+
 	healthTimeout time.Duration
+
+	// Background checks of the backends, disabled when the interval is 0
+	healthInterval  time.Duration
+	healthFailures  int
+	healthSuccesses int
+	healthMu        sync.Mutex
+	healthStop      chan struct{}
+
+	// Default consistency level of the writes
+	consistency models.ConsistencyLevel
+
+	// Ring routing the points to the shards, nil when sharding is disabled
+	shards *shardRing
+
+	// Transforms of the points sent to every backend
+	transforms transforms
+
+	// Balancing of the /query requests
+	queries *queryBalancer
+
+	// Relay serving the requests once a new configuration was loaded
+	active atomic.Value
+
+	// Called to reload the configuration file from the admin endpoint
+	reload func() error
 }
 
 type relayHandlerFunc func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time)
@@ -67,31 +96,59 @@ var (
 	handlers = map[string]relayHandlerFunc{
 		"/write":             (*HTTP).handleStandard,
 		"/api/v1/prom/write": (*HTTP).handleProm,
+		"/api/v1/prom/read":  (*HTTP).handlePromRead,
+		"/api/v2/write":      (*HTTP).handleV2Write,
 		"/ping":              (*HTTP).handlePing,
 		"/status":            (*HTTP).handleStatus,
 		"/admin":             (*HTTP).handleAdmin,
 		"/admin/flush":       (*HTTP).handleFlush,
+		"/admin/reload":      (*HTTP).handleReload,
 		"/health":            (*HTTP).handleHealth,
+		"/metrics":           (*HTTP).handleMetrics,
+		"/query":             (*HTTP).handleQuery,
+
+		"/admin/dead-letters":          (*HTTP).handleDeadLetters,
+		"/admin/dead-letters/download": (*HTTP).handleDeadLetterDownload,
+		"/admin/dead-letters/resubmit": (*HTTP).handleDeadLetterResubmit,
+
+		"/admin/backends":        (*HTTP).handleBackends,
+		"/admin/backends/pause":  (*HTTP).handleBackendPause,
+		"/admin/backends/resume": (*HTTP).handleBackendResume,
 	}
 
+	// The last middleware runs first: the body is decoded before the
+	// credentials are checked, so that the rate limit only applies
+	// to the requests of the authenticated clients
 	middlewares = []relayMiddleware{
-		(*HTTP).bodyMiddleWare,
 		(*HTTP).queryMiddleWare,
-		(*HTTP).logMiddleWare,
 		(*HTTP).rateMiddleware,
+		(*HTTP).authMiddleware,
+		(*HTTP).bodyMiddleWare,
+		(*HTTP).metricsMiddleware,
+		(*HTTP).logMiddleWare,
 	}
 )
 
 // NewHTTP creates a new HTTP relay
 // This relay will most likely be tied to a RelayService
 // and manage a set of HTTPBackends
-func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, error) {
+func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters, ts config.Transforms) (Relay, error) {
+	return newHTTP(cfg, verbose, fs, ts, nil)
+}
+
+func newHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters, ts config.Transforms, previous []*httpBackend) (_ *HTTP, err error) {
 	h := new(HTTP)
 
+	// The retry buffers created for a rejected configuration are closed
+	defer func() {
+		if err != nil {
+			handOver(previous, h.backends)
+		}
+	}()
+
 	h.addr = cfg.Addr
 	h.name = cfg.Name
-	h.log = verbose
-	h.logger = log.New(os.Stdout, "relay: ", 0)
+	h.accessLog = verbose || cfg.AccessLog
 
 	h.pingResponseCode = DefaultHTTPPingResponse
 	if cfg.DefaultPingResponse != 0 {
@@ -114,16 +171,51 @@ func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, err
 		h.schema = "https"
 	}
 
+	h.logger = logging.Default().With("relay", h.Name())
+	h.transforms = globalTransforms(ts)
+
 	// For each output specified in the config, we are going to create a backend
 	for i := range cfg.Outputs {
-		backend, err := newHTTPBackend(&cfg.Outputs[i], fs)
+		var prev *httpBackend
+		for _, b := range previous {
+			if b.name == cfg.Outputs[i].Name || b.name == cfg.Outputs[i].Location && cfg.Outputs[i].Name == "" {
+				prev = b
+			}
+		}
+
+		backend, err := reuseHTTPBackend(&cfg.Outputs[i], fs, prev)
 		if err != nil {
 			return nil, err
 		}
+		backend.transforms = outputTransforms(ts, backend.name)
 
 		h.backends = append(h.backends, backend)
 	}
 
+	if len(cfg.Shards) > 0 {
+		ring, err := newShardRing(cfg.ShardKey, cfg.Shards)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = assignShards(h.backends, cfg.Shards); err != nil {
+			return nil, err
+		}
+		h.shards = ring
+	}
+
+	queries, err := newQueryBalancer(cfg.QueryBalancing, cfg.QueryExcludeBuffering, cfg.QueryRetryInterval)
+	if err != nil {
+		return nil, err
+	}
+	h.queries = queries
+
+	if len(cfg.Users) > 0 {
+		if h.auth, err = newAuthenticator(cfg.Users); err != nil {
+			return nil, err
+		}
+	}
+
 	// If a RateLimit is specified, create a new limiter
 	if cfg.RateLimit != 0 {
 		if cfg.BurstLimit != 0 {
@@ -135,9 +227,78 @@ func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, err
 
 	h.healthTimeout = time.Duration(cfg.HealthTimeout) * time.Millisecond
 
+	if cfg.HealthCheckInterval != "" {
+		if h.healthInterval, err = time.ParseDuration(cfg.HealthCheckInterval); err != nil {
+			return nil, fmt.Errorf("error parsing health check interval %v", err)
+		}
+
+		// The checks must not pile up
+		if h.healthTimeout <= 0 || h.healthTimeout > h.healthInterval {
+			h.healthTimeout = h.healthInterval
+		}
+	}
+
+	h.healthFailures = DefaultHealthCheckFailures
+	if cfg.HealthCheckFailures > 0 {
+		h.healthFailures = cfg.HealthCheckFailures
+	}
+
+	h.healthSuccesses = DefaultHealthCheckSuccesses
+	if cfg.HealthCheckSuccesses > 0 {
+		h.healthSuccesses = cfg.HealthCheckSuccesses
+	}
+
+	h.consistency = models.ConsistencyLevelAny
+	if cfg.Consistency != "" {
+		c, err := models.ParseConsistencyLevel(cfg.Consistency)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing consistency %q: %v", cfg.Consistency, err)
+		}
+		h.consistency = c
+	}
+
 	return h, nil
 }
 
+// Reload creates the relay of a new configuration, sharing the retry buffers
+// of the outputs whose name and buffer settings did not change, so that no
+// buffered write is lost. It does not serve any request until it replaces h,
+// or is run once handed over the buffers of h (see HandOver)
+func (h *HTTP) Reload(cfg config.HTTPConfig, verbose bool, fs config.Filters, ts config.Transforms) (*HTTP, error) {
+	return newHTTP(cfg, verbose, fs, ts, h.current().backends)
+}
+
+// Replace makes h serve its requests with the configuration of n, it is
+// only possible when both listen on the same address with the same certificate
+func (h *HTTP) Replace(n *HTTP) bool {
+	if n.addr != h.addr || n.cert != h.cert {
+		return false
+	}
+
+	old := h.current()
+	n.reload = old.reload
+
+	old.stopHealthChecks()
+	n.startHealthChecks()
+	h.active.Store(n)
+	handOver(n.backends, old.backends)
+	return true
+}
+
+// SetReloadFunc sets the function reloading the configuration
+// file, which is then available on the /admin/reload endpoint
+func (h *HTTP) SetReloadFunc(f func() error) {
+	h.current().reload = f
+}
+
+// current returns the relay serving the requests
+func (h *HTTP) current() *HTTP {
+	if a, ok := h.active.Load().(*HTTP); ok {
+		return a
+	}
+	return h
+}
+
 // Name is the name of the HTTP relay
 // a default name might be generated if it is
 // not specified in the configuration file
@@ -170,10 +331,9 @@ func (h *HTTP) Run() error {
 	}
 
 	h.l = l
+	h.startHealthChecks()
 
-	if h.log {
-		h.logger.Printf("starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.addr)
-	}
+	h.logger.Info("starting relay", "schema", h.schema, "addr", h.addr)
 
 	err = http.Serve(l, h)
 	if atomic.LoadInt64(&h.closing) != 0 {
@@ -185,6 +345,7 @@ func (h *HTTP) Run() error {
 // Stop actually stops the HTTP endpoint
 func (h *HTTP) Stop() error {
 	atomic.StoreInt64(&h.closing, 1)
+	h.current().stopHealthChecks()
 	return h.l.Close()
 }
 
@@ -193,6 +354,7 @@ func (h *HTTP) Stop() error {
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// h.start = time.Now()
 
+	h = h.current()
 	if fun, ok := handlers[r.URL.Path]; ok {
 		allMiddlewares(h, fun)(h, w, r, time.Now())
 	} else {
@@ -272,6 +434,17 @@ func newSimplePoster(location string, timeout time.Duration, skipTLSVerification
 	}
 }
 
+func newQueryClient(timeout time.Duration, skipTLSVerification bool) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: skipTLSVerification,
+			},
+		},
+	}
+}
+
 func (s *simplePoster) getStats() stats {
 	return simpleStats{Location: s.location}
 }
@@ -316,37 +489,63 @@ type httpBackend struct {
 	endpoints config.HTTPEndpointConfig
 	location  string
 
-	tagRegexps         []*regexp.Regexp
-	measurementRegexps []*regexp.Regexp
-}
-
-// validateRegexps checks if a request on this backend matches
-// all the tag regular expressions for this backend
-func (b *httpBackend) validateRegexps(ps models.Points) error {
-	// For each point
-	for _, p := range ps {
-		// Check if the measurement of each point
-		// matches ALL measurement regular expressions
-		m := p.Name()
-		for _, r := range b.measurementRegexps {
-			if !r.Match(m) {
-				return errors.New("bad measurement")
-			}
-		}
+	// Index of the shard this backend belongs to, -1 when it receives every point
+	shard int
 
-		// For each tag of each point
-		for _, t := range p.Tags() {
-			// Check if each tag of each point
-			// matches ALL tags regular expressions
-			for _, r := range b.tagRegexps {
-				if !r.Match(t.Key) {
-					return errors.New("bad tag")
-				}
-			}
+	// Whether the backend is an InfluxDB 2.x server
+	v2 bool
+
+	// Credentials sent to the backend
+	auth *backendAuth
+
+	// Renames the database and retention policy of the writes, nil when none
+	renamer *queryRenamer
+
+	// State of the backend given by the background checks
+	health *healthState
+
+	// State of the backend set through the admin API
+	state *backendState
+
+	// Client and state used to proxy queries
+	querier    *http.Client
+	queryState *queryState
+	priority   int
+
+	// Filters of the points sent to this backend
+	filters []*config.Filter
+
+	// Poster of the location, the retry buffer writes to it once
+	// the relay of the backend is running (see handOver)
+	target poster
+
+	// Transforms of the points sent to this backend only
+	transforms transforms
+}
+
+// post sends a write with the credentials of the client the backend forwards,
+// the retry buffer thus keys its batches on those credentials, and the ones
+// of the backend are only added when the write is sent (see credentialsPoster)
+// While the backend is down, the write goes straight to the retry buffer,
+// or is not sent at all when there is none
+func (b *httpBackend) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if err := b.skipped(); err != nil {
+		return nil, err
+	}
+
+	if b.auth != nil {
+		query, auth = b.auth.client(query, auth)
+	}
+
+	if b.health.isDown() {
+		r := b.getRetryBuffer()
+		if r == nil {
+			return nil, errBackendDown
 		}
+		return r.buffer(buf, query, auth, endpoint)
 	}
 
-	return nil
+	return b.poster.post(buf, query, auth, endpoint)
 }
 
 func (b *httpBackend) getRetryBuffer() *retryBuffer {
@@ -357,7 +556,19 @@ func (b *httpBackend) getRetryBuffer() *retryBuffer {
 	return nil
 }
 
+// behind tells whether the backend still has buffered writes to catch up on
+func (b *httpBackend) behind() bool {
+	r := b.getRetryBuffer()
+	return r != nil && (atomic.LoadInt32(&r.buffering) == 1 || r.list.getSize() > 0)
+}
+
 func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBackend, error) {
+	return reuseHTTPBackend(cfg, fs, nil)
+}
+
+// reuseHTTPBackend creates a backend, keeping the retry buffer of the
+// previous backend of the output when it is still in the same directory
+func reuseHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters, prev *httpBackend) (*httpBackend, error) {
 	// Get default name
 	if cfg.Name == "" {
 		cfg.Name = cfg.Location
@@ -373,12 +584,62 @@ func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBacke
 		timeout = t
 	}
 
+	auth, err := newBackendAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	renamer, err := newQueryRenamer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The state of the backend is kept until it is checked again
+	health := new(healthState)
+	if prev != nil && prev.location == cfg.Location && prev.health != nil {
+		health = prev.health
+	}
+
+	// The state set by the administrators is kept, whatever the location
+	state := new(backendState)
+	if prev != nil && prev.state != nil {
+		state = prev.state
+	}
+
 	// Get underlying Poster instance
 	var p poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
 
+	switch cfg.Type {
+	case "", BackendInfluxDB:
+	case BackendInfluxDBv2:
+		p = newV2Poster(p, cfg)
+		if cfg.Endpoints.Write == "" {
+			cfg.Endpoints.Write = defaultV2WriteEndpoint
+			if strings.HasSuffix(cfg.Location, "/") {
+				cfg.Endpoints.Write = defaultV2WriteEndpoint[1:]
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid type %q for %q", cfg.Type, cfg.Name)
+	}
+	p = &credentialsPoster{poster: p, auth: auth}
+
 	// If configured, create a retryBuffer per backend.
 	// This way we serialize retries against each backend.
-	if cfg.BufferSizeMB > 0 {
+	target := p
+	var kept *retryBuffer
+	if prev != nil {
+		kept = prev.getRetryBuffer()
+	}
+
+	if kept != nil && kept.matches(cfg) {
+		// The queue of a running buffer is handed over with its writes,
+		// the other settings are kept until the relay is restarted
+		p = kept
+		if kept.settings != newBufferSettings(cfg) {
+			logging.Warn("the retry buffer keeps its previous settings until the relay is restarted", "backend", cfg.Name)
+		}
+	} else if cfg.BufferSizeMB > 0 {
 		max := DefaultMaxDelayInterval
 		if cfg.MaxDelayInterval != "" {
 			m, err := time.ParseDuration(cfg.MaxDelayInterval)
@@ -393,37 +654,145 @@ func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBacke
 			batch = cfg.MaxBatchKB * KB
 		}
 
-		p = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
-	}
+		policy := retryPolicy{
+			maxInterval: max,
+			strict:      cfg.BufferStrictOrdering,
+			maxAttempts: cfg.BufferMaxAttempts,
+		}
+
+		if cfg.BufferMaxAge != "" {
+			m, err := time.ParseDuration(cfg.BufferMaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing buffer max age %v", err)
+			}
+			policy.maxAge = m
+		}
 
-	var tagRegexps []*regexp.Regexp
-	var measurementRegexps []*regexp.Regexp
+		// Poison lines are only looked for when batches can give up
+		if policy.maxAttempts > 0 || policy.maxAge > 0 {
+			size := DefaultDeadLetterSizeMB * MB
+			if cfg.DeadLetterSizeMB > 0 {
+				size = cfg.DeadLetterSizeMB * MB
+			}
 
-	// Get regexps related to this HTTP backend
-	for _, f := range fs {
-		for _, e := range f.Outputs {
-			if e == cfg.Name {
-				if f.TagRegexp != nil {
-					tagRegexps = append(tagRegexps, f.TagRegexp)
-				}
+			dir := ""
+			if cfg.BufferPath != "" {
+				dir = filepath.Join(cfg.BufferPath, "dead-letter")
+			}
 
-				if f.MeasurementRegexp != nil {
-					measurementRegexps = append(measurementRegexps, f.MeasurementRegexp)
-				}
+			d, err := newDeadLetters(dir, size)
+			if err != nil {
+				return nil, fmt.Errorf("error opening dead letters for %q: %v", cfg.Name, err)
 			}
+			policy.deadLetters = d
 		}
+
+		var list retryQueue = newBufferList(cfg.BufferSizeMB*MB, batch)
+		if cfg.BufferPath != "" {
+			q, err := newDiskQueue(cfg.BufferPath, cfg.BufferFsync, cfg.BufferSizeMB*MB, batch)
+			if err != nil {
+				return nil, fmt.Errorf("error opening buffer for %q: %v", cfg.Name, err)
+			}
+			list = q
+		}
+
+		r := newRetryBuffer(cfg.BufferSizeMB*MB, batch, list, policy, p)
+		r.settings = newBufferSettings(cfg)
+		p = r
+	}
+
+	// A new retry buffer of a disabled output holds its writes as well
+	r, buffered := p.(*retryBuffer)
+	if buffered {
+		_, mode := state.get()
+		r.setPaused(mode == DisabledBuffer)
+	}
+
+	// Without a retry buffer anymore, a disabled output discards its writes,
+	// the running backend keeping its own state until it is replaced
+	if s, mode := state.get(); s == StateDisabled && mode == DisabledBuffer && !buffered {
+		logging.Warn("discarding the writes of the disabled backend, which has no retry buffer anymore", "backend", cfg.Name)
+		state = &backendState{state: StateDisabled, mode: DisabledDiscard}
 	}
 
 	return &httpBackend{
-		poster:             p,
-		name:               cfg.Name,
-		tagRegexps:         tagRegexps,
-		measurementRegexps: measurementRegexps,
-		endpoints:          cfg.Endpoints,
-		location:           cfg.Location,
+		poster:     p,
+		target:     target,
+		name:       cfg.Name,
+		filters:    outputFilters(fs, cfg.Name),
+		endpoints:  cfg.Endpoints,
+		location:   cfg.Location,
+		shard:      -1,
+		auth:       auth,
+		renamer:    renamer,
+		health:     health,
+		state:      state,
+		querier:    newQueryClient(timeout, cfg.SkipTLSVerification),
+		queryState: new(queryState),
+		priority:   cfg.QueryPriority,
+		v2:         cfg.Type == BackendInfluxDBv2,
 	}, nil
 }
 
+// bufferSettings are the settings of an output a retry buffer is created
+// with, besides its directory
+type bufferSettings struct {
+	sizeMB           int
+	fsync            string
+	strict           bool
+	maxAttempts      int
+	maxAge           string
+	deadLetterSizeMB int
+	maxBatchKB       int
+	maxDelayInterval string
+}
+
+func newBufferSettings(cfg *config.HTTPOutputConfig) bufferSettings {
+	return bufferSettings{
+		sizeMB:           cfg.BufferSizeMB,
+		fsync:            cfg.BufferFsync,
+		strict:           cfg.BufferStrictOrdering,
+		maxAttempts:      cfg.BufferMaxAttempts,
+		maxAge:           cfg.BufferMaxAge,
+		deadLetterSizeMB: cfg.DeadLetterSizeMB,
+		maxBatchKB:       cfg.MaxBatchKB,
+		maxDelayInterval: cfg.MaxDelayInterval,
+	}
+}
+
+// matches tells whether a running retry buffer can serve an output
+// configuration, which asks for a buffer in the same directory, or in memory
+func (r *retryBuffer) matches(cfg *config.HTTPOutputConfig) bool {
+	if cfg.BufferSizeMB <= 0 {
+		return false
+	}
+
+	q, ok := r.list.(*diskQueue)
+	if !ok {
+		return cfg.BufferPath == ""
+	}
+	return cfg.BufferPath != "" && filepath.Clean(q.dir) == filepath.Clean(cfg.BufferPath)
+}
+
+// handOver is called once the backends of a new configuration replaced the
+// previous ones: the retry buffers they kept write to their new location,
+// and the ones not used anymore are closed
+func handOver(backends, previous []*httpBackend) {
+	kept := make(map[*retryBuffer]bool)
+	for _, b := range backends {
+		if r := b.getRetryBuffer(); r != nil {
+			r.setTarget(b.target)
+			kept[r] = true
+		}
+	}
+
+	for _, b := range previous {
+		if r := b.getRetryBuffer(); r != nil && !kept[r] {
+			r.close()
+		}
+	}
+}
+
 // ErrBufferFull error indicates that retry buffer is full
 var ErrBufferFull = errors.New("retry buffer full")
 
@@ -440,3 +809,12 @@ func putBuf(b *bytes.Buffer) {
 	b.Reset()
 	bufPool.Put(b)
 }
+
+// writePoints serializes the points in the line protocol, with the precision
+func writePoints(b *bytes.Buffer, points models.Points, precision string) {
+	for _, p := range points {
+		// Those two functions never return any errors, let's just ignore the return value
+		_, _ = b.WriteString(p.PrecisionString(precision))
+		_ = b.WriteByte('\n')
+	}
+}
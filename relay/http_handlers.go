@@ -2,9 +2,14 @@ package relay
 
 import (
 	"bytes"
-	"errors"
-	"log"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +18,9 @@ import (
 
 type status struct {
 	Status  map[string]stats `json:"status"`
+
+	// State of the backends which are not enabled
+	State map[string]string `json:"state,omitempty"`
 }
 
 func (h *HTTP) handleStatus(w http.ResponseWriter, r *http.Request, _ time.Time) {
@@ -21,6 +29,13 @@ func (h *HTTP) handleStatus(w http.ResponseWriter, r *http.Request, _ time.Time)
 
 		for _, b := range h.backends {
 			st.Status[b.name] = b.poster.getStats()
+
+			if state, _ := b.state.get(); state != StateEnabled {
+				if st.State == nil {
+					st.State = make(map[string]string)
+				}
+				st.State[b.name] = state
+			}
 		}
 
 		jsonResponse(w, response{http.StatusOK, st})
@@ -52,6 +67,9 @@ type healthReport struct {
 	Status  string            `json:"status"`
 	Healthy map[string]string `json:"healthy,omitempty"`
 	Problem map[string]string `json:"problem,omitempty"`
+
+	// Backends disabled or draining, the disabled ones are not checked
+	Maintenance map[string]string `json:"maintenance,omitempty"`
 }
 
 func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, _ time.Time) {
@@ -60,36 +78,46 @@ func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, _ time.Time)
 	var validEndpoints = 0
 	wg.Add(len(h.backends))
 
+	report := healthReport{}
 	for _, b := range h.backends {
 		b := b
 
-		validEndpoints++
+		if state, _ := b.state.get(); state != StateEnabled {
+			if report.Maintenance == nil {
+				report.Maintenance = make(map[string]string)
+			}
+			report.Maintenance[b.name] = state
 
-		go func() {
-			defer wg.Done()
+			if state == StateDisabled {
+				wg.Done()
+				continue
+			}
+		}
 
-			var healthCheck = health{name: b.name, err: nil}
+		validEndpoints++
 
-			client := http.Client{
-				Timeout: h.healthTimeout,
+		// The state given by the background checks is returned right away
+		if h.healthInterval > 0 {
+			healthCheck, ok := b.health.result()
+			if !ok {
+				healthCheck = health{name: b.name}
 			}
-			start := time.Now()
-			res, err := client.Get(b.location + b.endpoints.Ping)
-
-			if err != nil {
-				if h.log {
-					h.logger.Println(err)
-				}
-				healthCheck.err = err
-				responses <- healthCheck
-				return
+			if b.health.isDown() && healthCheck.err == nil {
+				healthCheck.err = errBackendDown
 			}
-			if res.StatusCode/100 != 2 {
-				healthCheck.err = errors.New("Unexpected error code " + string(res.StatusCode))
+			responses <- healthCheck
+			wg.Done()
+			continue
+		}
+
+		go func() {
+			defer wg.Done()
+
+			healthCheck := h.ping(b)
+			if healthCheck.err != nil {
+				h.logger.Debug("health check failed", "backend", b.name, "error", healthCheck.err)
 			}
-			healthCheck.duration = time.Since(start)
 			responses <- healthCheck
-			return
 		}()
 	}
 
@@ -99,7 +127,6 @@ func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, _ time.Time)
 	}()
 
 	nbDown := 0
-	report := healthReport{}
 	for r := range responses {
 		if r.err == nil {
 			if report.Healthy == nil {
@@ -136,7 +163,7 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 	baseBody := bytes.Buffer{}
 	_, err := baseBody.ReadFrom(r.Body)
 	if err != nil {
-		log.Printf("relay %q: could not read body: %v", h.Name(), err)
+		h.logger.Error("unable to read body", "error", err)
 		return
 	}
 
@@ -168,26 +195,27 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 			// Forward body
 			req, err := http.NewRequest("POST", b.location+b.endpoints.Query, &bodyBytes)
 			if err != nil {
-				log.Printf("problem posting to relay %q backend %q: could not prepare request: %v", h.Name(), b.name, err)
+				h.logger.Error("unable to prepare request", "backend", b.name, "error", err)
 				responses <- &http.Response{}
 				return
 			}
 
-			// Forward headers
-			req.Header = r.Header
+			// Forward headers, with the credentials of the backend
+			copyHeader(req.Header, r.Header)
+			b.authorize(req)
 
 			// Forward the request
 			resp, err := client.Do(req)
 			if err != nil {
 				// Internal error
-				log.Printf("problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
+				h.logger.Error("unable to post", "backend", b.name, "error", err)
 
 				// So empty response
 				responses <- &http.Response{}
 			} else {
 				if resp.StatusCode/100 == 5 {
 					// HTTP error
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
+					h.logger.Warn("5xx response", "backend", b.name, "status", resp.StatusCode)
 				}
 
 				// Get response
@@ -229,20 +257,21 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 }
 
 func (h *HTTP) handleFlush(w http.ResponseWriter, r *http.Request, start time.Time) {
-	if h.log {
-		h.logger.Println("Flushing buffers...")
+	// A single backend can be flushed
+	backends := h.backends
+	if r.URL.Query().Get("backend") != "" {
+		b, ok := h.backend(w, r)
+		if !ok {
+			return
+		}
+		backends = []*httpBackend{b}
 	}
 
-	for _, b := range h.backends {
+	for _, b := range backends {
 		r := b.getRetryBuffer()
 
 		if r != nil {
-			if h.log {
-				h.logger.Println("Flushing " + b.name)
-			} else {
-				h.logger.Println("NOT flushing " + b.name + " (is empty)")
-			}
-
+			h.logger.Info("flushing retry buffer", "backend", b.name)
 			r.empty()
 		}
 	}
@@ -250,6 +279,27 @@ func (h *HTTP) handleFlush(w http.ResponseWriter, r *http.Request, start time.Ti
 	jsonResponse(w, response{http.StatusOK, http.StatusText(http.StatusOK)})
 }
 
+func (h *HTTP) handleReload(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	if h.reload == nil {
+		jsonResponse(w, response{http.StatusNotImplemented, "configuration reload not available"})
+		return
+	}
+
+	if err := h.reload(); err != nil {
+		h.logger.Error("unable to reload configuration", "error", err)
+		jsonResponse(w, response{http.StatusInternalServerError, "unable to reload configuration: " + err.Error()})
+		return
+	}
+
+	jsonResponse(w, response{http.StatusOK, http.StatusText(http.StatusOK)})
+}
+
 func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time.Time) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
@@ -262,6 +312,12 @@ func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time
 	}
 
 	queryParams := r.URL.Query()
+	level, report, err := h.writeOptions(r, queryParams)
+	if err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, "invalid consistency level"})
+		return
+	}
+
 	bodyBuf := getBuf()
 	_, _ = bodyBuf.ReadFrom(r.Body)
 
@@ -269,23 +325,28 @@ func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time
 	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
 	if err != nil {
 		putBuf(bodyBuf)
-		log.Printf("parse points error: %s", err)
+		h.logger.Warn("unable to parse points", "error", err)
 		jsonResponse(w, response{http.StatusBadRequest, "unable to parse points"})
 		return
 	}
 
+	metricPointsReceived.add(float64(len(points)), h.Name())
+	metricBytesReceived.add(float64(bodyBuf.Len()), h.Name())
+
+	points = h.transforms.apply(points)
+
 	outBuf := getBuf()
-	for _, p := range points {
-		// Those two functions never return any errors, let's just ignore the return value
-		_, _ = outBuf.WriteString(p.PrecisionString(precision))
-		_ = outBuf.WriteByte('\n')
-	}
+	writePoints(outBuf, points, precision)
 
-	// done with the input points
-	putBuf(bodyBuf)
+	// points of each shard, if sharding is enabled
+	var batches []*shardBatch
+	if h.shards != nil {
+		batches = h.shards.split(points, precision)
+	}
 
 	// normalize query string
 	query := queryParams.Encode()
+	db, rp := queryParams.Get("db"), queryParams.Get("rp")
 
 	outBytes := outBuf.Bytes()
 
@@ -295,89 +356,164 @@ func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time
 	var wg sync.WaitGroup
 	wg.Add(len(h.backends))
 
-	var responses = make(chan *responseData, len(h.backends))
+	var responses = make(chan *backendResult, len(h.backends))
+
+	// number of backends the points are sent to
+	n := 0
 
 	for _, b := range h.backends {
 		b := b
 
-		// Don't do the request if the tags do not match the filters
-		err := b.validateRegexps(points)
-		if err != nil {
-			if h.log {
-				h.logger.Printf("request invalidated by regular expression for backend: %s", b.name)
-				h.logger.Printf(err.Error())
-			}
-
+		// Disabled and draining backends do not count for the consistency
+		if err := b.skipped(); err != nil {
+			responses <- &backendResult{Name: b.name, Filtered: true, Error: err.Error()}
 			wg.Done()
 			continue
 		}
 
+		// Only send the points of its shard to a sharded backend
+		points, outBytes := points, outBytes
+		if b.shard >= 0 {
+			sb := batches[b.shard]
+			if sb == nil {
+				responses <- &backendResult{Name: b.name, Filtered: true, Error: "no points routed to shard " + h.shards.names[b.shard]}
+				wg.Done()
+				continue
+			}
+			points, outBytes = sb.points, sb.buf.Bytes()
+		}
+
+		// Only send the points matching the filters
+		kept := b.filterPoints(points, db, rp, start)
+		if dropped := len(points) - len(kept); dropped > 0 {
+			h.logger.Debug("points filtered out", "backend", b.name, "points", dropped)
+			metricPointsFiltered.add(float64(dropped), h.Name(), b.name)
+
+			if len(kept) == 0 {
+				responses <- &backendResult{Name: b.name, Filtered: true, Error: errPointsFiltered.Error()}
+				wg.Done()
+				continue
+			}
+		}
+
+		// The points of an InfluxDB 2.x backend may be sent in another precision
+		precision, query := precision, query
+		converted := b.v2 && v2Precision(precision) != precision
+		if converted {
+			precision = v2Precision(precision)
+			query = withPrecision(query, precision)
+		}
+
+		// Rewrite the points for this backend only
+		var rewritten *bytes.Buffer
+		if len(kept) < len(points) || len(b.transforms) > 0 || converted {
+			points = b.transforms.apply(kept)
+			if len(points) == 0 && len(kept) > 0 {
+				responses <- &backendResult{Name: b.name, Filtered: true, Error: "no points left by the transforms"}
+				wg.Done()
+				continue
+			}
+
+			rewritten = getBuf()
+			writePoints(rewritten, points, precision)
+			outBytes = rewritten.Bytes()
+		}
+
+		n++
 		go func() {
 			defer wg.Done()
-			resp, err := b.post(outBytes, query, authHeader, b.endpoints.Write)
-			if err != nil {
-				log.Printf("Problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
-				if h.log {
-					h.logger.Printf("Content: %s", bodyBuf.String())
-				}
+			if rewritten != nil {
+				defer putBuf(rewritten)
+			}
 
-				responses <- &responseData{}
-			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
-				}
-				responses <- resp
+			start := time.Now()
+			resp, err := b.post(outBytes, b.renamer.apply(query), authHeader, b.endpoints.Write)
+			if err != nil {
+				h.logger.Error("unable to post", "backend", b.name, "error", err)
+				h.logger.Debug("content not posted", "backend", b.name, "content", string(outBytes))
+			} else if resp.StatusCode/100 == 5 {
+				h.logger.Warn("5xx response", "backend", b.name, "status", resp.StatusCode)
 			}
+
+			h.observeWrite(b, len(points), len(outBytes), resp, err, start)
+			responses <- newBackendResult(b, resp, err, start)
 		}()
 	}
 
 	go func() {
 		wg.Wait()
 		close(responses)
+
+		// The points read the body until the filters and
+		// transforms of every backend have been applied
+		putBuf(bodyBuf)
 		putBuf(outBuf)
+		for _, sb := range batches {
+			if sb != nil {
+				putBuf(sb.buf)
+			}
+		}
 	}()
 
-	var errResponse *responseData
+	outputs := h.writeResult(w, responses, level, n, report)
+	accessOf(r).record(len(points), outputs)
+}
+
+// v2Precisions maps the precisions of the InfluxDB 2.x API to the 1.x ones
+var v2Precisions = map[string]string{
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
 
-	w.Header().Set("Content-Type", "text/plain")
+// handleV2Write accepts the writes of the InfluxDB 2.x API, relayed as
+// standard writes: the bucket names the database and retention policy,
+// "db/rp" or "db" for the default retention policy, and the organization is
+// ignored. A "Token username:password" authorization is sent as basic auth
+func (h *HTTP) handleV2Write(w http.ResponseWriter, r *http.Request, start time.Time) {
+	queryParams := r.URL.Query()
 
-	for resp := range responses {
+	if r.Method == http.MethodPost {
+		bucket := queryParams.Get("bucket")
+		if bucket == "" {
+			jsonResponse(w, response{http.StatusBadRequest, "missing parameter: bucket"})
+			return
+		}
 
-		switch resp.StatusCode / 100 {
-		case 2:
-			// Status accepted means buffering,
-			if resp.StatusCode == http.StatusAccepted {
-				if h.log {
-					h.logger.Printf("could not reach relay %q, buffering...", h.Name())
-				}
+		db, rp := bucket, ""
+		if i := strings.IndexByte(bucket, '/'); i >= 0 {
+			db, rp = bucket[:i], bucket[i+1:]
+		}
+		queryParams.Set("db", db)
+		if rp != "" {
+			queryParams.Set("rp", rp)
+		}
 
-				w.WriteHeader(http.StatusAccepted)
+		if precision := queryParams.Get("precision"); precision != "" {
+			p, ok := v2Precisions[precision]
+			if !ok {
+				jsonResponse(w, response{http.StatusBadRequest, "invalid precision"})
 				return
 			}
+			queryParams.Set("precision", p)
+		}
 
-			w.WriteHeader(http.StatusNoContent)
-			return
-
-		case 4:
-			// User error
-			resp.Write(w)
-			return
+		queryParams.Del("bucket")
+		queryParams.Del("org")
+		queryParams.Del("orgID")
+		r.URL.RawQuery = queryParams.Encode()
 
-		default:
-			// Hold on to one of the responses to return back to the client
-			errResponse = nil
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Token ") && strings.Contains(auth, ":") {
+			r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth[len("Token "):])))
 		}
 	}
 
-	// No successful writes
-	if errResponse == nil {
-		// Failed to make any valid request...
-		jsonResponse(w, response{http.StatusServiceUnavailable, "unable to write points"})
-		return
-	}
+	h.handleStandard(w, r, start)
 }
 
-func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
+func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, start time.Time) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
 		if r.Method == http.MethodOptions {
@@ -388,35 +524,157 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		}
 	}
 
+	queryParams := r.URL.Query()
+	level, report, err := h.writeOptions(r, queryParams)
+	if err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, "invalid consistency level"})
+		return
+	}
 	authHeader := r.Header.Get("Authorization")
 
 	bodyBuf := getBuf()
 	_, _ = bodyBuf.ReadFrom(r.Body)
 
+	req, err := decodePromWrite(bodyBuf.Bytes())
+	if err != nil {
+		putBuf(bodyBuf)
+		h.logger.Warn("unable to decode prometheus write request", "error", err)
+		jsonResponse(w, response{http.StatusBadRequest, "unable to decode prometheus write request"})
+		return
+	}
+
+	points, dropped, err := promToPoints(req)
+	if err != nil {
+		putBuf(bodyBuf)
+		h.logger.Warn("unable to convert prometheus samples", "error", err)
+		jsonResponse(w, response{http.StatusBadRequest, "unable to convert prometheus samples"})
+		return
+	}
+
+	if dropped > 0 {
+		h.logger.Debug("dropped prometheus samples which cannot be converted", "samples", dropped)
+	}
+
 	outBytes := bodyBuf.Bytes()
+	metricPointsReceived.add(float64(len(points)), h.Name())
+	metricBytesReceived.add(float64(len(outBytes)), h.Name())
+
+	query := queryParams.Encode()
+	db, rp := queryParams.Get("db"), queryParams.Get("rp")
+
+	// The converted points are sent to the outputs without
+	// a Prometheus endpoint, with a nanosecond precision
+	var lineBuf *bytes.Buffer
+	var lineQuery string
+
+	// points of each shard, if sharding is enabled
+	var batches []*shardBatch
+	if h.shards != nil {
+		batches = h.shards.split(points, "")
+	}
+	received := len(points)
 
 	var wg sync.WaitGroup
 	wg.Add(len(h.backends))
 
-	var responses = make(chan *responseData, len(h.backends))
+	var responses = make(chan *backendResult, len(h.backends))
+
+	// number of backends the request is sent to
+	n := 0
 
 	for _, b := range h.backends {
 		b := b
 
-		go func() {
-			defer wg.Done()
-			resp, err := b.post(outBytes, r.URL.RawQuery, authHeader, b.endpoints.PromWrite)
-			if err != nil {
-				log.Printf("problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
+		// Disabled and draining backends do not count for the consistency
+		if err := b.skipped(); err != nil {
+			responses <- &backendResult{Name: b.name, Filtered: true, Error: err.Error()}
+			wg.Done()
+			continue
+		}
+
+		// Only send the samples of its shard to a sharded backend
+		points := points
+		if b.shard >= 0 {
+			sb := batches[b.shard]
+			if sb == nil {
+				responses <- &backendResult{Name: b.name, Filtered: true, Error: "no points routed to shard " + h.shards.names[b.shard]}
+				wg.Done()
+				continue
+			}
+			points = sb.points
+		}
+
+		// Only send the samples matching the filters
+		kept := b.filterPoints(points, db, rp, start)
+		if dropped := len(points) - len(kept); dropped > 0 {
+			h.logger.Debug("points filtered out", "backend", b.name, "points", dropped)
+			metricPointsFiltered.add(float64(dropped), h.Name(), b.name)
 
-				responses <- &responseData{}
+			if len(kept) == 0 {
+				responses <- &backendResult{Name: b.name, Filtered: true, Error: errPointsFiltered.Error()}
+				wg.Done()
+				continue
+			}
+		}
+
+		// The request is only sent as is when the backend gets every sample
+		partial := len(kept) < received
+
+		var rewritten *bytes.Buffer
+		body, query, endpoint := outBytes, query, b.endpoints.PromWrite
+		if endpoint == "" && b.endpoints.Write != "" {
+			if lineQuery == "" {
+				params := make(url.Values, len(queryParams))
+				for k, v := range queryParams {
+					if k != "precision" {
+						params[k] = v
+					}
+				}
+				lineQuery = params.Encode()
+			}
+
+			if partial {
+				rewritten = getBuf()
+				writePoints(rewritten, kept, "")
+				body = rewritten.Bytes()
 			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
+				if lineBuf == nil {
+					lineBuf = getBuf()
+					writePoints(lineBuf, points, "")
 				}
+				body = lineBuf.Bytes()
+			}
+			query, endpoint = lineQuery, b.endpoints.Write
+		} else if partial {
+			// The request is encoded again with the samples kept only
+			data, err := pointsToProm(kept)
+			if err != nil {
+				h.logger.Error("unable to encode prometheus write request", "backend", b.name, "error", err)
+				responses <- &backendResult{Name: b.name, Error: err.Error()}
+				wg.Done()
+				continue
+			}
+			body = data
+		}
 
-				responses <- resp
+		n++
+		go func() {
+			defer wg.Done()
+			if rewritten != nil {
+				defer putBuf(rewritten)
 			}
+
+			start := time.Now()
+			resp, err := b.post(body, b.renamer.apply(query), authHeader, endpoint)
+			if err != nil {
+				h.logger.Error("unable to post", "backend", b.name, "error", err)
+			} else if resp.StatusCode/100 == 5 {
+				h.logger.Warn("5xx response", "backend", b.name, "status", resp.StatusCode)
+			}
+
+			h.observeWrite(b, len(points), len(body), resp, err, start)
+
+			responses <- newBackendResult(b, resp, err, start)
 		}()
 	}
 
@@ -424,43 +682,190 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		wg.Wait()
 		close(responses)
 		putBuf(bodyBuf)
+		if lineBuf != nil {
+			putBuf(lineBuf)
+		}
+		for _, sb := range batches {
+			if sb != nil {
+				putBuf(sb.buf)
+			}
+		}
 	}()
 
-	var errResponse *responseData
+	outputs := h.writeResult(w, responses, level, n, report)
+	accessOf(r).record(len(points), outputs)
+}
 
-	w.Header().Set("Content-Type", "text/plain")
+func (h *HTTP) handleQuery(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
 
-	for resp := range responses {
+	// The body is kept to be sent again when failing over
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, "unable to read body"})
+		return
+	}
 
-		switch resp.StatusCode / 100 {
-		case 2:
-			// Status accepted means buffering,
-			if resp.StatusCode == http.StatusAccepted {
-				if h.log {
-					h.logger.Printf("could not reach relay %q, buffering...", h.Name())
-				}
-				w.WriteHeader(http.StatusAccepted)
-				return
-			}
+	if h.shards != nil {
+		h.handleShardedQuery(w, r, body)
+		return
+	}
 
-			w.WriteHeader(http.StatusNoContent)
+	backends := h.queries.order(h.backends)
+	if len(backends) == 0 {
+		jsonResponse(w, response{http.StatusServiceUnavailable, "no backend available for queries"})
+		return
+	}
+
+	resp, b, errResponse := h.forwardQuery(r.Method, r.Header, r.URL.RawQuery, body, backends)
+	if resp == nil {
+		if errResponse == nil {
+			jsonResponse(w, response{http.StatusServiceUnavailable, "unable to forward query"})
 			return
+		}
 
-		case 4:
-			// User error
-			resp.Write(w)
+		errResponse.Write(w)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.Header().Set(HeaderBackend, b.name)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// deadLetters returns the dead letters of the backend named in the
+// query string, writing an error to the client when there is none
+func (h *HTTP) deadLetters(w http.ResponseWriter, r *http.Request) (*httpBackend, *deadLetters, uint64, bool) {
+	queryParams := r.URL.Query()
+
+	var id uint64
+	if s := queryParams.Get("id"); s != "" {
+		var err error
+		if id, err = strconv.ParseUint(s, 10, 64); err != nil {
+			jsonResponse(w, response{http.StatusBadRequest, "invalid parameter: id"})
+			return nil, nil, 0, false
+		}
+	}
+
+	name := queryParams.Get("backend")
+	if name == "" {
+		jsonResponse(w, response{http.StatusBadRequest, "missing parameter: backend"})
+		return nil, nil, 0, false
+	}
+
+	for _, b := range h.backends {
+		if b.name != name {
+			continue
+		}
+
+		if rb := b.getRetryBuffer(); rb != nil && rb.deadLetters != nil {
+			return b, rb.deadLetters, id, true
+		}
+		break
+	}
+
+	jsonResponse(w, response{http.StatusNotFound, "no dead letters for backend " + name})
+	return nil, nil, 0, false
+}
+
+func (h *HTTP) handleDeadLetters(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		list := make(map[string][]*deadLetter)
+		for _, b := range h.backends {
+			if rb := b.getRetryBuffer(); rb != nil && rb.deadLetters != nil {
+				list[b.name] = rb.deadLetters.list()
+			}
+		}
+
+		jsonResponse(w, response{http.StatusOK, list})
+
+	case http.MethodDelete:
+		_, d, id, ok := h.deadLetters(w, r)
+		if !ok {
 			return
+		}
 
-		default:
-			// Hold on to one of the responses to return back to the client
-			errResponse = nil
+		removed := 0
+		for _, l := range d.get(id) {
+			if d.remove(l.ID) {
+				removed++
+			}
 		}
+
+		jsonResponse(w, response{http.StatusOK, map[string]int{"removed": removed}})
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
 	}
+}
 
-	// No successful writes
-	if errResponse == nil {
-		// Failed to make any valid request...
-		jsonResponse(w, response{http.StatusServiceUnavailable, "unable to write points"})
+func (h *HTTP) handleDeadLetterDownload(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	_, d, id, ok := h.deadLetters(w, r)
+	if !ok {
+		return
+	}
+
+	out := getBuf()
+	defer putBuf(out)
+	for _, l := range d.get(id) {
+		_, _ = out.Write(l.data)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out.Bytes())
+}
+
+type resubmitReport struct {
+	Resubmitted []uint64          `json:"resubmitted"`
+	Failed      map[uint64]string `json:"failed,omitempty"`
+}
+
+func (h *HTTP) handleDeadLetterResubmit(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	b, d, id, ok := h.deadLetters(w, r)
+	if !ok {
 		return
 	}
+
+	report := resubmitReport{Resubmitted: []uint64{}}
+	for _, l := range d.get(id) {
+		resp, err := b.post(l.data, l.query, l.auth, l.Endpoint)
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("backend answered %d", resp.StatusCode)
+		}
+
+		if err != nil {
+			if report.Failed == nil {
+				report.Failed = make(map[uint64]string)
+			}
+			report.Failed[l.ID] = err.Error()
+			continue
+		}
+
+		d.remove(l.ID)
+		report.Resubmitted = append(report.Resubmitted, l.ID)
+	}
+
+	jsonResponse(w, response{http.StatusOK, report})
 }
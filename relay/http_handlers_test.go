@@ -2,6 +2,7 @@ package relay
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -14,6 +15,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 )
 
 var (
@@ -76,6 +78,8 @@ var (
 			"Allow":          []string{http.MethodPost},
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"0"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -85,6 +89,8 @@ var (
 			"Allow":          []string{http.MethodPost},
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -92,6 +98,8 @@ var (
 		writeBuf: &bytes.Buffer{},
 		header: http.Header{
 			"Content-Type": []string{"text/plain"},
+			HeaderAcks:     []string{"1"},
+			HeaderBackends: []string{"1"},
 		},
 		code: http.StatusNoContent,
 	}
@@ -100,6 +108,8 @@ var (
 		header: http.Header{
 			"Content-Length": []string{"0"},
 			"Content-Type":   []string{"text/plain"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusBadRequest,
 	}
@@ -108,6 +118,8 @@ var (
 		header: http.Header{
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -126,6 +138,8 @@ var (
 			"Allow":          []string{http.MethodPost},
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"0"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -135,6 +149,8 @@ var (
 			"Allow":          []string{http.MethodPost},
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -142,6 +158,8 @@ var (
 		writeBuf: &bytes.Buffer{},
 		header: http.Header{
 			"Content-Type": []string{"text/plain"},
+			HeaderAcks:     []string{"1"},
+			HeaderBackends: []string{"1"},
 		},
 		code: http.StatusNoContent,
 	}
@@ -150,6 +168,8 @@ var (
 		header: http.Header{
 			"Content-Length": []string{"0"},
 			"Content-Type":   []string{"text/plain"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusBadRequest,
 	}
@@ -158,6 +178,8 @@ var (
 		header: http.Header{
 			"Content-Type":   []string{"application/json"},
 			"Content-Length": []string{"24"},
+			HeaderAcks:       []string{"0"},
+			HeaderBackends:   []string{"1"},
 		},
 		code: http.StatusServiceUnavailable,
 	}
@@ -173,6 +195,8 @@ var (
 		writeBuf: &bytes.Buffer{},
 		header: http.Header{
 			"Content-Type": []string{"text/plain"},
+			HeaderAcks:     []string{"1"},
+			HeaderBackends: []string{"1"},
 		},
 		code: http.StatusNoContent,
 	}
@@ -223,8 +247,10 @@ var (
 func captureOutput(f func()) string {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
+	logging.SetOutput(&buf)
 	f()
 	log.SetOutput(os.Stderr)
+	logging.SetOutput(os.Stderr)
 	return buf.String()
 }
 
@@ -353,8 +379,7 @@ func TestHandlePromBackendDown(t *testing.T) {
 	output := captureOutput(func() {
 		h.handleProm(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, "problem posting to relay \"http://\" backend \"test_prometheus\": Post : unsupported protocol scheme \"\"\n", output)
+	assert.Contains(t, output, ` level=error msg="unable to post" relay=http:// backend=test_prometheus error="Post `)
 	WriterTest(t, BackendDownPromWriter, w)
 	h.backends = h.backends[:0]
 }
@@ -393,7 +418,6 @@ func TestHandlePromBackendUpError400(t *testing.T) {
 	h.backends = h.backends[:0]
 }
 
-
 func TestHandlePromBackendUpError500(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, emptyConfig, false)
@@ -408,9 +432,8 @@ func TestHandlePromBackendUpError500(t *testing.T) {
 	output := captureOutput(func() {
 		h.handleProm(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, `5xx response for relay "http://" backend "test_prometheus": 500
-`, output)
+	assert.Contains(t, output, ` level=warn msg="5xx response" relay=http:// backend=test_prometheus status=500
+`)
 	WriterTest(t, BackendUpPromError500Writer, w)
 	h.backends = h.backends[:0]
 }
@@ -454,8 +477,7 @@ func TestHandleInfluxBackendDown(t *testing.T) {
 	output := captureOutput(func() {
 		h.handleStandard(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, "Problem posting to relay \"http://\" backend \"test_influx\": Post : unsupported protocol scheme \"\"\n", output)
+	assert.Contains(t, output, ` level=error msg="unable to post" relay=http:// backend=test_influx error="Post `)
 	WriterTest(t, BackendDownInfluxWriter, w)
 	h.backends = h.backends[:0]
 }
@@ -508,9 +530,8 @@ func TestHandleInfluxBackendUpError500(t *testing.T) {
 	output := captureOutput(func() {
 		h.handleStandard(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, `5xx response for relay "http://" backend "test_influx": 500
-`, output)
+	assert.Contains(t, output, ` level=warn msg="5xx response" relay=http:// backend=test_influx status=500
+`)
 	WriterTest(t, BackendUpInfluxError500Writer, w)
 	h.backends = h.backends[:0]
 }
@@ -634,3 +655,159 @@ func TestAdminErrorClient(t *testing.T) {
 	assert.Equal(t, buf[:43], buf2[:43])
 }
 
+func TestHandleInfluxConsistency(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	for _, location := range []string{ValidServer.URL, ValidServer.URL, Error500.URL} {
+		cfg := config.HTTPOutputConfig{Name: "test_influx", Location: location + "/influxdb"}
+		b, _ := newHTTPBackend(&cfg, config.Filters{})
+		h.backends = append(h.backends, b)
+	}
+
+	for level, code := range map[string]int{
+		"any":    http.StatusNoContent,
+		"one":    http.StatusNoContent,
+		"quorum": http.StatusNoContent,
+		"all":    http.StatusInternalServerError,
+		"wrong":  http.StatusBadRequest,
+	} {
+		resetWriter()
+		influxBody.buf = bytes.NewBuffer([]byte("cpu value=1"))
+		r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&consistency="+level, influxBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		captureOutput(func() {
+			h.handleStandard(w, r, ti)
+		})
+		assert.Equal(t, code, w.code, level)
+
+		if level == "all" {
+			assert.Equal(t, "3", w.header.Get(HeaderBackends))
+			assert.Equal(t, "2", w.header.Get(HeaderAcks))
+		}
+	}
+}
+
+// bufferingPoster answers every write as buffered
+type bufferingPoster struct {
+	fakePoster
+}
+
+func (p *bufferingPoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	return &responseData{StatusCode: http.StatusAccepted}, nil
+}
+
+func TestHandleInfluxConsistencyBuffered(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+	h.backends = append(h.backends, stateBackend("buffered", &bufferingPoster{}))
+
+	post := func() int {
+		resetWriter()
+		influxBody.buf = bytes.NewBuffer([]byte("cpu value=1"))
+		r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test", influxBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.handleStandard(w, r, ti)
+		return w.code
+	}
+
+	// The write is only accepted when no backend wrote it
+	assert.Equal(t, http.StatusAccepted, post())
+
+	h.backends = append(h.backends, stateBackend("written", &fakePoster{}))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusNoContent, post())
+	}
+}
+
+func TestHandleInfluxReport(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	filters := config.Filters{{MeasurementExpression: "^mem$", Outputs: []string{"filtered"}}}
+	assert.Nil(t, filters.LoadRegexps())
+
+	for name, location := range map[string]string{"valid": ValidServer.URL, "error": Error500.URL, "filtered": ValidServer.URL} {
+		cfg := config.HTTPOutputConfig{Name: name, Location: location + "/influxdb"}
+		b, _ := newHTTPBackend(&cfg, filters)
+		h.backends = append(h.backends, b)
+	}
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(HeaderReport, "true")
+
+	captureOutput(func() {
+		h.handleStandard(w, r, ti)
+	})
+	assert.Equal(t, http.StatusOK, w.code)
+
+	var report writeReport
+	assert.Nil(t, json.Unmarshal(w.writeBuf.Bytes(), &report))
+	assert.Equal(t, 1, report.Acks)
+	assert.Equal(t, 2, report.Backends)
+
+	outputs := make(map[string]*backendResult)
+	for _, o := range report.Outputs {
+		outputs[o.Name] = o
+	}
+	assert.Equal(t, 3, len(outputs))
+	assert.Equal(t, http.StatusOK, outputs["valid"].Status)
+	assert.Equal(t, http.StatusInternalServerError, outputs["error"].Status)
+	assert.Equal(t, true, outputs["filtered"].Filtered)
+}
+
+func TestHandleV2Write(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	var query, auth, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		query, auth, body = r.URL.RawQuery, r.Header.Get("Authorization"), string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := config.HTTPOutputConfig{Name: "v1", Location: server.URL, Endpoints: config.HTTPEndpointConfig{Write: "/write"}}
+	b, _ := newHTTPBackend(&cfg, config.Filters{})
+	h.backends = append(h.backends, b)
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 1500000000000"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v2/write?org=acme&bucket=telegraf/autogen&precision=ms&report=true", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Token user:secret")
+
+	h.handleV2Write(w, r, ti)
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, "db=telegraf&precision=ms&rp=autogen", query)
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", auth)
+	assert.Equal(t, "cpu value=1 1500000000000\n", body)
+}
+
+func TestHandleV2WriteInvalid(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	for _, q := range []string{"org=acme", "bucket=telegraf&precision=m"} {
+		resetWriter()
+		influxBody.buf = bytes.NewBuffer([]byte("cpu value=1"))
+		r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v2/write?"+q, influxBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.handleV2Write(w, r, ti)
+		assert.Equal(t, http.StatusBadRequest, w.code, q)
+	}
+}
@@ -2,7 +2,12 @@ package relay
 
 import (
 	"compress/gzip"
+	"context"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,12 +20,111 @@ func allMiddlewares(h *HTTP, handlerFunc relayHandlerFunc) relayHandlerFunc {
 	return res
 }
 
+type accessKey struct{}
+
+// accessEntry holds what the handlers tell about a request for the access log
+type accessEntry struct {
+	points  int
+	outputs backendOutcomes
+}
+
+// record sets the number of points of a write and the outcome on each backend
+func (e *accessEntry) record(points int, outputs []*backendResult) {
+	if e != nil {
+		e.points, e.outputs = points, outputs
+	}
+}
+
+// accessOf returns the access log entry of a request, nil when not logged
+func accessOf(r *http.Request) *accessEntry {
+	e, _ := r.Context().Value(accessKey{}).(*accessEntry)
+	return e
+}
+
+// backendOutcomes are logged as a list of name:status in the logfmt format
+type backendOutcomes []*backendResult
+
+func (o backendOutcomes) String() string {
+	outcomes := make([]string, 0, len(o))
+	for _, res := range o {
+		var outcome string
+		switch {
+		case res.Filtered:
+			outcome = "filtered"
+		case res.Buffered:
+			outcome = "buffered"
+		case res.Status == 0:
+			outcome = "error"
+		default:
+			outcome = strconv.Itoa(res.Status)
+		}
+		outcomes = append(outcomes, res.Name+":"+outcome)
+	}
+	return strings.Join(outcomes, ",")
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// logMiddleWare writes an access log line once a request is served
 func (h *HTTP) logMiddleWare(next relayHandlerFunc) relayHandlerFunc {
 	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
-		if h.log {
-			h.logger.Println("got request on: " + r.URL.Path)
+		if !h.accessLog {
+			next(h, w, r, start)
+			return
 		}
-		next(h, w, r, start)
+
+		e := &accessEntry{points: -1}
+		r = r.WithContext(context.WithValue(r.Context(), accessKey{}, e))
+
+		var body *countingReader
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next(h, sw, r, start)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+
+		queryParams := r.URL.Query()
+		kv := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"db", requestDatabase(r),
+			"rp", queryParams.Get("rp"),
+			"client", client,
+			"status", sw.code,
+			"duration_ms", float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if body != nil {
+			kv = append(kv, "bytes", body.n)
+		}
+		if e.points >= 0 {
+			kv = append(kv, "points", e.points, "backends", e.outputs)
+		}
+		if b := sw.Header().Get(HeaderBackend); b != "" {
+			kv = append(kv, "backend", b)
+		}
+
+		h.logger.Info("request", kv...)
 	})
 }
 
@@ -65,6 +169,7 @@ func (h *HTTP) queryMiddleWare(next relayHandlerFunc) relayHandlerFunc {
 func (h *HTTP) rateMiddleware(next relayHandlerFunc) relayHandlerFunc {
 	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
 		if h.rateLimiter != nil && !h.rateLimiter.Allow() {
+			metricRateLimited.add(1, h.Name())
 			jsonResponse(w, response{http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)})
 			return
 		}
@@ -72,3 +177,16 @@ func (h *HTTP) rateMiddleware(next relayHandlerFunc) relayHandlerFunc {
 		next(h, w, r, start)
 	})
 }
+
+func (h *HTTP) metricsMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		sw := &statusWriter{ResponseWriter: w}
+		next(h, sw, r, start)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		metricRequests.add(1, h.Name(), r.URL.Path, strconv.Itoa(sw.code))
+		metricRequestDuration.observe(time.Since(start).Seconds(), h.Name(), r.URL.Path)
+	})
+}
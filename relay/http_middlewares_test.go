@@ -3,6 +3,7 @@ package relay
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 	"time"
 )
 
@@ -132,7 +134,7 @@ func WriterTest(t *testing.T, expected *ResponseWriter, actual *ResponseWriter)
 }
 
 func createHTTP(t *testing.T, cfg config.HTTPConfig, verbose bool) *HTTP {
-	tmp, err := NewHTTP(cfg, verbose, config.Filters{})
+	tmp, err := NewHTTP(cfg, verbose, config.Filters{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -143,22 +145,23 @@ func TestLogMiddleware(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, config.HTTPConfig{}, true)
 
-	h.logger = log.New(logger, "", 0)
+	h.logger, _ = logging.New(logger, logging.FormatLogfmt, logging.LevelInfo)
 	handler := h.logMiddleWare((*HTTP).End)
-	r, err := http.NewRequest("", "influxdb", emptyBody)
+	r, err := http.NewRequest("", "influxdb?db=test", emptyBody)
 	if err != nil {
 		t.Fatal(err)
 	}
+	r.RemoteAddr = "10.0.0.1:4242"
 	handler(h, w, r, ti)
 	buf, _ := ioutil.ReadAll(logger.buffer)
-	assert.Equal(t, string(buf), "got request on: influxdb\n")
+	assert.Contains(t, string(buf), " level=info msg=request method=GET path=influxdb db=test rp=\"\" client=10.0.0.1 status=200 duration_ms=")
 }
 
 func TestLogMiddlewareNoLog(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, config.HTTPConfig{}, false)
 
-	h.logger = log.New(logger, "", 0)
+	h.logger, _ = logging.New(logger, logging.FormatLogfmt, logging.LevelInfo)
 	handler := h.logMiddleWare((*HTTP).End)
 	r, err := http.NewRequest("", "influxdb", emptyBody)
 	if err != nil {
@@ -169,6 +172,46 @@ func TestLogMiddlewareNoLog(t *testing.T) {
 	assert.Equal(t, string(buf), "")
 }
 
+func TestLogMiddlewareWrite(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, config.HTTPConfig{AccessLog: true}, false)
+	h.backends = []*httpBackend{
+		{poster: &fakePoster{}, name: "up", shard: -1, endpoints: config.HTTPEndpointConfig{Write: "/write"}},
+		{poster: &fakePoster{down: 1}, name: "down", shard: -1, endpoints: config.HTTPEndpointConfig{Write: "/write"}},
+	}
+
+	var buf bytes.Buffer
+	h.logger, _ = logging.New(&buf, logging.FormatJSON, logging.LevelInfo)
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 1\nmem value=2 1\n"))
+	r, err := http.NewRequest(http.MethodPost, "http://influxdb:8086/write?db=test&report=true", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allMiddlewares(h, (*HTTP).handleStandard)(h, w, r, ti)
+
+	// The access log line comes after the ones of the handler
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(lines[len(lines)-1], &entry))
+	assert.Equal(t, "/write", entry["path"])
+	assert.Equal(t, "test", entry["db"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(28), entry["bytes"])
+	assert.Equal(t, float64(2), entry["points"])
+
+	// Every backend is waited for when a report is asked for
+	outcomes := make(map[string]interface{})
+	for _, o := range entry["backends"].([]interface{}) {
+		o := o.(map[string]interface{})
+		outcomes[o["name"].(string)] = o["status"]
+	}
+	assert.Equal(t, map[string]interface{}{"up": float64(204), "down": float64(503)}, outcomes)
+
+	assert.Equal(t, "up:204,down:503", backendOutcomes{{Name: "up", Status: 204}, {Name: "down", Status: 503}}.String())
+}
+
 func TestQueryMiddleware(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, config.HTTPConfig{}, false)
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestHTTPReload(t *testing.T) {
+	cfg := config.HTTPConfig{
+		Addr: "127.0.0.1:9096",
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "kept", Location: "http://127.0.0.1:8086/", BufferSizeMB: 1},
+			{Name: "moved", Location: "http://127.0.0.1:8087/", BufferSizeMB: 1},
+		},
+	}
+	h := createHTTP(t, cfg, false)
+	kept, moved := h.backends[0].getRetryBuffer(), h.backends[1].getRetryBuffer()
+
+	cfg.Outputs = []config.HTTPOutputConfig{
+		{Name: "moved", Location: "http://127.0.0.1:9087/", BufferSizeMB: 1},
+		{Name: "kept", Location: "http://127.0.0.1:8086/", BufferSizeMB: 1},
+		{Name: "new", Location: "http://127.0.0.1:8088/"},
+	}
+	fs := config.Filters{{MeasurementExpression: "^cpu$", Outputs: []string{"kept"}}}
+	assert.Nil(t, fs.LoadRegexps())
+
+	n, err := h.Reload(cfg, false, fs, nil)
+	assert.Nil(t, err)
+
+	// The buffers are handed over, the moved one writes
+	// to its new location once the relay is replaced
+	assert.True(t, n.backends[1].getRetryBuffer() == kept)
+	assert.True(t, n.backends[0].getRetryBuffer() == moved)
+	assert.Equal(t, 1, len(n.backends[1].filters))
+	assert.False(t, moved.poster() == n.backends[0].target)
+
+	assert.True(t, h.Replace(n))
+	assert.True(t, h.current() == n)
+	assert.True(t, moved.poster() == n.backends[0].target)
+
+	// The buffer of an output which does not buffer anymore is closed
+	cfg.Outputs[0].BufferSizeMB = 0
+	n, err = h.Reload(cfg, false, fs, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, n.backends[0].getRetryBuffer())
+
+	assert.True(t, h.Replace(n))
+	_, err = moved.list.add([]byte("cpu value=1\n"), "", "", "")
+	assert.Equal(t, errBufferClosed, err)
+
+	cfg.Addr = "127.0.0.1:9097"
+	n, err = h.Reload(cfg, false, fs, nil)
+	assert.Nil(t, err)
+	assert.False(t, h.Replace(n))
+
+	cfg.Consistency = "wrong"
+	_, err = h.Reload(cfg, false, fs, nil)
+	assert.NotNil(t, err)
+}
+
+func TestHTTPReloadBufferSettings(t *testing.T) {
+	cfg := config.HTTPOutputConfig{Name: "kept", Location: "http://127.0.0.1:8086/", BufferSizeMB: 1}
+	prev, err := newHTTPBackend(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prev.getRetryBuffer().close()
+
+	reuse := func(cfg config.HTTPOutputConfig) string {
+		return captureOutput(func() {
+			b, err := reuseHTTPBackend(&cfg, nil, prev)
+			assert.Nil(t, err)
+			assert.True(t, b.getRetryBuffer() == prev.getRetryBuffer())
+		})
+	}
+
+	// A kept buffer does not apply the new settings, which is reported
+	assert.NotContains(t, reuse(cfg), "previous settings")
+	cfg.BufferMaxAttempts = 3
+	assert.Contains(t, reuse(cfg), "previous settings")
+}
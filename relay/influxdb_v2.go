@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// Types of HTTP backends
+const (
+	BackendInfluxDB   = "influxdb"
+	BackendInfluxDBv2 = "influxdb-v2"
+)
+
+// Default bucket template of the InfluxDB 2.x backends
+const DefaultV2Bucket = "{db}/{rp}"
+
+// Retention policy used in the bucket template when a write names none
+const defaultV2RetentionPolicy = "autogen"
+
+// Default write endpoint of the InfluxDB 2.x backends
+const defaultV2WriteEndpoint = "/api/v2/write"
+
+// v1Precisions maps the precisions of the InfluxDB 1.x API to the 2.x ones
+var v1Precisions = map[string]string{
+	"n":  "ns",
+	"ns": "ns",
+	"u":  "us",
+	"us": "us",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// v2Precision returns the precision of the points written to an InfluxDB 2.x
+// backend: it has no minute or hour precision, such points are sent in seconds
+func v2Precision(precision string) string {
+	if precision == "m" || precision == "h" {
+		return "s"
+	}
+	return precision
+}
+
+// withPrecision returns a query string with another precision
+func withPrecision(query string, precision string) string {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	params.Set("precision", precision)
+	return params.Encode()
+}
+
+// v2Poster writes to an InfluxDB 2.x backend: the query string of the
+// 1.x writes is rewritten to name a bucket and an organization
+type v2Poster struct {
+	poster
+
+	org    string
+	bucket string
+}
+
+func newV2Poster(p poster, cfg *config.HTTPOutputConfig) *v2Poster {
+	v := &v2Poster{
+		poster: p,
+		org:    cfg.Org,
+		bucket: cfg.Bucket,
+	}
+
+	if v.bucket == "" {
+		v.bucket = DefaultV2Bucket
+	}
+	return v
+}
+
+// v2Query returns the query string of a 2.x write from a 1.x one
+func (v *v2Poster) v2Query(query string) (string, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	rp := params.Get("rp")
+	if rp == "" {
+		rp = defaultV2RetentionPolicy
+	}
+
+	res := url.Values{}
+	res.Set("bucket", strings.NewReplacer("{db}", params.Get("db"), "{rp}", rp).Replace(v.bucket))
+	if v.org != "" {
+		res.Set("org", v.org)
+	}
+
+	if precision := params.Get("precision"); precision != "" {
+		p, ok := v1Precisions[precision]
+		if !ok {
+			return "", fmt.Errorf("precision %q not supported by InfluxDB 2.x", precision)
+		}
+		res.Set("precision", p)
+	}
+
+	return res.Encode(), nil
+}
+
+func (v *v2Poster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	query, err := v.v2Query(query)
+	if err != nil {
+		// Rejected like the backend would, rather than retried
+		return &responseData{
+			ContentType: "application/json",
+			StatusCode:  http.StatusBadRequest,
+			Body:        []byte(`{"error":` + strconv.Quote(err.Error()) + `}`),
+		}, nil
+	}
+
+	return v.poster.post(buf, query, auth, endpoint)
+}
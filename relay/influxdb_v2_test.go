@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestV2Query(t *testing.T) {
+	v := newV2Poster(nil, &config.HTTPOutputConfig{Org: "acme"})
+
+	for query, expected := range map[string]string{
+		"db=telegraf":                          "bucket=telegraf%2Fautogen&org=acme",
+		"db=telegraf&rp=week&precision=s":      "bucket=telegraf%2Fweek&org=acme&precision=s",
+		"db=telegraf&precision=n&u=user&p=pwd": "bucket=telegraf%2Fautogen&org=acme&precision=ns",
+		"db=telegraf&precision=us":             "bucket=telegraf%2Fautogen&org=acme&precision=us",
+	} {
+		q, err := v.v2Query(query)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, q, query)
+	}
+
+	v = newV2Poster(nil, &config.HTTPOutputConfig{Bucket: "{db}-{rp}"})
+	q, err := v.v2Query("db=telegraf&rp=week")
+	assert.Nil(t, err)
+	assert.Equal(t, "bucket=telegraf-week", q)
+
+	_, err = v.v2Query("db=telegraf&precision=h")
+	assert.NotNil(t, err)
+}
+
+func TestV2Backend(t *testing.T) {
+	var path, query, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query, auth = r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := config.HTTPOutputConfig{Name: "v2", Location: server.URL, Type: BackendInfluxDBv2, Org: "acme", Token: "secret"}
+	b, err := newHTTPBackend(&cfg, config.Filters{})
+	assert.Nil(t, err)
+
+	resp, err := b.post([]byte("cpu value=1\n"), "db=telegraf&rp=week", "Basic dXNlcjpwd2Q=", b.endpoints.Write)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "/api/v2/write", path)
+	assert.Equal(t, "bucket=telegraf%2Fweek&org=acme", query)
+	assert.Equal(t, "Token secret", auth)
+
+	// Writes in a precision InfluxDB 2.x does not know are rejected, the
+	// relays convert the minutes and hours before they are posted
+	resp, err = b.post([]byte("cpu value=1 1\n"), "db=telegraf&precision=m", "", b.endpoints.Write)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	cfg = config.HTTPOutputConfig{Name: "invalid", Location: server.URL, Type: "influxdb-v3"}
+	_, err = newHTTPBackend(&cfg, config.Filters{})
+	assert.NotNil(t, err)
+}
+
+func TestHandleStandardV2Precision(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	v1, v2 := new(authPoster), new(authPoster)
+	h.backends = append(h.backends, stateBackend("v1", v1), stateBackend("v2", v2))
+	h.backends[1].v2 = true
+
+	// The points written in minutes are sent in seconds to InfluxDB 2.x
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 2\n"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&precision=m&consistency=all", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleStandard(w, r, ti)
+	assert.Equal(t, http.StatusNoContent, w.code)
+	assert.Equal(t, []string{"db=test&precision=m"}, v1.queries)
+	assert.Equal(t, []string{"cpu value=1 2\n"}, v1.writes)
+	assert.Equal(t, []string{"db=test&precision=s"}, v2.queries)
+	assert.Equal(t, []string{"cpu value=1 120\n"}, v2.writes)
+}
@@ -0,0 +1,321 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of the metrics names
+const metricsNamespace = "influxdb_relay_"
+
+// Buckets of the duration histograms, in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics of the events of every relay of the process, exposed
+// in the Prometheus text format on the /metrics endpoint
+var (
+	metrics = newRegistry()
+
+	metricRequests        = metrics.counter("http_requests_total", "HTTP requests handled, per route and status code", "relay", "path", "code")
+	metricRequestDuration = metrics.histogram("http_request_duration_seconds", "Time taken to handle the HTTP requests", "relay", "path")
+	metricRateLimited     = metrics.counter("rate_limited_requests_total", "HTTP requests rejected by the rate limiter", "relay")
+
+	metricPointsReceived = metrics.counter("points_received_total", "Points received", "relay")
+	metricBytesReceived  = metrics.counter("bytes_received_total", "Bytes of the write requests received", "relay")
+
+	metricPointsForwarded  = metrics.counter("points_forwarded_total", "Points accepted by a backend, written or buffered", "relay", "backend")
+	metricBytesForwarded   = metrics.counter("bytes_forwarded_total", "Bytes accepted by a backend, written or buffered", "relay", "backend")
+	metricPointsFiltered   = metrics.counter("points_filtered_total", "Points not sent to a backend because of the filters", "relay", "backend")
+	metricBackendResponses = metrics.counter("backend_responses_total", "Responses of the backends to the writes, per status code (\"error\" when none)", "relay", "backend", "code")
+	metricBackendDuration  = metrics.histogram("backend_write_duration_seconds", "Time taken by the backends to answer the writes", "relay", "backend")
+
+	metricUDPPackets     = metrics.counter("udp_packets_total", "UDP packets received", "relay")
+	metricUDPParseErrors = metrics.counter("udp_parse_errors_total", "UDP packets which could not be parsed", "relay")
+	metricUDPDropped     = metrics.counter("udp_packets_dropped_total", "UDP packets dropped because the queue was full", "relay")
+
+	metricGraphiteParseErrors = metrics.counter("graphite_parse_errors_total", "Graphite lines which could not be parsed", "relay")
+)
+
+type metricFamily struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+
+	// counter or gauge value, or histogram sum
+	value float64
+
+	count   uint64
+	buckets []uint64
+}
+
+type registry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+func newRegistry() *registry {
+	return new(registry)
+}
+
+func newMetricFamily(name, help, typ string, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:   metricsNamespace + name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func (r *registry) register(f *metricFamily) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *registry) counter(name, help string, labels ...string) *metricFamily {
+	return r.register(newMetricFamily(name, help, "counter", labels...))
+}
+
+func (r *registry) histogram(name, help string, labels ...string) *metricFamily {
+	return r.register(newMetricFamily(name, help, "histogram", labels...))
+}
+
+// get returns the series of the label values, f must be locked
+func (f *metricFamily) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter
+func (f *metricFamily) add(v float64, values ...string) {
+	f.mu.Lock()
+	f.get(values).value += v
+	f.mu.Unlock()
+}
+
+// set sets the value of a gauge
+func (f *metricFamily) set(v float64, values ...string) {
+	f.mu.Lock()
+	f.get(values).value = v
+	f.mu.Unlock()
+}
+
+// observe adds a value to a histogram
+func (f *metricFamily) observe(v float64, values ...string) {
+	f.mu.Lock()
+	s := f.get(values)
+	s.value += v
+	s.count++
+	for i, b := range defaultBuckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	f.mu.Unlock()
+}
+
+var labelEscape = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelEscape.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the family in the Prometheus text format
+func (f *metricFamily) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labels), formatValue(s.value))
+			continue
+		}
+
+		for i, b := range defaultBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labels, "le", formatValue(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labels), s.count)
+	}
+}
+
+func (r *registry) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.families {
+		f.write(w)
+	}
+}
+
+// observeWrite records the outcome of a write sent to a backend
+func (h *HTTP) observeWrite(b *httpBackend, points int, size int, resp *responseData, err error, start time.Time) {
+	observeBackendWrite(h.Name(), b, points, size, resp, err, start)
+}
+
+// observeBackendWrite records a write sent to a backend by a relay
+func observeBackendWrite(relay string, b *httpBackend, points int, size int, resp *responseData, err error, start time.Time) {
+	metricBackendDuration.observe(time.Since(start).Seconds(), relay, b.name)
+
+	if err != nil {
+		metricBackendResponses.add(1, relay, b.name, "error")
+		return
+	}
+	metricBackendResponses.add(1, relay, b.name, strconv.Itoa(resp.StatusCode))
+
+	if resp.StatusCode/100 == 2 {
+		metricPointsForwarded.add(float64(points), relay, b.name)
+		metricBytesForwarded.add(float64(size), relay, b.name)
+	}
+}
+
+// backendMetrics returns the state of the backends of the relay,
+// which is only known when the metrics are scraped
+func (h *HTTP) backendMetrics() []*metricFamily {
+	var (
+		buffering = newMetricFamily("buffering", "Whether the backend writes are being buffered", "gauge", "relay", "backend")
+		size      = newMetricFamily("buffer_size_bytes", "Size of the writes waiting in the retry buffer", "gauge", "relay", "backend")
+		maxSize   = newMetricFamily("buffer_max_size_bytes", "Maximum size of the retry buffer", "gauge", "relay", "backend")
+		age       = newMetricFamily("buffer_oldest_age_seconds", "Age of the buffered write being retried", "gauge", "relay", "backend")
+		retries   = newMetricFamily("retry_attempts_total", "Failed attempts to send buffered writes", "counter", "relay", "backend")
+		letters   = newMetricFamily("dead_letters", "Dead letters waiting to be resubmitted", "gauge", "relay", "backend")
+		up        = newMetricFamily("backend_up", "Whether the backend is up according to the health checks", "gauge", "relay", "backend")
+	)
+
+	now := time.Now()
+	for _, b := range h.backends {
+		if h.healthInterval > 0 {
+			var v float64 = 1
+			if b.health.isDown() {
+				v = 0
+			}
+			up.set(v, h.Name(), b.name)
+		}
+
+		r := b.getRetryBuffer()
+		if r == nil {
+			continue
+		}
+
+		buffering.set(float64(atomic.LoadInt32(&r.buffering)), h.Name(), b.name)
+		size.set(float64(r.list.getSize()), h.Name(), b.name)
+		maxSize.set(float64(r.list.getMaxSize()), h.Name(), b.name)
+		retries.set(float64(atomic.LoadInt64(&r.retries)), h.Name(), b.name)
+
+		var oldest float64
+		if t := atomic.LoadInt64(&r.oldest); t != 0 {
+			oldest = now.Sub(time.Unix(0, t)).Seconds()
+		}
+		age.set(oldest, h.Name(), b.name)
+
+		if r.deadLetters != nil {
+			letters.set(float64(len(r.deadLetters.list())), h.Name(), b.name)
+		}
+	}
+
+	return []*metricFamily{up, buffering, size, maxSize, age, retries, letters}
+}
+
+func (h *HTTP) handleMetrics(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	metrics.write(bw)
+	for _, f := range h.backendMetrics() {
+		f.write(bw)
+	}
+	_ = bw.Flush()
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets the proxied query responses be streamed
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
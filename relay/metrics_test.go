@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestMetricFamilyWrite(t *testing.T) {
+	c := newMetricFamily("test_total", "Test counter", "counter", "relay")
+	c.add(1, `a"b`)
+	c.add(2, `a"b`)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	assert.Equal(t, "# HELP influxdb_relay_test_total Test counter\n# TYPE influxdb_relay_test_total counter\ninfluxdb_relay_test_total{relay=\"a\\\"b\"} 3\n", buf.String())
+
+	hist := newMetricFamily("test_seconds", "Test histogram", "histogram")
+	hist.observe(0.2)
+	hist.observe(20)
+
+	buf.Reset()
+	hist.write(&buf)
+	assert.Contains(t, buf.String(), "influxdb_relay_test_seconds_bucket{le=\"0.1\"} 0\n")
+	assert.Contains(t, buf.String(), "influxdb_relay_test_seconds_bucket{le=\"0.25\"} 1\n")
+	assert.Contains(t, buf.String(), "influxdb_relay_test_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, buf.String(), "influxdb_relay_test_seconds_sum 20.2\n")
+	assert.Contains(t, buf.String(), "influxdb_relay_test_seconds_count 2\n")
+}
+
+func TestHandleMetrics(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, config.HTTPConfig{Name: "metrics"}, false)
+
+	f := &fakePoster{down: 1}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Millisecond}, f)
+	r.initialInterval = time.Millisecond
+	h.backends = append(h.backends, &httpBackend{poster: r, name: "buffered", shard: -1})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&f.down, 0)
+	}()
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1\nmem value=2"))
+	req, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&report=true", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.metricsMiddleware((*HTTP).handleStandard)(h, w, req, time.Now())
+
+	resetWriter()
+	req, _ = http.NewRequest(http.MethodGet, ValidServer.URL+"/metrics", nil)
+	h.handleMetrics(w, req, ti)
+	assert.Equal(t, http.StatusOK, w.code)
+
+	for _, line := range []string{
+		`influxdb_relay_http_requests_total{relay="metrics",path="/write",code="200"} 1`,
+		`influxdb_relay_points_received_total{relay="metrics"} 2`,
+		`influxdb_relay_points_forwarded_total{relay="metrics",backend="buffered"} 2`,
+		`influxdb_relay_backend_responses_total{relay="metrics",backend="buffered",code="204"} 1`,
+		`influxdb_relay_buffer_max_size_bytes{relay="metrics",backend="buffered"} 1.048576e+06`,
+	} {
+		assert.True(t, strings.Contains(w.writeBuf.String(), line+"\n"), line)
+	}
+	assert.Regexp(t, `influxdb_relay_retry_attempts_total\{relay="metrics",backend="buffered"\} [1-9]`, w.writeBuf.String())
+}
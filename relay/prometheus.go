@@ -0,0 +1,344 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/prometheus/remote"
+)
+
+const (
+	// promNameLabel is the label holding the name of a Prometheus metric,
+	// it becomes the measurement of the converted points
+	promNameLabel = "__name__"
+
+	// promFieldName is the field the values of the samples are written to
+	promFieldName = "value"
+)
+
+// promMessage is a Prometheus remote storage message
+type promMessage interface {
+	Unmarshal([]byte) error
+}
+
+// decodeProm decodes a snappy compressed Prometheus remote storage message
+// An empty body is an empty message
+func decodeProm(body []byte, m promMessage) error {
+	if len(body) == 0 {
+		return nil
+	}
+
+	buf, err := snappy.Decode(nil, body)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(buf)
+}
+
+// decodePromWrite decodes a Prometheus remote write request
+func decodePromWrite(body []byte) (*remote.WriteRequest, error) {
+	req := new(remote.WriteRequest)
+	if err := decodeProm(body, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// promToPoints converts the samples of a Prometheus remote write request the
+// way InfluxDB does: the metric name is the measurement, the other labels are
+// the tags and the value is written to the "value" field
+// The samples which cannot be represented (NaN and infinite values, series
+// without a name) are dropped, their number is returned along with the points
+func promToPoints(req *remote.WriteRequest) (models.Points, int, error) {
+	var n int
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+	points := make(models.Points, 0, n)
+
+	dropped := 0
+	for _, ts := range req.Timeseries {
+		var name string
+		tags := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			switch {
+			case l.Name == promNameLabel:
+				name = l.Value
+			case l.Value != "":
+				// Prometheus labels with an empty value do not exist
+				tags[l.Name] = l.Value
+			}
+		}
+
+		if name == "" {
+			dropped += len(ts.Samples)
+			continue
+		}
+
+		for _, s := range ts.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				dropped++
+				continue
+			}
+
+			t := time.Unix(0, s.TimestampMs*int64(time.Millisecond))
+			p, err := models.NewPoint(name, models.NewTags(tags), models.Fields{promFieldName: s.Value}, t)
+			if err != nil {
+				return nil, dropped, err
+			}
+			points = append(points, p)
+		}
+	}
+
+	return points, dropped, nil
+}
+
+// pointsToProm encodes points converted from a Prometheus remote write
+// request back into a request, for the outputs receiving some of its samples
+func pointsToProm(points models.Points) ([]byte, error) {
+	req := new(remote.WriteRequest)
+	series := make(map[string]*remote.TimeSeries)
+
+	for _, p := range points {
+		ts, ok := series[string(p.Key())]
+		if !ok {
+			ts = &remote.TimeSeries{Labels: []*remote.LabelPair{{Name: promNameLabel, Value: string(p.Name())}}}
+			for _, t := range p.Tags() {
+				ts.Labels = append(ts.Labels, &remote.LabelPair{Name: string(t.Key), Value: string(t.Value)})
+			}
+
+			series[string(p.Key())] = ts
+			req.Timeseries = append(req.Timeseries, ts)
+		}
+
+		fields, err := p.Fields()
+		if err != nil {
+			return nil, err
+		}
+
+		value, _ := fields[promFieldName].(float64)
+		ts.Samples = append(ts.Samples, &remote.Sample{Value: value, TimestampMs: p.UnixNano() / int64(time.Millisecond)})
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// promReadResult is the answer of one backend to a remote read request
+type promReadResult struct {
+	response    *remote.ReadResponse
+	errResponse *responseData
+}
+
+// handlePromRead sends a Prometheus remote read request to every available
+// backend, then merges the time series they returned into a single response
+func (h *HTTP) handlePromRead(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, "unable to read body"})
+		return
+	}
+
+	req := new(remote.ReadRequest)
+	if err := decodeProm(body, req); err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, "unable to decode prometheus read request"})
+		return
+	}
+
+	// The backends which recently failed are only used when all did
+	backends, down := h.queries.available(h.backends, func(b *httpBackend) bool { return b.endpoints.PromRead != "" })
+	if len(backends) == 0 {
+		backends = down
+	}
+
+	if len(backends) == 0 {
+		jsonResponse(w, response{http.StatusServiceUnavailable, "no backend available for prometheus read"})
+		return
+	}
+
+	header := http.Header{}
+	copyHeader(header, r.Header)
+	header.Del("Content-Length")
+	header.Del("Accept-Encoding")
+
+	results := make([]promReadResult, len(backends))
+
+	var wg sync.WaitGroup
+	wg.Add(len(backends))
+	for i, b := range backends {
+		go func(res *promReadResult, b *httpBackend) {
+			defer wg.Done()
+			res.response, res.errResponse = h.promRead(b, r.URL.RawQuery, header, body)
+		}(&results[i], b)
+	}
+	wg.Wait()
+
+	var names []string
+	var responses []*remote.ReadResponse
+	var errResponse *responseData
+	for i, res := range results {
+		if res.response == nil {
+			if res.errResponse != nil {
+				errResponse = res.errResponse
+			}
+			continue
+		}
+
+		names = append(names, backends[i].name)
+		responses = append(responses, res.response)
+	}
+
+	if len(responses) == 0 {
+		if errResponse != nil {
+			errResponse.Write(w)
+			return
+		}
+		jsonResponse(w, response{http.StatusServiceUnavailable, "unable to forward prometheus read"})
+		return
+	}
+
+	data, err := mergeReadResponses(len(req.Queries), responses).Marshal()
+	if err != nil {
+		jsonResponse(w, response{http.StatusInternalServerError, "unable to encode prometheus read response"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Header().Set(HeaderBackend, strings.Join(names, ","))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(snappy.Encode(nil, data))
+}
+
+// promRead sends a remote read request to a backend, and decodes its answer
+// An error answer of the backend is returned when it could not be decoded
+func (h *HTTP) promRead(b *httpBackend, query string, header http.Header, body []byte) (*remote.ReadResponse, *responseData) {
+	req, err := http.NewRequest(http.MethodPost, b.location+b.endpoints.PromRead, bytes.NewReader(body))
+	if err != nil {
+		h.logger.Error("unable to prepare prometheus read request", "backend", b.name, "error", err)
+		return nil, nil
+	}
+
+	req.URL.RawQuery = query
+	copyHeader(req.Header, header)
+	b.authorize(req)
+
+	start := time.Now()
+	resp, err := b.querier.Do(req)
+	if err != nil {
+		h.logger.Error("unable to read from backend", "backend", b.name, "error", err)
+		b.queryState.failure(time.Now())
+		return nil, nil
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.logger.Error("unable to read from backend", "backend", b.name, "error", err)
+		b.queryState.failure(time.Now())
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode/100 == 5 {
+			h.logger.Warn("5xx response", "backend", b.name, "status", resp.StatusCode)
+			b.queryState.failure(time.Now())
+		}
+
+		return nil, &responseData{
+			ContentType:     resp.Header.Get("Content-Type"),
+			ContentEncoding: resp.Header.Get("Content-Encoding"),
+			StatusCode:      resp.StatusCode,
+			Body:            data,
+		}
+	}
+
+	res := new(remote.ReadResponse)
+	if err := decodeProm(data, res); err != nil {
+		h.logger.Error("unable to decode prometheus read response", "backend", b.name, "error", err)
+		b.queryState.failure(time.Now())
+		return nil, nil
+	}
+
+	b.queryState.success(time.Since(start))
+	return res, nil
+}
+
+// seriesKey identifies a time series by its labels
+func seriesKey(labels []*remote.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+"\xff"+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// mergeReadResponses merges the results of the backends for each of the
+// n queries: the time series with the same labels are merged, and a single
+// sample is kept for each timestamp, from the first backend which has it
+func mergeReadResponses(n int, responses []*remote.ReadResponse) *remote.ReadResponse {
+	merged := &remote.ReadResponse{Results: make([]*remote.QueryResult, n)}
+
+	for i := range merged.Results {
+		series := make(map[string]*remote.TimeSeries)
+		for _, res := range responses {
+			if i >= len(res.Results) {
+				continue
+			}
+
+			for _, ts := range res.Results[i].Timeseries {
+				key := seriesKey(ts.Labels)
+				if s, ok := series[key]; ok {
+					s.Samples = append(s.Samples, ts.Samples...)
+					continue
+				}
+				series[key] = &remote.TimeSeries{Labels: ts.Labels, Samples: append([]*remote.Sample(nil), ts.Samples...)}
+			}
+		}
+
+		keys := make([]string, 0, len(series))
+		for k := range series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		result := &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0, len(keys))}
+		for _, k := range keys {
+			s := series[k]
+
+			// The stable sort keeps the samples of the first backends first
+			sort.SliceStable(s.Samples, func(i, j int) bool { return s.Samples[i].TimestampMs < s.Samples[j].TimestampMs })
+			samples := s.Samples[:0]
+			for _, sample := range s.Samples {
+				if len(samples) > 0 && samples[len(samples)-1].TimestampMs == sample.TimestampMs {
+					continue
+				}
+				samples = append(samples, sample)
+			}
+			s.Samples = samples
+
+			result.Timeseries = append(result.Timeseries, s)
+		}
+		merged.Results[i] = result
+	}
+
+	return merged
+}
@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb/prometheus/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+var promRequest = &remote.WriteRequest{
+	Timeseries: []*remote.TimeSeries{
+		{
+			Labels: []*remote.LabelPair{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "job", Value: "api"},
+				{Name: "instance", Value: ""},
+			},
+			Samples: []*remote.Sample{
+				{Value: 12, TimestampMs: 1000},
+				{Value: math.NaN(), TimestampMs: 2000},
+				{Value: 13.5, TimestampMs: 3000},
+			},
+		},
+		{
+			Labels:  []*remote.LabelPair{{Name: "job", Value: "api"}},
+			Samples: []*remote.Sample{{Value: 1, TimestampMs: 1000}},
+		},
+	},
+}
+
+const promLines = "http_requests_total,job=api value=12 1000000000\nhttp_requests_total,job=api value=13.5 3000000000\n"
+
+func encodePromWrite(t *testing.T, req *remote.WriteRequest) []byte {
+	buf, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, buf)
+}
+
+func TestPromToPoints(t *testing.T) {
+	req, err := decodePromWrite(encodePromWrite(t, promRequest))
+	assert.Nil(t, err)
+
+	points, dropped, err := promToPoints(req)
+	assert.Nil(t, err)
+	// The NaN sample and the series without a name are dropped
+	assert.Equal(t, 2, dropped)
+
+	var lines string
+	for _, p := range points {
+		lines += p.String() + "\n"
+	}
+	assert.Equal(t, promLines, lines)
+}
+
+func TestDecodePromWriteInvalid(t *testing.T) {
+	req, err := decodePromWrite(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(req.Timeseries))
+
+	_, err = decodePromWrite([]byte("cpu value=1"))
+	assert.NotNil(t, err)
+}
+
+func TestHandlePromConvert(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	posters := make(map[string]*fakePoster)
+	for _, name := range []string{"prom", "line", "filtered"} {
+		posters[name] = &fakePoster{}
+	}
+	h.backends = []*httpBackend{
+		{poster: posters["prom"], name: "prom", shard: -1, endpoints: config.HTTPEndpointConfig{PromWrite: "api/v1/prom/write", Write: "write"}},
+		{poster: posters["line"], name: "line", shard: -1, endpoints: config.HTTPEndpointConfig{Write: "write"}},
+		{poster: posters["filtered"], name: "filtered", shard: -1, endpoints: config.HTTPEndpointConfig{Write: "write"},
+			filters: []*config.Filter{{MeasurementRegexp: regexp.MustCompile("^node_")}}},
+	}
+
+	body := encodePromWrite(t, promRequest)
+	promBody.buf = bytes.NewBuffer(body)
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v1/prom/write?db=test&report=true", promBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleProm(w, r, ti)
+	assert.Equal(t, http.StatusOK, w.code)
+
+	// The Prometheus output receives the request as is, the others the converted points
+	assert.Equal(t, []string{string(body)}, posters["prom"].writes)
+	assert.Equal(t, []string{promLines}, posters["line"].writes)
+	assert.Equal(t, 0, len(posters["filtered"].writes))
+}
+
+func TestHandlePromInvalid(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	promBody.buf = bytes.NewBuffer([]byte("cpu value=1"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v1/prom/write", promBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(func() {
+		h.handleProm(w, r, ti)
+	})
+	assert.Equal(t, http.StatusBadRequest, w.code)
+}
+
+func readSeries(name string, samples ...int64) *remote.TimeSeries {
+	ts := &remote.TimeSeries{Labels: []*remote.LabelPair{{Name: "__name__", Value: name}}}
+	for _, s := range samples {
+		ts.Samples = append(ts.Samples, &remote.Sample{Value: float64(s), TimestampMs: s})
+	}
+	return ts
+}
+
+func TestMergeReadResponses(t *testing.T) {
+	a := &remote.ReadResponse{Results: []*remote.QueryResult{{Timeseries: []*remote.TimeSeries{readSeries("up", 1, 2), readSeries("mem", 1)}}}}
+	b := &remote.ReadResponse{Results: []*remote.QueryResult{{Timeseries: []*remote.TimeSeries{readSeries("up", 2, 3)}}}}
+
+	merged := mergeReadResponses(1, []*remote.ReadResponse{a, b})
+	expected := &remote.ReadResponse{Results: []*remote.QueryResult{{Timeseries: []*remote.TimeSeries{readSeries("mem", 1), readSeries("up", 1, 2, 3)}}}}
+	assert.Equal(t, expected, merged)
+}
+
+func promReadServer(t *testing.T, res *remote.ReadResponse) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(remote.ReadRequest)
+		if err := decodeProm(body, req); err != nil || len(req.Queries) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		data, err := res.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(snappy.Encode(nil, data))
+	}))
+}
+
+func readBackend(t *testing.T, name string, location string) *httpBackend {
+	cfg := config.HTTPOutputConfig{Name: name, Location: location, Endpoints: config.HTTPEndpointConfig{PromRead: "/read"}}
+	b, err := newHTTPBackend(&cfg, config.Filters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHandlePromRead(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	s1 := promReadServer(t, &remote.ReadResponse{Results: []*remote.QueryResult{{Timeseries: []*remote.TimeSeries{readSeries("up", 1, 2)}}}})
+	defer s1.Close()
+	s2 := promReadServer(t, &remote.ReadResponse{Results: []*remote.QueryResult{{Timeseries: []*remote.TimeSeries{readSeries("up", 2, 3)}}}})
+	defer s2.Close()
+
+	h.backends = []*httpBackend{
+		readBackend(t, "s1", s1.URL),
+		readBackend(t, "s2", s2.URL),
+		readBackend(t, "failing", Error500.URL),
+		queryBackend(t, "query-only", ValidServer.URL, 0),
+	}
+
+	buf, err := (&remote.ReadRequest{Queries: []*remote.Query{{StartTimestampMs: 0, EndTimestampMs: 10}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyBody.buf = bytes.NewBuffer(snappy.Encode(nil, buf))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v1/prom/read", emptyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(func() {
+		h.handlePromRead(w, r, ti)
+	})
+
+	// The failing backend is ignored, the others are merged
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, "s1,s2", w.header.Get(HeaderBackend))
+
+	res := new(remote.ReadResponse)
+	assert.Nil(t, decodeProm(w.writeBuf.Bytes(), res))
+	assert.Equal(t, []*remote.TimeSeries{readSeries("up", 1, 2, 3)}, res.Results[0].Timeseries)
+}
+
+func TestHandlePromReadNoBackend(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+	h.backends = []*httpBackend{queryBackend(t, "query-only", ValidServer.URL, 0)}
+
+	emptyBody.buf = new(bytes.Buffer)
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v1/prom/read", emptyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handlePromRead(w, r, ti)
+	assert.Equal(t, http.StatusServiceUnavailable, w.code)
+}
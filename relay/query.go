@@ -0,0 +1,330 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Query balancing modes
+const (
+	QueryRoundRobin   = "round-robin"
+	QueryLeastLatency = "least-latency"
+	QueryPriority     = "priority"
+)
+
+// Default delay during which a backend which failed a query is tried last
+const DefaultQueryRetryInterval = 10 * time.Second
+
+// HeaderBackend names the backend which answered a query
+const HeaderBackend = "X-Relay-Backend"
+
+// Headers which must not be forwarded by a proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// queryBalancer orders the backends a query is sent to
+type queryBalancer struct {
+	mode            string
+	excludeBuffered bool
+	retryInterval   time.Duration
+
+	next uint32
+}
+
+func newQueryBalancer(mode string, excludeBuffered bool, retryInterval string) (*queryBalancer, error) {
+	q := &queryBalancer{
+		mode:            mode,
+		excludeBuffered: excludeBuffered,
+		retryInterval:   DefaultQueryRetryInterval,
+	}
+
+	switch mode {
+	case "":
+		q.mode = QueryRoundRobin
+	case QueryRoundRobin, QueryLeastLatency, QueryPriority:
+	default:
+		return nil, fmt.Errorf("invalid query balancing %q", mode)
+	}
+
+	if retryInterval != "" {
+		d, err := time.ParseDuration(retryInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing query retry interval %v", err)
+		}
+		q.retryInterval = d
+	}
+
+	return q, nil
+}
+
+// queryState tracks how a backend answers queries
+type queryState struct {
+	// Moving average of the query latency in ns, 0 until the first query
+	latency int64
+
+	// Time of the last failed query in ns, 0 when the last one succeeded
+	failed int64
+}
+
+func (s *queryState) success(d time.Duration) {
+	atomic.StoreInt64(&s.failed, 0)
+
+	// Approximate under concurrency, which is fine for ordering backends
+	old := atomic.LoadInt64(&s.latency)
+	if old == 0 {
+		atomic.StoreInt64(&s.latency, int64(d))
+		return
+	}
+	atomic.StoreInt64(&s.latency, (4*old+int64(d))/5)
+}
+
+func (s *queryState) failure(now time.Time) {
+	atomic.StoreInt64(&s.failed, now.UnixNano())
+}
+
+func (s *queryState) down(now time.Time, retryInterval time.Duration) bool {
+	failed := atomic.LoadInt64(&s.failed)
+	return failed != 0 && now.UnixNano()-failed < int64(retryInterval)
+}
+
+// available splits the backends serving a kind of query between the ones
+// which are up and the ones which recently failed a query
+func (q *queryBalancer) available(backends []*httpBackend, serves func(*httpBackend) bool) (up, down []*httpBackend) {
+	now := time.Now()
+
+	for _, b := range backends {
+		// Disabled and draining backends are out of the rotation
+		if !serves(b) || !b.serves() {
+			continue
+		}
+
+		// A backend with buffered writes is known to miss some points
+		if q.excludeBuffered && b.behind() {
+			continue
+		}
+
+		if b.queryState.down(now, q.retryInterval) || b.health.isDown() {
+			down = append(down, b)
+		} else {
+			up = append(up, b)
+		}
+	}
+
+	return up, down
+}
+
+// order returns the backends to try for a query, best first: the backends
+// which recently failed a query are tried after the others
+func (q *queryBalancer) order(backends []*httpBackend) []*httpBackend {
+	up, down := q.available(backends, func(b *httpBackend) bool { return b.endpoints.Query != "" })
+
+	if len(up) > 1 {
+		// Rotate the backends, so that backends sharing
+		// the same priority or latency share the load
+		i := int(atomic.AddUint32(&q.next, 1) % uint32(len(up)))
+		up = append(append(make([]*httpBackend, 0, len(backends)), up[i:]...), up[:i]...)
+
+		switch q.mode {
+		case QueryLeastLatency:
+			sort.SliceStable(up, func(i, j int) bool {
+				return atomic.LoadInt64(&up[i].queryState.latency) < atomic.LoadInt64(&up[j].queryState.latency)
+			})
+		case QueryPriority:
+			sort.SliceStable(up, func(i, j int) bool { return up[i].priority < up[j].priority })
+		}
+	}
+
+	return append(up, down...)
+}
+
+// copyHeader copies the end-to-end headers
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+
+	for _, k := range hopHeaders {
+		dst.Del(k)
+	}
+}
+
+// forwardQuery sends a query to the first backend answering it without a 5xx,
+// failing over to the next ones. When none did, the last 5xx is returned, if any
+func (h *HTTP) forwardQuery(method string, header http.Header, query string, body []byte, backends []*httpBackend) (*http.Response, *httpBackend, *responseData) {
+	var errResponse *responseData
+	for _, b := range backends {
+		req, err := http.NewRequest(method, b.location+b.endpoints.Query, bytes.NewReader(body))
+		if err != nil {
+			h.logger.Error("unable to prepare query", "backend", b.name, "error", err)
+			continue
+		}
+
+		req.URL.RawQuery = query
+		copyHeader(req.Header, header)
+		b.authorize(req)
+
+		// The body was already decompressed by the body middleware
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Length")
+
+		start := time.Now()
+		resp, err := b.querier.Do(req)
+		if err != nil {
+			h.logger.Error("unable to query backend", "backend", b.name, "error", err)
+			b.queryState.failure(time.Now())
+			continue
+		}
+
+		if resp.StatusCode/100 != 5 {
+			b.queryState.success(time.Since(start))
+			return resp, b, nil
+		}
+
+		h.logger.Warn("5xx response", "backend", b.name, "status", resp.StatusCode)
+		b.queryState.failure(time.Now())
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		errResponse = &responseData{
+			ContentType:     resp.Header.Get("Content-Type"),
+			ContentEncoding: resp.Header.Get("Content-Encoding"),
+			StatusCode:      resp.StatusCode,
+			Body:            data,
+		}
+	}
+
+	return nil, nil, errResponse
+}
+
+// shardResponse is the answer of one shard to a query
+type shardResponse struct {
+	backend     string
+	result      *queryResponse
+	errResponse *responseData
+}
+
+// handleShardedQuery sends a query to one backend of each shard holding
+// the points it reads, then merges their results into a single response
+func (h *HTTP) handleShardedQuery(w http.ResponseWriter, r *http.Request, body []byte) {
+	queryParams := r.URL.Query()
+
+	q := queryParams.Get("q")
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("q") != "" {
+			q = form.Get("q")
+		}
+	}
+
+	statements, err := parseStatements(q)
+	if err != nil {
+		jsonResponse(w, response{http.StatusBadRequest, queryResponse{Err: err.Error()}})
+		return
+	}
+
+	// Results are merged as a single JSON object
+	queryParams.Del("chunked")
+	queryParams.Del("chunk_size")
+	queryParams.Del("pretty")
+	query := queryParams.Encode()
+
+	header := http.Header{}
+	copyHeader(header, r.Header)
+	header.Del("Accept")
+	header.Del("Accept-Encoding")
+
+	shards := h.shards.relevant(statements)
+	responses := make([]shardResponse, len(shards))
+
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i, shard := range shards {
+		go func(res *shardResponse, shard int) {
+			defer wg.Done()
+			res.errResponse = &responseData{StatusCode: http.StatusServiceUnavailable}
+
+			var backends []*httpBackend
+			for _, b := range h.backends {
+				if b.shard == shard {
+					backends = append(backends, b)
+				}
+			}
+
+			resp, b, errResponse := h.forwardQuery(r.Method, header, query, body, h.queries.order(backends))
+			if resp == nil {
+				if errResponse != nil {
+					res.errResponse = errResponse
+				}
+				return
+			}
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				h.logger.Error("unable to query backend", "backend", b.name, "error", err)
+				return
+			}
+
+			// User error, returned as is to the client
+			if resp.StatusCode != http.StatusOK {
+				res.errResponse = &responseData{
+					ContentType:     resp.Header.Get("Content-Type"),
+					ContentEncoding: resp.Header.Get("Content-Encoding"),
+					StatusCode:      resp.StatusCode,
+					Body:            data,
+				}
+				return
+			}
+
+			result := new(queryResponse)
+			d := json.NewDecoder(bytes.NewReader(data))
+			d.UseNumber()
+			if err = d.Decode(result); err != nil {
+				h.logger.Error("unable to decode query results", "backend", b.name, "error", err)
+				return
+			}
+
+			res.backend, res.result, res.errResponse = b.name, result, nil
+		}(&responses[i], shard)
+	}
+	wg.Wait()
+
+	var names []string
+	var results []*queryResponse
+	for i, res := range responses {
+		if res.errResponse != nil {
+			// A missing shard would silently give wrong results
+			if len(res.errResponse.Body) == 0 {
+				jsonResponse(w, response{res.errResponse.StatusCode, queryResponse{Err: "unable to query shard " + h.shards.names[shards[i]]}})
+				return
+			}
+
+			res.errResponse.Write(w)
+			return
+		}
+
+		names = append(names, res.backend)
+		results = append(results, res.result)
+	}
+
+	w.Header().Set(HeaderBackend, strings.Join(names, ","))
+	jsonResponse(w, response{http.StatusOK, mergeResults(statements, results)})
+}
@@ -0,0 +1,555 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How the results of a statement run on several shards are merged
+type mergeMode int
+
+const (
+	// SHOW statements: union of the rows
+	mergeUnion mergeMode = iota
+
+	// Raw SELECT statements: rows ordered by time
+	mergeConcat
+
+	// SELECT statements only made of sum, count, min or max
+	mergeAggregate
+)
+
+// Keywords which may follow the FROM clause of a statement
+var clauseKeywords = []string{"WHERE", "GROUP", "ORDER", "LIMIT", "OFFSET", "SLIMIT", "SOFFSET", "FILL", "TZ"}
+
+var (
+	funcRegexp   = regexp.MustCompile(`^(?i)([a-z_][a-z0-9_]*)\s*\(`)
+	byTimeRegexp = regexp.MustCompile(`(?i)\btime\s*\(`)
+)
+
+// statement describes how to merge the results of a statement
+type statement struct {
+	text string
+	mode mergeMode
+
+	// aggregate of each field of an aggregate statement
+	funcs []string
+
+	// grouped by time intervals
+	byTime bool
+
+	desc bool
+
+	// LIMIT and SLIMIT, applied again to the merged rows and series
+	limit  int
+	slimit int
+}
+
+// parseStatements splits a query into its statements, failing
+// if the results of one of them cannot be merged
+func parseStatements(q string) ([]*statement, error) {
+	var statements []*statement
+	for _, text := range splitTopLevel(q, ';') {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		st, err := parseStatement(text)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, st)
+	}
+
+	if len(statements) == 0 {
+		return nil, errors.New("missing required parameter \"q\"")
+	}
+	return statements, nil
+}
+
+func parseStatement(text string) (*statement, error) {
+	st := &statement{text: text}
+
+	switch strings.ToUpper(strings.Fields(text)[0]) {
+	case "SHOW":
+		st.mode = mergeUnion
+	case "SELECT":
+		if err := st.parseSelect(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("only SELECT and SHOW statements can be run on a sharded relay")
+	}
+
+	if l := strings.Fields(clause(text, "LIMIT")); len(l) > 0 {
+		st.limit, _ = strconv.Atoi(l[0])
+	}
+	if l := strings.Fields(clause(text, "SLIMIT")); len(l) > 0 {
+		st.slimit, _ = strconv.Atoi(l[0])
+	}
+
+	return st, nil
+}
+
+func (st *statement) parseSelect() error {
+	if findKeyword(st.text, "INTO") >= 0 {
+		return errors.New("SELECT INTO statements cannot be run on a sharded relay")
+	}
+
+	if findKeyword(st.text, "OFFSET") >= 0 || findKeyword(st.text, "SOFFSET") >= 0 {
+		return errors.New("OFFSET cannot be applied across shards")
+	}
+
+	from := findKeyword(st.text, "FROM")
+	if from < 0 {
+		from = len(st.text)
+	}
+
+	raw := 0
+	for _, f := range splitTopLevel(st.text[len("SELECT"):from], ',') {
+		fn, err := aggregateFunc(f)
+		switch {
+		case err != nil:
+			return err
+		case fn == "":
+			raw++
+		default:
+			st.funcs = append(st.funcs, fn)
+		}
+	}
+
+	switch {
+	case len(st.funcs) == 0:
+		st.mode = mergeConcat
+	case raw == 0:
+		st.mode = mergeAggregate
+	default:
+		return errors.New("aggregates mixed with fields cannot be merged across shards")
+	}
+
+	st.byTime = byTimeRegexp.MatchString(clause(st.text, "GROUP"))
+	for _, w := range strings.Fields(clause(st.text, "ORDER")) {
+		if strings.EqualFold(w, "DESC") {
+			st.desc = true
+		}
+	}
+
+	return nil
+}
+
+// aggregateFunc returns the function a field is made of, if any
+func aggregateFunc(field string) (string, error) {
+	field = strings.TrimSpace(field)
+	if i := findKeyword(field, "AS"); i > 0 {
+		field = strings.TrimSpace(field[:i])
+	}
+
+	m := funcRegexp.FindStringSubmatch(field)
+	if m == nil {
+		return "", nil
+	}
+
+	fn := strings.ToLower(m[1])
+
+	// The call must be the whole field, without nested calls
+	complex := strings.Contains(field[len(m[0]):], "(")
+	scanQuery(field, func(i int) bool {
+		complex = complex || i >= len(m[0])
+		return !complex
+	})
+	if complex {
+		return "", fmt.Errorf("expressions using %s() cannot be merged across shards", fn)
+	}
+
+	switch fn {
+	case "sum", "count", "min", "max":
+		return fn, nil
+	}
+	return "", fmt.Errorf("%s() cannot be merged across shards", fn)
+}
+
+// scanQuery calls fn with the index of each byte of the query found outside
+// of quoted strings, identifiers and parentheses, until fn returns false
+func scanQuery(q string, fn func(i int) bool) {
+	var quote byte
+	depth := 0
+
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0:
+			if !fn(i) {
+				return
+			}
+		}
+	}
+}
+
+// splitTopLevel splits a query on the separators which are not quoted
+func splitTopLevel(q string, sep byte) []string {
+	var parts []string
+	last := 0
+	scanQuery(q, func(i int) bool {
+		if q[i] == sep {
+			parts = append(parts, q[last:i])
+			last = i + 1
+		}
+		return true
+	})
+	return append(parts, q[last:])
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// findKeyword returns the index of the first unquoted keyword, or -1
+func findKeyword(q string, kw string) int {
+	pos := -1
+	scanQuery(q, func(i int) bool {
+		end := i + len(kw)
+		if end <= len(q) && strings.EqualFold(q[i:end], kw) &&
+			(i == 0 || !isIdentChar(q[i-1])) && (end == len(q) || !isIdentChar(q[end])) {
+			pos = i
+			return false
+		}
+		return true
+	})
+	return pos
+}
+
+// clause returns the text following a keyword up to the next clause
+func clause(q string, kw string) string {
+	start := findKeyword(q, kw)
+	if start < 0 {
+		return ""
+	}
+
+	rest := q[start+len(kw):]
+	end := len(rest)
+	for _, k := range clauseKeywords {
+		if i := findKeyword(rest, k); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return strings.TrimSpace(rest[:end])
+}
+
+// measurementName returns the measurement of a FROM clause
+// selecting a single measurement, without any regular expression
+func measurementName(from string) (string, bool) {
+	if from == "" || strings.ContainsAny(from, "(/") || len(splitTopLevel(from, ',')) > 1 {
+		return "", false
+	}
+
+	parts := splitTopLevel(from, '.')
+	name := strings.TrimSpace(parts[len(parts)-1])
+	if len(name) > 1 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = strings.Replace(name[1:len(name)-1], `\"`, `"`, -1)
+	}
+	return name, name != ""
+}
+
+type queryResponse struct {
+	Results []*queryResult `json:"results,omitempty"`
+	Err     string         `json:"error,omitempty"`
+}
+
+type queryResult struct {
+	StatementID int               `json:"statement_id"`
+	Series      []*querySeries    `json:"series,omitempty"`
+	Messages    []json.RawMessage `json:"messages,omitempty"`
+	Partial     bool              `json:"partial,omitempty"`
+	Err         string            `json:"error,omitempty"`
+}
+
+type querySeries struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns,omitempty"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+	Partial bool              `json:"partial,omitempty"`
+}
+
+// key identifies a series across the responses, series are sorted on it
+func (s *querySeries) key() string {
+	tags := make([]string, 0, len(s.Tags))
+	for k, v := range s.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return s.Name + "\x00" + strings.Join(tags, ",")
+}
+
+// mergeResults merges the responses of the shards into a single response
+func mergeResults(statements []*statement, responses []*queryResponse) *queryResponse {
+	merged := &queryResponse{}
+	for _, resp := range responses {
+		if resp.Err != "" {
+			return &queryResponse{Err: resp.Err}
+		}
+	}
+
+	for i, st := range statements {
+		res := &queryResult{StatementID: i}
+		series := make(map[string]*querySeries)
+		var keys []string
+
+		for _, resp := range responses {
+			for _, r := range resp.Results {
+				if r.StatementID != i {
+					continue
+				}
+
+				if r.Err != "" && res.Err == "" {
+					res.Err = r.Err
+				}
+				res.Partial = res.Partial || r.Partial
+				res.Messages = appendMessages(res.Messages, r.Messages)
+
+				for _, s := range r.Series {
+					k := s.key()
+					cur, ok := series[k]
+					if !ok {
+						series[k] = s
+						keys = append(keys, k)
+						continue
+					}
+
+					cur.Partial = cur.Partial || s.Partial
+					if err := st.merge(cur, s); err != nil && res.Err == "" {
+						res.Err = err.Error()
+					}
+				}
+			}
+		}
+
+		if res.Err == "" {
+			// The first series of every shard include the first ones overall
+			sort.Strings(keys)
+			if st.slimit > 0 && len(keys) > st.slimit {
+				keys = keys[:st.slimit]
+			}
+			for _, k := range keys {
+				s := series[k]
+				st.finish(s)
+				res.Series = append(res.Series, s)
+			}
+		}
+
+		merged.Results = append(merged.Results, res)
+	}
+
+	return merged
+}
+
+func appendMessages(messages []json.RawMessage, others []json.RawMessage) []json.RawMessage {
+	for _, m := range others {
+		found := false
+		for _, o := range messages {
+			found = found || string(o) == string(m)
+		}
+
+		if !found {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// merge adds the rows of a series to the same series of another shard
+func (st *statement) merge(dst *querySeries, src *querySeries) error {
+	values := alignColumns(dst, src)
+	if st.mode != mergeAggregate {
+		dst.Values = append(dst.Values, values...)
+		return nil
+	}
+
+	if len(dst.Columns) != len(st.funcs)+1 || dst.Columns[0] != "time" {
+		return errors.New("unable to merge the aggregates across shards")
+	}
+
+	// Without time intervals, each shard returns a single row
+	rowKey := func(row []interface{}) string {
+		if st.byTime {
+			return fmt.Sprint(row[0])
+		}
+		return ""
+	}
+
+	// A single selector keeps the time of the selected point
+	selectsTime := !st.byTime && len(st.funcs) == 1 && st.funcs[0] != "sum" && st.funcs[0] != "count"
+
+	rows := make(map[string][]interface{}, len(dst.Values))
+	for _, row := range dst.Values {
+		rows[rowKey(row)] = row
+	}
+
+	for _, row := range values {
+		k := rowKey(row)
+		cur, ok := rows[k]
+		if !ok {
+			rows[k] = row
+			dst.Values = append(dst.Values, row)
+			continue
+		}
+
+		for i, fn := range st.funcs {
+			v, won := combine(fn, cur[i+1], row[i+1])
+			cur[i+1] = v
+			if won && selectsTime {
+				cur[0] = row[0]
+			}
+		}
+	}
+
+	return nil
+}
+
+// alignColumns returns the rows of src laid out as the columns of dst,
+// adding the columns missing from dst, as SELECT * may return different
+// columns depending on the shard
+func alignColumns(dst *querySeries, src *querySeries) [][]interface{} {
+	idx := make([]int, len(src.Columns))
+	same := len(src.Columns) == len(dst.Columns)
+
+	for i, c := range src.Columns {
+		idx[i] = -1
+		for j, d := range dst.Columns {
+			if d == c {
+				idx[i] = j
+				break
+			}
+		}
+
+		if idx[i] == -1 {
+			dst.Columns = append(dst.Columns, c)
+			idx[i] = len(dst.Columns) - 1
+		}
+		same = same && idx[i] == i
+	}
+
+	if same {
+		return src.Values
+	}
+
+	for k, row := range dst.Values {
+		for len(row) < len(dst.Columns) {
+			row = append(row, nil)
+		}
+		dst.Values[k] = row
+	}
+
+	values := make([][]interface{}, len(src.Values))
+	for k, row := range src.Values {
+		v := make([]interface{}, len(dst.Columns))
+		for i, x := range row {
+			if i < len(idx) {
+				v[idx[i]] = x
+			}
+		}
+		values[k] = v
+	}
+	return values
+}
+
+// combine aggregates the values of two shards, telling if the second one was selected
+func combine(fn string, a interface{}, b interface{}) (interface{}, bool) {
+	if b == nil {
+		return a, false
+	}
+	if a == nil {
+		return b, true
+	}
+
+	x, okx := a.(json.Number)
+	y, oky := b.(json.Number)
+	if !okx || !oky {
+		return a, false
+	}
+
+	if fn == "sum" || fn == "count" {
+		i, errx := x.Int64()
+		j, erry := y.Int64()
+		if errx == nil && erry == nil {
+			return json.Number(strconv.FormatInt(i+j, 10)), false
+		}
+	}
+
+	f, _ := x.Float64()
+	g, _ := y.Float64()
+	switch fn {
+	case "sum", "count":
+		return json.Number(strconv.FormatFloat(f+g, 'f', -1, 64)), false
+	case "min":
+		if g < f {
+			return b, true
+		}
+	case "max":
+		if g > f {
+			return b, true
+		}
+	}
+	return a, false
+}
+
+// timeValue returns the timestamp of an epoch or RFC3339 time
+func timeValue(v interface{}) int64 {
+	switch t := v.(type) {
+	case json.Number:
+		i, _ := t.Int64()
+		return i
+	case string:
+		tm, _ := time.Parse(time.RFC3339Nano, t)
+		return tm.UnixNano()
+	}
+	return 0
+}
+
+// finish orders the rows of a merged series and applies the limit again
+func (st *statement) finish(s *querySeries) {
+	if st.mode == mergeUnion {
+		rows := make(map[string]bool, len(s.Values))
+		values := s.Values[:0]
+		for _, row := range s.Values {
+			k := fmt.Sprint(row)
+			if !rows[k] {
+				rows[k] = true
+				values = append(values, row)
+			}
+		}
+
+		sort.SliceStable(values, func(i, j int) bool { return fmt.Sprint(values[i]) < fmt.Sprint(values[j]) })
+		s.Values = values
+	} else if len(s.Columns) > 0 && s.Columns[0] == "time" {
+		sort.SliceStable(s.Values, func(i, j int) bool {
+			if st.desc {
+				return timeValue(s.Values[i][0]) > timeValue(s.Values[j][0])
+			}
+			return timeValue(s.Values[i][0]) < timeValue(s.Values[j][0])
+		})
+	}
+
+	if st.limit > 0 && len(s.Values) > st.limit {
+		s.Values = s.Values[:st.limit]
+	}
+}
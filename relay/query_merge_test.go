@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestParseStatements(t *testing.T) {
+	statements, err := parseStatements(`SELECT sum(value) AS "total", max(value) FROM cpu WHERE host = 'a;b' GROUP BY time(1m) LIMIT 10; SHOW MEASUREMENTS`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(statements))
+	assert.Equal(t, mergeAggregate, statements[0].mode)
+	assert.Equal(t, []string{"sum", "max"}, statements[0].funcs)
+	assert.True(t, statements[0].byTime)
+	assert.Equal(t, 10, statements[0].limit)
+	assert.Equal(t, mergeUnion, statements[1].mode)
+
+	st, err := parseStatement(`SELECT "value", host FROM "db"."rp"."cpu" ORDER BY time DESC`)
+	assert.Nil(t, err)
+	assert.Equal(t, mergeConcat, st.mode)
+	assert.True(t, st.desc)
+
+	for _, q := range []string{
+		"SELECT mean(value) FROM cpu",
+		"SELECT max(value), host FROM cpu",
+		"SELECT sum(value) * 2 FROM cpu",
+		"SELECT * INTO other FROM cpu",
+		"SELECT * FROM cpu LIMIT 1 OFFSET 2",
+		"DROP MEASUREMENT cpu",
+		" ; ",
+	} {
+		_, err := parseStatements(q)
+		assert.NotNil(t, err, q)
+	}
+}
+
+func TestShardRingRoute(t *testing.T) {
+	s, _ := newShardRing("tag:customer_id", testShards)
+	st, _ := parseStatement(`SELECT * FROM cpu WHERE "customer_id" = 'it\'s' AND time > now() - 1h`)
+	assert.Equal(t, s.locate([]byte("it's")), s.route(st))
+	assert.Equal(t, []int{s.route(st)}, s.relevant([]*statement{st}))
+
+	st, _ = parseStatement(`SELECT * FROM cpu WHERE customer_id = 'a' OR customer_id = 'b'`)
+	assert.Equal(t, -1, s.route(st))
+	assert.Equal(t, 3, len(s.relevant([]*statement{st})))
+
+	s, _ = newShardRing("", testShards)
+	st, _ = parseStatement(`SELECT count(value) FROM "db"."rp"."cpu" WHERE host = 'a'`)
+	assert.Equal(t, s.locate([]byte("cpu")), s.route(st))
+
+	st, _ = parseStatement(`SELECT count(value) FROM /cp.*/`)
+	assert.Equal(t, -1, s.route(st))
+}
+
+func decodeResponse(t *testing.T, data string) *queryResponse {
+	r := new(queryResponse)
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func encodeResponse(t *testing.T, r *queryResponse) string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMergeResults(t *testing.T) {
+	statements, _ := parseStatements("SELECT * FROM cpu LIMIT 3; SELECT sum(v), min(v) FROM cpu GROUP BY time(1m); SELECT max(v) FROM cpu; SHOW MEASUREMENTS")
+	a := decodeResponse(t, `{"results":[
+		{"statement_id":0,"series":[{"name":"cpu","columns":["time","v"],"values":[[1,1],[4,4]]}]},
+		{"statement_id":1,"series":[{"name":"cpu","columns":["time","sum","min"],"values":[[0,1,1],[60,2.5,2.5]]}]},
+		{"statement_id":2,"series":[{"name":"cpu","columns":["time","max"],"values":[[10,7]]}]},
+		{"statement_id":3,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["mem"]]}]}]}`)
+	b := decodeResponse(t, `{"results":[
+		{"statement_id":0,"series":[{"name":"cpu","columns":["time","v","w"],"values":[[2,2,0],[3,3,0]]}]},
+		{"statement_id":1,"series":[{"name":"cpu","columns":["time","sum","min"],"values":[[0,2,0],[120,1,1]]}]},
+		{"statement_id":2,"series":[{"name":"cpu","columns":["time","max"],"values":[[20,9]]}]},
+		{"statement_id":3,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"]]}]}]}`)
+
+	assert.Equal(t, `{"results":[`+
+		`{"statement_id":0,"series":[{"name":"cpu","columns":["time","v","w"],"values":[[1,1,null],[2,2,0],[3,3,0]]}]},`+
+		`{"statement_id":1,"series":[{"name":"cpu","columns":["time","sum","min"],"values":[[0,3,0],[60,2.5,2.5],[120,1,1]]}]},`+
+		`{"statement_id":2,"series":[{"name":"cpu","columns":["time","max"],"values":[[20,9]]}]},`+
+		`{"statement_id":3,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"],["mem"]]}]}]}`,
+		encodeResponse(t, mergeResults(statements, []*queryResponse{a, b})))
+
+	b = decodeResponse(t, `{"results":[{"statement_id":0,"error":"database not found: test"}]}`)
+	merged := mergeResults(statements[:1], []*queryResponse{a, b})
+	assert.Equal(t, "database not found: test", merged.Results[0].Err)
+	assert.Nil(t, merged.Results[0].Series)
+}
+
+func TestMergeSelectors(t *testing.T) {
+	// The first shard holds the extreme values
+	statements, _ := parseStatements("SELECT min(v) FROM cpu; SELECT max(v) FROM cpu")
+	a := decodeResponse(t, `{"results":[
+		{"statement_id":0,"series":[{"name":"cpu","columns":["time","min"],"values":[[10,1]]}]},
+		{"statement_id":1,"series":[{"name":"cpu","columns":["time","max"],"values":[[10,9]]}]}]}`)
+	b := decodeResponse(t, `{"results":[
+		{"statement_id":0,"series":[{"name":"cpu","columns":["time","min"],"values":[[20,5]]}]},
+		{"statement_id":1,"series":[{"name":"cpu","columns":["time","max"],"values":[[20,5]]}]}]}`)
+
+	assert.Equal(t, `{"results":[`+
+		`{"statement_id":0,"series":[{"name":"cpu","columns":["time","min"],"values":[[10,1]]}]},`+
+		`{"statement_id":1,"series":[{"name":"cpu","columns":["time","max"],"values":[[10,9]]}]}]}`,
+		encodeResponse(t, mergeResults(statements, []*queryResponse{a, b})))
+}
+
+func TestHandleShardedQuery(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	for _, name := range []string{"a", "b"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			assert.Equal(t, "", req.URL.Query().Get("chunked"))
+			res.Header().Set("Content-Type", "application/json")
+			_, _ = res.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count"],"values":[[0,` + map[string]string{"a": "2", "b": "3"}[name] + `]]}]}]}`))
+		}))
+		defer server.Close()
+
+		b := queryBackend(t, name, server.URL, 0)
+		b.shard = len(h.backends)
+		h.backends = append(h.backends, b)
+	}
+	h.shards, _ = newShardRing(ShardKeySeries, []config.ShardConfig{{Name: "a"}, {Name: "b"}})
+
+	emptyBody.buf = new(bytes.Buffer)
+	r, err := http.NewRequest(http.MethodGet, ValidServer.URL+"/query?chunked=true&q=SELECT+count(value)+FROM+cpu", emptyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleQuery(w, r, ti)
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, "a,b", w.header.Get(HeaderBackend))
+	assert.Equal(t, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","count"],"values":[[0,5]]}]}]}`, w.writeBuf.String())
+}
+
+func TestMergeSeriesLimit(t *testing.T) {
+	// Each shard returns its first two series, only the first two overall are kept
+	statements, _ := parseStatements("SELECT * FROM cpu GROUP BY host LIMIT 1 SLIMIT 2")
+	assert.Equal(t, 1, statements[0].limit)
+	assert.Equal(t, 2, statements[0].slimit)
+
+	a := decodeResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1]]},
+		{"name":"cpu","tags":{"host":"c"},"columns":["time","v"],"values":[[1,3]]}]}]}`)
+	b := decodeResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,2]]},
+		{"name":"cpu","tags":{"host":"d"},"columns":["time","v"],"values":[[1,4]]}]}]}`)
+
+	assert.Equal(t, `{"results":[{"statement_id":0,"series":[`+
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","v"],"values":[[1,1]]},`+
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","v"],"values":[[1,2]]}]}]}`,
+		encodeResponse(t, mergeResults(statements, []*queryResponse{a, b})))
+}
@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func queryBackend(t *testing.T, name string, location string, priority int) *httpBackend {
+	cfg := config.HTTPOutputConfig{
+		Name:          name,
+		Location:      location,
+		Endpoints:     config.HTTPEndpointConfig{Query: "/query"},
+		QueryPriority: priority,
+	}
+
+	b, err := newHTTPBackend(&cfg, config.Filters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func names(backends []*httpBackend) []string {
+	var res []string
+	for _, b := range backends {
+		res = append(res, b.name)
+	}
+	return res
+}
+
+func TestQueryBalancerRoundRobin(t *testing.T) {
+	q, _ := newQueryBalancer("", false, "")
+	backends := []*httpBackend{queryBackend(t, "a", "", 0), queryBackend(t, "b", "", 0), queryBackend(t, "c", "", 0)}
+
+	first := q.order(backends)[0].name
+	second := q.order(backends)[0].name
+	assert.NotEqual(t, first, second)
+
+	// A failed backend is tried last
+	backends[0].queryState.failure(time.Now())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "a", names(q.order(backends))[2])
+	}
+}
+
+func TestQueryBalancerPriority(t *testing.T) {
+	q, _ := newQueryBalancer(QueryPriority, false, "")
+	backends := []*httpBackend{queryBackend(t, "a", "", 2), queryBackend(t, "b", "", 1), queryBackend(t, "c", "", 1)}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "a", names(q.order(backends))[2])
+	}
+}
+
+func TestQueryBalancerLeastLatency(t *testing.T) {
+	q, _ := newQueryBalancer(QueryLeastLatency, false, "")
+	backends := []*httpBackend{queryBackend(t, "a", "", 0), queryBackend(t, "b", "", 0)}
+	backends[0].queryState.success(time.Second)
+	backends[1].queryState.success(time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, []string{"b", "a"}, names(q.order(backends)))
+	}
+}
+
+func TestQueryBalancerExcludeBuffering(t *testing.T) {
+	q, _ := newQueryBalancer("", true, "")
+	b := queryBackend(t, "a", "", 0)
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Second}, &fakePoster{})
+	b.poster = r
+
+	assert.Equal(t, 1, len(q.order([]*httpBackend{b})))
+	r.buffering = 1
+	assert.Equal(t, 0, len(q.order([]*httpBackend{b})))
+}
+
+func TestHandleQueryFailover(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, config.HTTPConfig{QueryBalancing: QueryPriority}, false)
+	h.backends = append(h.backends, queryBackend(t, "down", Error500.URL, 0), queryBackend(t, "up", ValidServer.URL, 1))
+
+	emptyBody.buf = new(bytes.Buffer)
+	r, err := http.NewRequest(http.MethodGet, ValidServer.URL+"/query?q=SHOW+DATABASES", emptyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(func() {
+		h.handleQuery(w, r, ti)
+	})
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, "up", w.header.Get(HeaderBackend))
+	assert.True(t, h.backends[0].queryState.down(time.Now(), DefaultQueryRetryInterval))
+}
+
+func TestHandleQueryNoBackend(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	emptyBody.buf = new(bytes.Buffer)
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/query", emptyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleQuery(w, r, ti)
+	assert.Equal(t, http.StatusServiceUnavailable, w.code)
+}
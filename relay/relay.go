@@ -6,3 +6,28 @@ type Relay interface {
 	Run() error
 	Stop() error
 }
+
+// HandOver is called once next replaced prev, or was discarded in favor
+// of it: the retry buffers of prev which next does not use are closed,
+// and the ones of next write to its outputs. Either relay may be nil
+func HandOver(next, prev Relay) {
+	handOver(httpBackendsOf(next), httpBackendsOf(prev))
+}
+
+// httpBackendsOf returns the backends of a relay written to over HTTP
+func httpBackendsOf(r Relay) []*httpBackend {
+	var backends []*httpBackend
+	switch r := r.(type) {
+	case *HTTP:
+		backends = r.current().backends
+	case *UDP:
+		for _, b := range r.httpBackends {
+			backends = append(backends, b.httpBackend)
+		}
+	case *Graphite:
+		for _, b := range r.backends {
+			backends = append(backends, b.httpBackend)
+		}
+	}
+	return backends
+}
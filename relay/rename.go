@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// nameRule renames a database or a retention policy
+type nameRule struct {
+	from  string
+	regex *regexp.Regexp
+	to    string
+}
+
+// nameMap renames the names matching one of its rules, the first one applying
+type nameMap []nameRule
+
+func newNameMap(rules []config.NameMapping) (nameMap, error) {
+	m := make(nameMap, 0, len(rules))
+	for _, r := range rules {
+		rule := nameRule{from: r.From, to: r.To}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, err
+			}
+			rule.regex = re
+		}
+		m = append(m, rule)
+	}
+	return m, nil
+}
+
+// rename returns the new name of a name, and whether a rule applied
+func (m nameMap) rename(name string) (string, bool) {
+	for _, r := range m {
+		switch {
+		case r.regex != nil:
+			if r.regex.MatchString(name) {
+				return r.regex.ReplaceAllString(name, r.to), true
+			}
+		case r.from == name:
+			return r.to, true
+		}
+	}
+	return name, false
+}
+
+// queryRenamer renames the database and the retention
+// policy of the writes sent to a backend
+type queryRenamer struct {
+	db nameMap
+	rp nameMap
+}
+
+// newQueryRenamer returns the renamer of an output, nil when it has no rules
+func newQueryRenamer(cfg *config.HTTPOutputConfig) (*queryRenamer, error) {
+	if len(cfg.DBMap) == 0 && len(cfg.RPMap) == 0 {
+		return nil, nil
+	}
+
+	for _, r := range cfg.DBMap {
+		if r.To == "" && r.Regex == "" {
+			return nil, fmt.Errorf("database %q renamed to an empty name for %q", r.From, cfg.Name)
+		}
+	}
+
+	db, err := newNameMap(cfg.DBMap)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing db-map of %q: %v", cfg.Name, err)
+	}
+
+	rp, err := newNameMap(cfg.RPMap)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rp-map of %q: %v", cfg.Name, err)
+	}
+
+	return &queryRenamer{db: db, rp: rp}, nil
+}
+
+// apply returns the query string of a write with the database and retention
+// policy renamed, the retention policy being removed when renamed to ""
+func (q *queryRenamer) apply(query string) string {
+	if q == nil {
+		return query
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+
+	changed := false
+	if db, ok := q.db.rename(params.Get("db")); ok && db != "" {
+		params.Set("db", db)
+		changed = true
+	}
+
+	if rp, ok := q.rp.rename(params.Get("rp")); ok {
+		if rp == "" {
+			params.Del("rp")
+		} else {
+			params.Set("rp", rp)
+		}
+		changed = true
+	}
+
+	if !changed {
+		return query
+	}
+	return params.Encode()
+}
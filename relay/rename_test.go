@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func TestQueryRenamer(t *testing.T) {
+	cfg := config.HTTPOutputConfig{
+		Name: "archive",
+		DBMap: []config.NameMapping{
+			{From: "telegraf", To: "telegraf_archive"},
+			{Regex: "^(.*)_prod$", To: "${1}_archive"},
+		},
+		RPMap: []config.NameMapping{
+			{From: "", To: "long"},
+			{From: "short", To: ""},
+		},
+	}
+
+	q, err := newQueryRenamer(&cfg)
+	assert.Nil(t, err)
+
+	for query, expected := range map[string]string{
+		"db=telegraf":                 "db=telegraf_archive&rp=long",
+		"db=app_prod&rp=short":        "db=app_archive",
+		"db=other&rp=autogen":         "db=other&rp=autogen",
+		"db=telegraf&precision=s&u=x": "db=telegraf_archive&precision=s&rp=long&u=x",
+	} {
+		assert.Equal(t, expected, q.apply(query), query)
+	}
+
+	// Outputs without rules send the query strings as is
+	q, err = newQueryRenamer(&config.HTTPOutputConfig{Name: "none"})
+	assert.Nil(t, err)
+	assert.Nil(t, q)
+	assert.Equal(t, "rp=x&db=y", q.apply("rp=x&db=y"))
+
+	_, err = newQueryRenamer(&config.HTTPOutputConfig{DBMap: []config.NameMapping{{From: "telegraf"}}})
+	assert.NotNil(t, err)
+	_, err = newQueryRenamer(&config.HTTPOutputConfig{RPMap: []config.NameMapping{{Regex: "("}}})
+	assert.NotNil(t, err)
+}
+
+func TestHandleStandardRename(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	var mu sync.Mutex
+	queries := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries[r.URL.Path] = r.URL.RawQuery
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, cfg := range []config.HTTPOutputConfig{
+		{Name: "prod", Location: server.URL + "/prod"},
+		{Name: "archive", Location: server.URL + "/archive", DBMap: []config.NameMapping{{From: "telegraf", To: "telegraf_archive"}}},
+	} {
+		cfg := cfg
+		b, err := newHTTPBackend(&cfg, nil)
+		assert.Nil(t, err)
+		h.backends = append(h.backends, b)
+	}
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu value=1 1\n"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=telegraf&consistency=all", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleStandard(w, r, ti)
+	assert.Equal(t, http.StatusNoContent, w.code)
+	assert.Equal(t, "db=telegraf", queries["/prod"])
+	assert.Equal(t, "db=telegraf_archive", queries["/archive"])
+}
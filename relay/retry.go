@@ -2,10 +2,13 @@ package relay
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/veepee-moc/influxdb-relay/logging"
 )
 
 const (
@@ -13,6 +16,8 @@ const (
 	retryMultiplier = 2
 )
 
+var errBufferClosed = errors.New("retry buffer closed")
+
 // Operation -TODO-
 type Operation func() error
 
@@ -21,53 +26,174 @@ type Operation func() error
 // until success or timeout of the previous operation.
 // There is no delay between attempts of different operations.
 type retryBuffer struct {
+	// Number of failed attempts to send buffered writes, and
+	// creation time (ns) of the batch being retried, for the metrics
+	retries int64
+	oldest  int64
+
 	buffering int32
 	flushing  int32
 
+	// 1 while the buffered writes are not replayed, the new
+	// writes are then buffered without being tried first
+	paused int32
+
+	// 1 when no client waits for the replies of the writes, which
+	// are then answered as soon as they are buffered
+	detached int32
+
+	// The lock makes the switch back to direct posting atomic in strict mode
+	mu sync.RWMutex
+
 	initialInterval time.Duration
 	multiplier      time.Duration
-	maxInterval     time.Duration
+
+	retryPolicy
 
 	maxBuffered int
 	maxBatch    int
 
-	list *bufferList
+	list retryQueue
+
+	// target is the poster of the backend, holding a posterRef
+	// It changes with the location of the output on a reload
+	target atomic.Value
 
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	// settings of the output the buffer was created for
+	settings bufferSettings
+}
+
+type posterRef struct {
 	p poster
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
+// retryPolicy describes how the buffered writes are retried
+type retryPolicy struct {
+	maxInterval time.Duration
+
+	// In strict mode, new writes are buffered until the whole
+	// buffer is drained, so they can't overtake buffered ones
+	strict bool
+
+	// Once a batch failed this many times or is this old,
+	// it is bisected and the lines still rejected by the backend
+	// are moved to the dead letters (0 means no limit)
+	maxAttempts int
+	maxAge      time.Duration
+	deadLetters *deadLetters
+}
+
+// retryQueue holds the batches waiting to be retried against a backend
+type retryQueue interface {
+	// add appends a write to the queue, the returned batch
+	// (if any) is released once the write has been handled
+	add(buf []byte, query string, auth string, endpoint string) (*batch, error)
+
+	// pop removes and returns the oldest batch, blocking if necessary
+	pop() *batch
+
+	// done releases a batch returned by pop
+	done(b *batch)
+
+	// close makes pop return nil, the batches not released yet
+	// are kept for the next queue when they are on disk
+	close()
+
+	getSize() int
+	getMaxSize() int
+}
+
+func newRetryBuffer(size, batch int, list retryQueue, policy retryPolicy, p poster) *retryBuffer {
 	r := &retryBuffer{
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
-		maxInterval:     max,
+		retryPolicy:     policy,
 		maxBuffered:     size,
 		maxBatch:        batch,
-		list:            newBufferList(size, batch),
-		p:               p,
+		list:            list,
+		closing:         make(chan struct{}),
+		stopped:         make(chan struct{}),
 	}
+	r.setTarget(p)
 	go r.run()
 	return r
 }
 
+func (r *retryBuffer) poster() poster {
+	return r.target.Load().(posterRef).p
+}
+
+// setTarget changes the poster the writes are sent to
+func (r *retryBuffer) setTarget(p poster) {
+	r.target.Store(posterRef{p})
+}
+
+// close stops replaying the buffered writes and closes the queue, it waits
+// for the write being replayed, the following ones are rejected
+func (r *retryBuffer) close() {
+	r.closeOnce.Do(func() {
+		close(r.closing)
+		r.list.close()
+	})
+	<-r.stopped
+}
+
+// sleep waits for the given duration, it returns false if the buffer is closed meanwhile
+func (r *retryBuffer) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-r.closing:
+		return false
+	}
+}
+
 type retryStats struct {
-	Buffering int64 `json:"buffering"`
-	MaxSize   int64 `json:"maxSize"`
-	Size      int64 `json:"size"`
+	Buffering  int64 `json:"buffering"`
+	Strict     bool  `json:"strict"`
+	MaxSize    int64 `json:"maxSize"`
+	Size       int64 `json:"size"`
+	Persistent bool  `json:"persistent"`
+	Paused     bool  `json:"paused,omitempty"`
 }
 
 func (r *retryBuffer) getStats() stats {
 	stats := retryStats{}
-	stats.Buffering = int64(r.buffering)
-	stats.MaxSize = int64(r.list.maxSize)
-	stats.Size = int64(r.list.size)
+	stats.Buffering = int64(atomic.LoadInt32(&r.buffering))
+	stats.Strict = r.strict
+	stats.MaxSize = int64(r.list.getMaxSize())
+	stats.Size = int64(r.list.getSize())
+	_, stats.Persistent = r.list.(*diskQueue)
+	stats.Paused = atomic.LoadInt32(&r.paused) == 1
 	return stats
 }
 
 func (r *retryBuffer) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if atomic.LoadInt32(&r.paused) == 1 {
+		return r.buffer(buf, query, auth, endpoint)
+	}
+
+	if r.strict {
+		r.mu.RLock()
+		if atomic.LoadInt32(&r.buffering) == 1 {
+			batch, err := r.list.add(buf, query, auth, endpoint)
+			r.mu.RUnlock()
+			return r.wait(batch, err)
+		}
+		r.mu.RUnlock()
+	}
+
 	if atomic.LoadInt32(&r.buffering) == 0 {
-		resp, err := r.p.post(buf, query, auth, endpoint)
-		// TODO: A 5xx caused by the point data could cause the relay to buffer forever
+		resp, err := r.poster().post(buf, query, auth, endpoint)
+		// A 5xx caused by the point data could cause the relay to buffer forever,
+		// unless buffer-max-attempts or buffer-max-age is set (see isolate)
 		if err == nil && resp.StatusCode/100 != 5 {
 			return resp, err
 		}
@@ -76,7 +202,45 @@ func (r *retryBuffer) post(buf []byte, query string, auth string, endpoint strin
 	}
 
 	// already buffering or failed request
-	batch, err := r.list.add(buf, query, auth, endpoint)
+	return r.wait(r.list.add(buf, query, auth, endpoint))
+}
+
+// buffer adds a write to the buffer without trying to send it first, the
+// client being answered right away as the backend is known not to take it
+func (r *retryBuffer) buffer(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	atomic.StoreInt32(&r.buffering, 1)
+	if _, err := r.list.add(buf, query, auth, endpoint); err != nil {
+		return r.wait(nil, err)
+	}
+	return &responseData{StatusCode: http.StatusAccepted}, nil
+}
+
+// setPaused stops or starts replaying the buffered writes
+func (r *retryBuffer) setPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&r.paused, v)
+}
+
+// setDetached answers the writes as soon as they are buffered, for the
+// backends of the UDP and Graphite relays which have no client to hold
+func (r *retryBuffer) setDetached() {
+	atomic.StoreInt32(&r.detached, 1)
+}
+
+// wait holds the client until its buffered write is handled
+func (r *retryBuffer) wait(batch *batch, err error) (*responseData, error) {
+	if err == nil && batch == nil {
+		// The write is safely stored on disk, there is
+		// no need to hold the client until it is replayed
+		return &responseData{StatusCode: http.StatusAccepted}, nil
+	}
+
+	if err == nil && atomic.LoadInt32(&r.detached) == 1 {
+		return &responseData{StatusCode: http.StatusAccepted}, nil
+	}
 
 	if batch != nil {
 		defer batch.wg.Wait()
@@ -90,36 +254,70 @@ func (r *retryBuffer) post(buf []byte, query string, auth string, endpoint strin
 }
 
 func (r *retryBuffer) run() {
+	defer close(r.stopped)
+
 	buf := bytes.NewBuffer(make([]byte, 0, r.maxBatch))
 	for {
 		buf.Reset()
 		batch := r.list.pop()
+		if batch == nil {
+			return
+		}
+		atomic.StoreInt64(&r.oldest, batch.created.UnixNano())
 
 		for _, b := range batch.bufs {
 			buf.Write(b)
 		}
 
 		interval := r.initialInterval
+		attempts := 0
 		for {
-			if r.flushing == 1 {
+			if atomic.LoadInt32(&r.flushing) == 1 {
 				atomic.StoreInt32(&r.buffering, 0)
-				batch.wg.Done()
+				r.list.done(batch)
 
-				if r.list.size == 0 {
+				if r.list.getSize() == 0 {
 					atomic.StoreInt32(&r.flushing, 0)
 				}
 
 				break
 			}
 
-			resp, err := r.p.post(buf.Bytes(), batch.query, batch.auth, batch.endpoint)
+			if atomic.LoadInt32(&r.paused) == 1 {
+				if !r.sleep(r.initialInterval) {
+					r.list.done(batch)
+					return
+				}
+				continue
+			}
+
+			resp, err := r.poster().post(buf.Bytes(), batch.query, batch.auth, batch.endpoint)
 			if err == nil && resp.StatusCode/100 != 5 {
 				batch.resp = resp
-				atomic.StoreInt32(&r.buffering, 0)
-				batch.wg.Done()
+				r.resume()
+				r.list.done(batch)
 				break
 			}
 
+			attempts++
+			atomic.AddInt64(&r.retries, 1)
+			if err == nil && r.poisoned(batch, attempts) {
+				pending := r.isolate(batch, buf.Bytes())
+				if len(pending) == 0 {
+					r.resume()
+					r.list.done(batch)
+					break
+				}
+
+				// Only the lines neither written nor moved to the dead
+				// letters are retried, the backend is given more time
+				data := bytes.Join(pending, nil)
+				buf.Reset()
+				buf.Write(data)
+				attempts = 0
+				batch.created = time.Now()
+			}
+
 			if interval != r.maxInterval {
 				interval *= r.multiplier
 				if interval > r.maxInterval {
@@ -127,11 +325,148 @@ func (r *retryBuffer) run() {
 				}
 			}
 
-			time.Sleep(interval)
+			if !r.sleep(interval) {
+				r.list.done(batch)
+				return
+			}
 		}
+
+		atomic.StoreInt64(&r.oldest, 0)
 	}
 }
 
+// poisoned tells if a batch failed for too long
+func (r *retryBuffer) poisoned(b *batch, attempts int) bool {
+	if r.deadLetters == nil {
+		return false
+	}
+
+	return (r.maxAttempts > 0 && attempts >= r.maxAttempts) ||
+		(r.maxAge > 0 && time.Since(b.created) >= r.maxAge)
+}
+
+// rejectedLines are consecutive lines rejected by the backend with the same status
+type rejectedLines struct {
+	status int
+	lines  [][]byte
+}
+
+// bisection is the outcome of the bisection of a failing batch
+type bisection struct {
+	// answered is set once the backend wrote or rejected with a 4xx a part of the batch
+	answered bool
+
+	// down is set on a network error, the following lines are not tried
+	down bool
+
+	rejected []rejectedLines
+	pending  [][]byte
+}
+
+// reject adds a single line to the rejected ones
+func (res *bisection) reject(line []byte, status int) {
+	if n := len(res.rejected); n > 0 && res.rejected[n-1].status == status {
+		res.rejected[n-1].lines = append(res.rejected[n-1].lines, line)
+		return
+	}
+	res.rejected = append(res.rejected, rejectedLines{status: status, lines: [][]byte{line}})
+}
+
+// isolate bisects a batch failing on the backend in order to find the
+// lines it rejects, which are moved to the dead letters: the lines rejected
+// with a 4xx, and the ones whose 5xx repeats when they are retried on their
+// own while the backend writes or rejects other lines of the batch.
+// It returns the lines still to be retried: the ones which could not be
+// tried because of a network error, or the whole batch when every line
+// failed with a 5xx, the backend then seeming to be failing on its own.
+func (r *retryBuffer) isolate(b *batch, buf []byte) [][]byte {
+	lines := splitLines(buf)
+
+	var res bisection
+	r.bisect(b, lines, &res)
+	if !res.answered {
+		return lines
+	}
+
+	for _, rl := range res.rejected {
+		data := bytes.Join(rl.lines, nil)
+		logging.Warn("moving rejected lines to the dead letters", "lines", len(rl.lines), "status", rl.status)
+		if err := r.deadLetters.add(data, b.query, b.auth, b.endpoint, rl.status); err != nil {
+			logging.Error("dropping rejected lines", "lines", len(rl.lines), "status", rl.status, "error", err)
+		}
+	}
+
+	return res.pending
+}
+
+// bisect writes the lines, splitting them in halves as long as the backend
+// rejects them, and collects the single lines it keeps rejecting
+func (r *retryBuffer) bisect(b *batch, lines [][]byte, res *bisection) {
+	if res.down {
+		res.pending = append(res.pending, lines...)
+		return
+	}
+
+	resp, err := r.poster().post(bytes.Join(lines, nil), b.query, b.auth, b.endpoint)
+	if err == nil && len(lines) == 1 && resp.StatusCode/100 == 5 {
+		// A 5xx may be transient, the line is only poisoned if it repeats
+		resp, err = r.poster().post(lines[0], b.query, b.auth, b.endpoint)
+	}
+	if err != nil {
+		res.down = true
+		res.pending = append(res.pending, lines...)
+		return
+	}
+
+	class := resp.StatusCode / 100
+	if class != 4 && class != 5 {
+		res.answered = true
+		return
+	}
+
+	if len(lines) == 1 {
+		if class == 4 {
+			res.answered = true
+		}
+		res.reject(lines[0], resp.StatusCode)
+		return
+	}
+
+	mid := len(lines) / 2
+	r.bisect(b, lines[:mid], res)
+	r.bisect(b, lines[mid:], res)
+}
+
+// splitLines splits a line protocol body, keeping the line feeds
+func splitLines(buf []byte) [][]byte {
+	var lines [][]byte
+	for len(buf) > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			i = len(buf) - 1
+		}
+
+		lines = append(lines, buf[:i+1])
+		buf = buf[i+1:]
+	}
+	return lines
+}
+
+// resume switches back to direct posting after a successful retry,
+// in strict mode only once every buffered write has been sent
+func (r *retryBuffer) resume() {
+	if !r.strict {
+		atomic.StoreInt32(&r.buffering, 0)
+		return
+	}
+
+	r.mu.Lock()
+	if r.list.getSize() == 0 {
+		atomic.StoreInt32(&r.buffering, 0)
+	}
+	r.mu.Unlock()
+}
+
 type batch struct {
 	query    string
 	auth     string
@@ -139,6 +474,11 @@ type batch struct {
 	size     int
 	full     bool
 	endpoint string
+	created  time.Time
+
+	// position right after the batch in a diskQueue
+	seg uint64
+	off int64
 
 	wg   sync.WaitGroup
 	resp *responseData
@@ -153,6 +493,7 @@ func newBatch(buf []byte, query string, auth string, endpoint string) *batch {
 	b.query = query
 	b.auth = auth
 	b.endpoint = endpoint
+	b.created = time.Now()
 	b.wg.Add(1)
 	return b
 }
@@ -163,6 +504,7 @@ type bufferList struct {
 	size     int
 	maxSize  int
 	maxBatch int
+	closed   bool
 }
 
 func newBufferList(maxSize, maxBatch int) *bufferList {
@@ -181,14 +523,34 @@ func (r *retryBuffer) empty() {
 	atomic.StoreInt32(&r.flushing, 1)
 }
 
+func (l *bufferList) getSize() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	return l.size
+}
+
+func (l *bufferList) getMaxSize() int {
+	return l.maxSize
+}
+
+// done releases the clients waiting for the batch
+func (l *bufferList) done(b *batch) {
+	b.wg.Done()
+}
+
 // pop will remove and return the first element of the list, blocking if necessary
 func (l *bufferList) pop() *batch {
 	l.cond.L.Lock()
 
-	for l.size == 0 {
+	for l.size == 0 && !l.closed {
 		l.cond.Wait()
 	}
 
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil
+	}
+
 	b := l.head
 	l.head = l.head.next
 	l.size -= b.size
@@ -198,14 +560,41 @@ func (l *bufferList) pop() *batch {
 	return b
 }
 
+// close drops the buffered writes, releasing their clients
+func (l *bufferList) close() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+
+	for b := l.head; b != nil; b = b.next {
+		b.wg.Done()
+	}
+	l.head = nil
+	l.size = 0
+	l.cond.Broadcast()
+}
+
 func (l *bufferList) add(buf []byte, query string, auth string, endpoint string) (*batch, error) {
 	l.cond.L.Lock()
 
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil, errBufferClosed
+	}
+
 	if l.size+len(buf) > l.maxSize {
 		l.cond.L.Unlock()
 		return nil, ErrBufferFull
 	}
 
+	// The caller may answer its client and reuse buf before the write is
+	// replayed, so the list holds its own copy
+	buf = append([]byte(nil), buf...)
+
 	l.size += len(buf)
 	l.cond.Signal()
 
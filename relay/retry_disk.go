@@ -0,0 +1,594 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+// Fsync policies of the persisted retry buffer
+const (
+	FsyncAlways  = "always"
+	FsyncSegment = "segment"
+	FsyncNever   = "never"
+)
+
+const (
+	defaultSegmentSize = 16 * MB
+
+	segmentSuffix    = ".seg"
+	positionFile     = "position"
+	recordHeaderSize = 20
+
+	// maxRecordSize bounds the payload lengths read from the record
+	// headers, which are not covered by the checksum
+	maxRecordSize = 1 << 30
+)
+
+var errCorruptRecord = errors.New("corrupt buffer record")
+
+// openDirs are the directories of the disk queues in use, two
+// queues sharing their segments would lose buffered writes
+var openDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// diskQueue is a retryQueue storing the buffered writes in segment
+// files, so they can be replayed after a restart of the relay.
+// Every write is appended to the last segment, the oldest segments
+// are removed once all of their writes have been acknowledged.
+type diskQueue struct {
+	cond *sync.Cond
+
+	dir         string
+	fsync       string
+	maxSize     int
+	maxBatch    int
+	segmentSize int64
+
+	// segments on disk, oldest first, the last one is being written
+	segments []segment
+	w        *os.File
+
+	// read position
+	r    *os.File
+	rSeg uint64
+	rOff int64
+
+	// bytes not popped yet and bytes used on disk
+	size     int
+	diskSize int64
+
+	closed bool
+}
+
+func newDiskQueue(dir string, fsync string, maxSize, maxBatch int) (*diskQueue, error) {
+	switch fsync {
+	case "":
+		fsync = FsyncSegment
+	case FsyncAlways, FsyncSegment, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", fsync)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	openDirs.Lock()
+	defer openDirs.Unlock()
+	if openDirs.dirs[abs] {
+		return nil, fmt.Errorf("buffer directory %q is already in use", dir)
+	}
+
+	segmentSize := int64(defaultSegmentSize)
+	if s := int64(maxSize / 4); s < segmentSize {
+		segmentSize = s
+	}
+	if segmentSize < int64(maxBatch) {
+		segmentSize = int64(maxBatch)
+	}
+
+	q := &diskQueue{
+		cond:        sync.NewCond(new(sync.Mutex)),
+		dir:         dir,
+		fsync:       fsync,
+		maxSize:     maxSize,
+		maxBatch:    maxBatch,
+		segmentSize: segmentSize,
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+
+	openDirs.dirs[abs] = true
+	return q, nil
+}
+
+// close closes the segment files and wakes up pop, the writes
+// not acknowledged yet are replayed by the next queue of the directory
+func (q *diskQueue) close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.cond.Broadcast()
+
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+
+	if q.fsync != FsyncNever {
+		if err := q.w.Sync(); err != nil {
+			logging.Error("unable to sync buffer segment", "dir", q.dir, "error", err)
+		}
+	}
+	q.w.Close()
+
+	if abs, err := filepath.Abs(q.dir); err == nil {
+		openDirs.Lock()
+		delete(openDirs.dirs, abs)
+		openDirs.Unlock()
+	}
+}
+
+// replay loads the segments left by a previous run,
+// skipping everything that was already acknowledged
+func (q *diskQueue) replay() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	ackSeg, ackOff, err := q.readPosition()
+	if err != nil {
+		return err
+	}
+
+	var next uint64 = 1
+	for _, id := range ids {
+		next = id + 1
+
+		if id < ackSeg {
+			_ = os.Remove(q.segmentPath(id))
+			continue
+		}
+
+		size, err := q.validate(id)
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			_ = os.Remove(q.segmentPath(id))
+			continue
+		}
+
+		q.segments = append(q.segments, segment{id: id, size: size})
+		q.diskSize += size
+	}
+
+	if len(q.segments) > 0 {
+		q.rSeg = q.segments[0].id
+		if q.rSeg == ackSeg && ackOff <= q.segments[0].size {
+			q.rOff = ackOff
+		}
+
+		for _, s := range q.segments {
+			q.size += int(s.size)
+		}
+		q.size -= int(q.rOff)
+
+		logging.Info("replaying buffered writes", "bytes", q.size, "dir", q.dir)
+	}
+
+	// Always start writing in a fresh segment
+	if err := q.openSegment(next); err != nil {
+		return err
+	}
+
+	if len(q.segments) == 1 {
+		q.rSeg = next
+	}
+
+	return nil
+}
+
+// validate reads every record of a segment and truncates
+// it after the last valid one, returning its new size
+func (q *diskQueue) validate(id uint64) (int64, error) {
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var off int64
+	for {
+		_, n, err := readRecordAt(f, off)
+		if err == io.EOF {
+			return off, nil
+		}
+
+		if err != nil {
+			logging.Warn("truncating buffer segment", "segment", q.segmentPath(id), "offset", off, "error", err)
+			return off, f.Truncate(off)
+		}
+
+		off += n
+	}
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (q *diskQueue) readPosition() (uint64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, positionFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(data) != 16 {
+		logging.Warn("ignoring invalid buffer position", "dir", q.dir)
+		return 0, 0, nil
+	}
+
+	return binary.BigEndian.Uint64(data[:8]), int64(binary.BigEndian.Uint64(data[8:])), nil
+}
+
+func (q *diskQueue) writePosition(seg uint64, off int64) error {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], seg)
+	binary.BigEndian.PutUint64(data[8:], uint64(off))
+
+	tmp := filepath.Join(q.dir, positionFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data[:]); err == nil && q.fsync == FsyncAlways {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(q.dir, positionFile))
+}
+
+// openSegment closes the segment being written and starts a new one
+func (q *diskQueue) openSegment(id uint64) error {
+	if q.w != nil {
+		if q.fsync != FsyncNever {
+			if err := q.w.Sync(); err != nil {
+				return err
+			}
+		}
+
+		if err := q.w.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	q.w = f
+	q.segments = append(q.segments, segment{id: id})
+	return nil
+}
+
+func (q *diskQueue) current() *segment {
+	return &q.segments[len(q.segments)-1]
+}
+
+func (q *diskQueue) add(buf []byte, query string, auth string, endpoint string) (*batch, error) {
+	rec := encodeRecord(buf, query, auth, endpoint)
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return nil, errBufferClosed
+	}
+
+	if q.diskSize+int64(len(rec)) > int64(q.maxSize) {
+		return nil, ErrBufferFull
+	}
+
+	if cur := q.current(); cur.size > 0 && cur.size+int64(len(rec)) > q.segmentSize {
+		if err := q.openSegment(cur.id + 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := q.w.Write(rec); err != nil {
+		return nil, err
+	}
+
+	if q.fsync == FsyncAlways {
+		if err := q.w.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	q.current().size += int64(len(rec))
+	q.diskSize += int64(len(rec))
+	q.size += len(rec)
+	q.cond.Signal()
+
+	return nil, nil
+}
+
+// next reads the record at the read position, moving
+// to the following segment when the current one is over
+func (q *diskQueue) next() (*diskRecord, int64, error) {
+	for {
+		i := q.segmentIndex(q.rSeg)
+		if q.rOff >= q.segments[i].size {
+			if i == len(q.segments)-1 {
+				return nil, 0, io.EOF
+			}
+
+			if q.r != nil {
+				q.r.Close()
+				q.r = nil
+			}
+
+			q.rSeg = q.segments[i+1].id
+			q.rOff = 0
+			continue
+		}
+
+		if q.r == nil {
+			f, err := os.Open(q.segmentPath(q.rSeg))
+			if err != nil {
+				return nil, 0, err
+			}
+			q.r = f
+		}
+
+		return readRecordAt(q.r, q.rOff)
+	}
+}
+
+func (q *diskQueue) segmentIndex(id uint64) int {
+	return sort.Search(len(q.segments), func(i int) bool { return q.segments[i].id >= id })
+}
+
+// skip drops the remaining of the segment being read
+func (q *diskQueue) skip() {
+	i := q.segmentIndex(q.rSeg)
+	q.size -= int(q.segments[i].size - q.rOff)
+	q.rOff = q.segments[i].size
+}
+
+func (q *diskQueue) pop() *batch {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for {
+		for q.size == 0 && !q.closed {
+			q.cond.Wait()
+		}
+
+		if q.closed {
+			return nil
+		}
+
+		var b *batch
+		for {
+			rec, n, err := q.next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				logging.Error("unable to read buffer segment", "segment", q.segmentPath(q.rSeg), "error", err)
+				q.skip()
+				break
+			}
+
+			if b == nil {
+				b = newBatch(rec.data, rec.query, rec.auth, rec.endpoint)
+			} else if rec.query != b.query || rec.auth != b.auth || rec.endpoint != b.endpoint ||
+				b.size+len(rec.data) > q.maxBatch {
+				break
+			} else {
+				b.bufs = append(b.bufs, rec.data)
+				b.size += len(rec.data)
+			}
+
+			q.rOff += n
+			q.size -= int(n)
+		}
+
+		if b != nil {
+			b.seg = q.rSeg
+			b.off = q.rOff
+			return b
+		}
+	}
+}
+
+// done acknowledges a batch, removing the segments it fully consumed
+// A batch released after the queue is closed is not acknowledged
+func (q *diskQueue) done(b *batch) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	for len(q.segments) > 1 && q.segments[0].id < b.seg {
+		q.remove()
+	}
+
+	if len(q.segments) > 1 && q.segments[0].id == b.seg && b.off >= q.segments[0].size {
+		q.remove()
+	}
+
+	if err := q.writePosition(b.seg, b.off); err != nil {
+		logging.Error("unable to save buffer position", "dir", q.dir, "error", err)
+	}
+}
+
+func (q *diskQueue) remove() {
+	s := q.segments[0]
+	if s.id == q.rSeg && q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+
+	if err := os.Remove(q.segmentPath(s.id)); err != nil {
+		logging.Error("unable to remove buffer segment", "error", err)
+	}
+
+	q.diskSize -= s.size
+	q.segments = q.segments[1:]
+}
+
+func (q *diskQueue) getSize() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.size
+}
+
+func (q *diskQueue) getMaxSize() int {
+	return q.maxSize
+}
+
+type diskRecord struct {
+	query    string
+	auth     string
+	endpoint string
+	data     []byte
+}
+
+// encodeRecord serializes a write as follows:
+// query, auth, endpoint and data lengths (4 bytes each),
+// CRC32 of the payload (4 bytes), then the payload itself
+func encodeRecord(buf []byte, query string, auth string, endpoint string) []byte {
+	n := len(query) + len(auth) + len(endpoint) + len(buf)
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+n)
+
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(query)))
+	binary.BigEndian.PutUint32(rec[4:], uint32(len(auth)))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(endpoint)))
+	binary.BigEndian.PutUint32(rec[12:], uint32(len(buf)))
+
+	rec = append(rec, query...)
+	rec = append(rec, auth...)
+	rec = append(rec, endpoint...)
+	rec = append(rec, buf...)
+
+	binary.BigEndian.PutUint32(rec[16:], crc32.ChecksumIEEE(rec[recordHeaderSize:]))
+	return rec
+}
+
+// readRecordAt returns the record found at the given offset and its size
+func readRecordAt(f *os.File, off int64) (*diskRecord, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		if err == io.EOF {
+			// A partially written header is as bad as a corrupt record
+			if fi, serr := f.Stat(); serr == nil && fi.Size() > off {
+				return nil, 0, errCorruptRecord
+			}
+		}
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lens [4]int
+	var n int64
+	for i := range lens {
+		lens[i] = int(binary.BigEndian.Uint32(header[i*4:]))
+		n += int64(lens[i])
+	}
+
+	// A length beyond the end of the segment is a torn or corrupt header,
+	// it must not be trusted before the checksum of the payload is checked
+	if n > maxRecordSize || off+recordHeaderSize+n > fi.Size() {
+		return nil, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, n)
+	if _, err := f.ReadAt(payload, off+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, 0, errCorruptRecord
+		}
+		return nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[16:]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	rec := &diskRecord{}
+	rec.query, payload = string(payload[:lens[0]]), payload[lens[0]:]
+	rec.auth, payload = string(payload[:lens[1]]), payload[lens[1]:]
+	rec.endpoint, payload = string(payload[:lens[2]]), payload[lens[2]:]
+	rec.data = payload
+
+	return rec, recordHeaderSize + n, nil
+}
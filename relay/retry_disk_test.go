@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createDiskQueue(t *testing.T, dir string) *diskQueue {
+	q, err := newDiskQueue(dir, FsyncNever, MB, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "relay-buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDiskQueueBatches(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q := createDiskQueue(t, dir)
+
+	for _, l := range []string{"cpu value=1\n", "cpu value=2\n"} {
+		b, err := q.add([]byte(l), "db=a", "", "write")
+		assert.Nil(t, err)
+		assert.Nil(t, b)
+	}
+	_, _ = q.add([]byte("mem value=3\n"), "db=b", "", "write")
+
+	b := q.pop()
+	assert.Equal(t, "db=a", b.query)
+	assert.Equal(t, [][]byte{[]byte("cpu value=1\n"), []byte("cpu value=2\n")}, b.bufs)
+	q.done(b)
+
+	b = q.pop()
+	assert.Equal(t, "db=b", b.query)
+	assert.Equal(t, 0, q.getSize())
+}
+
+func TestDiskQueueReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q := createDiskQueue(t, dir)
+
+	_, _ = q.add([]byte("cpu value=1\n"), "db=a", "Basic xxx", "write")
+	_, _ = q.add([]byte("mem value=2\n"), "db=b", "", "write")
+	q.done(q.pop())
+	q.close()
+
+	// The second write was never acknowledged
+	q = createDiskQueue(t, dir)
+	b := q.pop()
+	assert.Equal(t, "db=b", b.query)
+	assert.Equal(t, [][]byte{[]byte("mem value=2\n")}, b.bufs)
+	q.done(b)
+	q.close()
+
+	q = createDiskQueue(t, dir)
+	assert.Equal(t, 0, q.getSize())
+}
+
+func TestDiskQueueCorruptTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q := createDiskQueue(t, dir)
+
+	_, _ = q.add([]byte("cpu value=1\n"), "db=a", "", "write")
+	_, _ = q.w.Write([]byte("garbage"))
+	q.close()
+
+	q = createDiskQueue(t, dir)
+	assert.Equal(t, len(encodeRecord([]byte("cpu value=1\n"), "db=a", "", "write")), q.getSize())
+	b := q.pop()
+	assert.Equal(t, [][]byte{[]byte("cpu value=1\n")}, b.bufs)
+}
+
+func TestDiskQueueCorruptHeader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q := createDiskQueue(t, dir)
+
+	// The lengths of a torn header must not be allocated
+	_, _ = q.add([]byte("cpu value=1\n"), "db=a", "", "write")
+	header := make([]byte, recordHeaderSize)
+	for i := range header {
+		header[i] = 0xff
+	}
+	_, _ = q.w.Write(header)
+	q.close()
+
+	q = createDiskQueue(t, dir)
+	assert.Equal(t, len(encodeRecord([]byte("cpu value=1\n"), "db=a", "", "write")), q.getSize())
+	b := q.pop()
+	assert.Equal(t, [][]byte{[]byte("cpu value=1\n")}, b.bufs)
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, FsyncAlways, 32, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = q.add([]byte("cpu value=1\n"), "db=a", "", "write")
+	assert.Equal(t, ErrBufferFull, err)
+}
+
+func TestDiskQueueClose(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q := createDiskQueue(t, dir)
+
+	// A directory has a single owner
+	_, err := newDiskQueue(dir, FsyncNever, MB, 64)
+	assert.NotNil(t, err)
+
+	_, _ = q.add([]byte("cpu value=1\n"), "db=a", "", "write")
+	b := q.pop()
+	q.close()
+	assert.Nil(t, q.pop())
+
+	// The batch released once the queue is closed is replayed
+	q.done(b)
+	q = createDiskQueue(t, dir)
+	b = q.pop()
+	assert.Equal(t, [][]byte{[]byte("cpu value=1\n")}, b.bufs)
+}
@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePoster records the writes it receives and fails while down is set
+type fakePoster struct {
+	sync.Mutex
+	down   int32
+	writes []string
+}
+
+func (f *fakePoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return &responseData{StatusCode: http.StatusServiceUnavailable}, nil
+	}
+
+	f.Lock()
+	f.writes = append(f.writes, string(buf))
+	f.Unlock()
+	return &responseData{StatusCode: http.StatusNoContent}, nil
+}
+
+func (f *fakePoster) getStats() stats {
+	return nil
+}
+
+// waitUntil waits for a condition set by the goroutines of a test
+func waitUntil(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestRetryBufferStrictResume(t *testing.T) {
+	f := &fakePoster{down: 1}
+	r := newRetryBuffer(MB, 1, newBufferList(MB, 1), retryPolicy{maxInterval: time.Millisecond, strict: true}, f)
+	r.initialInterval = time.Millisecond
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = r.post([]byte("a"), "", "", "")
+	}()
+
+	// The first write is being retried when the second one is buffered behind it
+	waitUntil(t, func() bool { return atomic.LoadInt64(&r.retries) > 0 })
+	go func() {
+		defer wg.Done()
+		_, _ = r.post([]byte("b"), "", "", "")
+	}()
+	waitUntil(t, func() bool { return r.list.getSize() == 1 })
+
+	atomic.StoreInt32(&f.down, 0)
+	wg.Wait()
+
+	// Both writes were drained before switching back to direct posting
+	assert.Equal(t, int32(0), atomic.LoadInt32(&r.buffering))
+	_, _ = r.post([]byte("c"), "", "", "")
+	assert.Equal(t, []string{"a", "b", "c"}, f.writes)
+}
+
+// poisonPoster fails with a 500 the writes of several lines containing a bad
+// line, and rejects with a 400 the bad lines written on their own
+type poisonPoster struct {
+	fakePoster
+}
+
+func (p *poisonPoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if bytes.Contains(buf, []byte("bad")) {
+		if bytes.Count(buf, []byte("\n")) > 1 {
+			return &responseData{StatusCode: http.StatusInternalServerError}, nil
+		}
+		return &responseData{StatusCode: http.StatusBadRequest}, nil
+	}
+	return p.fakePoster.post(buf, query, auth, endpoint)
+}
+
+func TestRetryBufferDeadLetters(t *testing.T) {
+	p := &poisonPoster{}
+	d, _ := newDeadLetters("", MB)
+	policy := retryPolicy{maxInterval: time.Millisecond, maxAttempts: 2, deadLetters: d}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), policy, p)
+	r.initialInterval = time.Millisecond
+
+	_, _ = r.post([]byte("cpu value=1\ncpu,bad=1 value=2\ncpu value=3\nmem value=4\n"), "db=a", "", "write")
+
+	assert.Equal(t, []string{"cpu value=1\n", "cpu value=3\nmem value=4\n"}, p.writes)
+	letters := d.list()
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "cpu,bad=1 value=2\n", string(letters[0].data))
+	assert.Equal(t, http.StatusBadRequest, letters[0].Status)
+	assert.Equal(t, "db=a", letters[0].Query)
+}
+
+func TestRetryBufferAllRejected(t *testing.T) {
+	p := &poisonPoster{}
+	d, _ := newDeadLetters("", MB)
+	policy := retryPolicy{maxInterval: time.Millisecond, maxAttempts: 1, deadLetters: d}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), policy, p)
+	r.initialInterval = time.Millisecond
+
+	// Every line is rejected, the batch is not retried forever
+	_, _ = r.post([]byte("cpu,bad=1 value=1\ncpu,bad=2 value=2\n"), "db=a", "", "write")
+
+	assert.Equal(t, 0, len(p.writes))
+	letters := d.list()
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "cpu,bad=1 value=1\ncpu,bad=2 value=2\n", string(letters[0].data))
+}
+
+func TestRetryBufferBackendDown(t *testing.T) {
+	for _, lines := range []string{"cpu value=1\n", "cpu value=1\nmem value=2\n"} {
+		f := &fakePoster{down: 1}
+		d, _ := newDeadLetters("", MB)
+		policy := retryPolicy{maxInterval: time.Millisecond, maxAttempts: 1, deadLetters: d}
+		r := newRetryBuffer(MB, MB, newBufferList(MB, MB), policy, f)
+		r.initialInterval = time.Millisecond
+
+		go func() {
+			waitUntil(t, func() bool { return atomic.LoadInt64(&r.retries) >= 3 })
+			atomic.StoreInt32(&f.down, 0)
+		}()
+		_, _ = r.post([]byte(lines), "db=a", "", "write")
+
+		// Nothing could be written while the backend was down, nothing is poisoned
+		assert.Equal(t, 0, len(d.list()), lines)
+		assert.Equal(t, []string{lines}, f.writes, lines)
+	}
+}
+
+func TestRetryBufferClose(t *testing.T) {
+	f := &fakePoster{down: 1}
+	r := newRetryBuffer(MB, 1, newBufferList(MB, 1), retryPolicy{maxInterval: time.Hour}, f)
+	r.initialInterval = time.Hour
+
+	// Both the write being retried and the one queued behind it are released
+	var wg sync.WaitGroup
+	for _, w := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(w string) {
+			defer wg.Done()
+			_, _ = r.buffer([]byte(w), "", "", "")
+		}(w)
+	}
+	waitUntil(t, func() bool { return atomic.LoadInt64(&r.retries) > 0 && r.list.getSize() == 1 })
+
+	r.close()
+	wg.Wait()
+	r.close()
+
+	_, err := r.buffer([]byte("c"), "", "", "")
+	assert.Equal(t, errBufferClosed, err)
+	assert.Equal(t, 0, len(f.writes))
+}
+
+func TestRetryBufferReusedBuffer(t *testing.T) {
+	f := &fakePoster{down: 1}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), retryPolicy{maxInterval: time.Millisecond}, f)
+	r.initialInterval = time.Millisecond
+	defer r.close()
+
+	// The client is answered right away, and its pooled buffer is
+	// reused by the next request before the write is replayed
+	buf := getBuf()
+	buf.WriteString("cpu value=1\n")
+	resp, err := r.buffer(buf.Bytes(), "db=a", "", "write")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	buf.Reset()
+	buf.WriteString("XXX garbage\n")
+	putBuf(buf)
+
+	atomic.StoreInt32(&f.down, 0)
+	waitUntil(t, func() bool {
+		f.Lock()
+		defer f.Unlock()
+		return len(f.writes) == 1
+	})
+	assert.Equal(t, []string{"cpu value=1\n"}, f.writes)
+}
+
+// fatalPoster fails with a 500 the writes containing a fatal line, and
+// with a network error the first write containing a late line
+type fatalPoster struct {
+	fakePoster
+	late int32
+}
+
+func (p *fatalPoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if bytes.Contains(buf, []byte("fatal")) {
+		return &responseData{StatusCode: http.StatusInternalServerError}, nil
+	}
+	if bytes.Contains(buf, []byte("late")) && atomic.CompareAndSwapInt32(&p.late, 0, 1) {
+		return nil, errors.New("connection reset")
+	}
+	return p.fakePoster.post(buf, query, auth, endpoint)
+}
+
+func TestRetryBufferFatalLine(t *testing.T) {
+	p := &fatalPoster{}
+	d, _ := newDeadLetters("", MB)
+	policy := retryPolicy{maxInterval: time.Millisecond, maxAttempts: 1, deadLetters: d}
+	r := newRetryBuffer(MB, MB, newBufferList(MB, MB), policy, p)
+	r.initialInterval = time.Millisecond
+
+	// The line failing with a 5xx on its own does not block the batch, and
+	// the lines written before the network error are not written again
+	_, _ = r.post([]byte("cpu value=1\ncpu,fatal=1 value=2\ncpu,late=1 value=3\nmem value=4\n"), "db=a", "", "write")
+
+	assert.Equal(t, []string{"cpu value=1\n", "cpu,late=1 value=3\nmem value=4\n"}, p.writes)
+	letters := d.list()
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "cpu,fatal=1 value=2\n", string(letters[0].data))
+	assert.Equal(t, http.StatusInternalServerError, letters[0].Status)
+}
+
+func TestDeadLettersCredentials(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	d, err := newDeadLetters(dir, MB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, d.add([]byte("cpu value=1\n"), "db=a&p=secret&u=user", "", "write", http.StatusBadRequest))
+
+	// The credentials of the client are kept to resubmit the
+	// lines, but are not shown by the admin API
+	d, err = newDeadLetters(dir, MB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := d.list()
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, "db=a", letters[0].Query)
+	assert.Equal(t, "db=a&p=secret&u=user", letters[0].query)
+}
@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// Shard keys
+const (
+	ShardKeyMeasurement = "measurement"
+	ShardKeySeries      = "series"
+	ShardKeyTagPrefix   = "tag:"
+)
+
+// Number of points each shard has on the hash ring
+const shardReplicas = 128
+
+// shardRing routes each point to a shard using consistent hashing,
+// so that adding a shard only moves the points of its neighbours
+type shardRing struct {
+	key string
+	tag []byte
+
+	// matches a WHERE clause condition on the sharding tag
+	tagCondition *regexp.Regexp
+
+	names  []string
+	hashes []uint64
+	shards []int
+}
+
+func newShardRing(key string, shards []config.ShardConfig) (*shardRing, error) {
+	s := &shardRing{key: key}
+
+	switch {
+	case key == "":
+		s.key = ShardKeyMeasurement
+	case key == ShardKeyMeasurement || key == ShardKeySeries:
+	case strings.HasPrefix(key, ShardKeyTagPrefix) && len(key) > len(ShardKeyTagPrefix):
+		tag := strings.TrimPrefix(key, ShardKeyTagPrefix)
+		s.tag = []byte(tag)
+		s.tagCondition = regexp.MustCompile(`(?:^|[\s(])(?:` + regexp.QuoteMeta(tag) + `|"` + regexp.QuoteMeta(tag) + `")\s*=\s*'((?:[^'\\]|\\.)*)'`)
+	default:
+		return nil, fmt.Errorf("invalid shard key %q", key)
+	}
+
+	type vnode struct {
+		hash  uint64
+		shard int
+	}
+
+	var ring []vnode
+	for i, sh := range shards {
+		if sh.Name == "" {
+			return nil, errors.New("shards must be named")
+		}
+
+		for _, n := range s.names {
+			if n == sh.Name {
+				return nil, fmt.Errorf("duplicate shard: %q", sh.Name)
+			}
+		}
+		s.names = append(s.names, sh.Name)
+
+		for r := 0; r < shardReplicas; r++ {
+			ring = append(ring, vnode{hash: hash64([]byte(sh.Name + "#" + strconv.Itoa(r))), shard: i})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	for _, v := range ring {
+		s.hashes = append(s.hashes, v.hash)
+		s.shards = append(s.shards, v.shard)
+	}
+
+	return s, nil
+}
+
+// hash64 hashes a key with FNV-1a, mixing the result as
+// close keys give close hashes, which would unbalance the ring
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// shardKey returns the bytes a point is sharded on, points
+// missing the sharding tag are sharded on their measurement
+func (s *shardRing) shardKey(p models.Point) []byte {
+	switch {
+	case s.tag != nil:
+		if v := p.Tags().Get(s.tag); v != nil {
+			return v
+		}
+		return p.Name()
+	case s.key == ShardKeySeries:
+		return p.Key()
+	default:
+		return p.Name()
+	}
+}
+
+// shard returns the index of the shard a point belongs to
+func (s *shardRing) shard(p models.Point) int {
+	return s.locate(s.shardKey(p))
+}
+
+// locate returns the index of the shard owning a key
+func (s *shardRing) locate(key []byte) int {
+	h := hash64(key)
+	i := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= h })
+	if i == len(s.hashes) {
+		i = 0
+	}
+	return s.shards[i]
+}
+
+var (
+	orRegexp       = regexp.MustCompile(`(?i)\bor\b`)
+	tagValueEscape = strings.NewReplacer(`\'`, `'`, `\\`, `\`)
+)
+
+// route returns the only shard holding the points a SELECT statement
+// reads, or -1 when the statement may read points of every shard
+func (s *shardRing) route(st *statement) int {
+	if st.mode == mergeUnion {
+		return -1
+	}
+
+	switch {
+	case s.tag != nil:
+		// Points having the tag are all on the shard of its value
+		where := clause(st.text, "WHERE")
+		if where == "" || orRegexp.MatchString(where) {
+			return -1
+		}
+
+		m := s.tagCondition.FindStringSubmatch(where)
+		if m == nil {
+			return -1
+		}
+		return s.locate([]byte(tagValueEscape.Replace(m[1])))
+
+	case s.key == ShardKeySeries:
+		return -1
+
+	default:
+		name, ok := measurementName(clause(st.text, "FROM"))
+		if !ok {
+			return -1
+		}
+		return s.locate([]byte(name))
+	}
+}
+
+// relevant returns the shards a query has to be sent to
+func (s *shardRing) relevant(statements []*statement) []int {
+	shard := -1
+	for i, st := range statements {
+		j := s.route(st)
+		if j < 0 || (i > 0 && j != shard) {
+			shard = -1
+			break
+		}
+		shard = j
+	}
+
+	if shard >= 0 {
+		return []int{shard}
+	}
+
+	all := make([]int, len(s.names))
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// shardBatch holds the points of a shard, serialized with the request precision
+type shardBatch struct {
+	points models.Points
+	buf    *bytes.Buffer
+}
+
+// split dispatches the points to their shards, a shard
+// without any point is left nil
+func (s *shardRing) split(points models.Points, precision string) []*shardBatch {
+	batches := make([]*shardBatch, len(s.names))
+	for _, p := range points {
+		i := s.shard(p)
+		if batches[i] == nil {
+			batches[i] = &shardBatch{buf: getBuf()}
+		}
+
+		b := batches[i]
+		b.points = append(b.points, p)
+		_, _ = b.buf.WriteString(p.PrecisionString(precision))
+		_ = b.buf.WriteByte('\n')
+	}
+	return batches
+}
+
+// assignShards sets the shard of each backend belonging to one
+func assignShards(backends []*httpBackend, shards []config.ShardConfig) error {
+	for i, sh := range shards {
+		for _, name := range sh.Outputs {
+			found := false
+			for _, b := range backends {
+				if b.name != name {
+					continue
+				}
+
+				if b.shard != -1 {
+					return fmt.Errorf("output %q belongs to several shards", name)
+				}
+				b.shard = i
+				found = true
+			}
+
+			if !found {
+				return fmt.Errorf("unknown output %q in shard %q", name, sh.Name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+var testShards = []config.ShardConfig{
+	{Name: "a", Outputs: []string{"a1", "a2"}},
+	{Name: "b", Outputs: []string{"b1"}},
+	{Name: "c", Outputs: []string{"c1"}},
+}
+
+func parsePoints(t *testing.T, lines string) models.Points {
+	points, err := models.ParsePoints([]byte(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func TestShardRing(t *testing.T) {
+	s, err := newShardRing("tag:customer_id", testShards)
+	assert.Nil(t, err)
+
+	// Points are routed on the tag value, or on the measurement without the tag
+	points := parsePoints(t, "cpu,customer_id=42 value=1\nmem,customer_id=42,host=a value=2\ncpu value=3\ncpu,customer_id=cpu value=4")
+	assert.Equal(t, s.shard(points[0]), s.shard(points[1]))
+	assert.Equal(t, s.shard(points[2]), s.shard(points[3]))
+
+	// Keys are spread over every shard
+	counts := make([]int, len(testShards))
+	for i := 0; i < 3000; i++ {
+		p := parsePoints(t, "cpu,customer_id="+strconv.Itoa(i)+" value=1")
+		counts[s.shard(p[0])]++
+	}
+	for _, c := range counts {
+		assert.True(t, c > 500, "unbalanced shards: %v", counts)
+	}
+
+	// Adding a shard only moves keys to the new shard
+	more, _ := newShardRing("tag:customer_id", append(testShards, config.ShardConfig{Name: "d"}))
+	for i := 0; i < 1000; i++ {
+		p := parsePoints(t, "cpu,customer_id="+strconv.Itoa(i)+" value=1")
+		if j := more.shard(p[0]); j != 3 {
+			assert.Equal(t, s.shard(p[0]), j)
+		}
+	}
+}
+
+func TestShardRingInvalid(t *testing.T) {
+	_, err := newShardRing("host", testShards)
+	assert.NotNil(t, err)
+
+	_, err = newShardRing("", append(testShards, config.ShardConfig{Name: "a"}))
+	assert.NotNil(t, err)
+
+	backends := []*httpBackend{{name: "a1", shard: -1}, {name: "a2", shard: -1}}
+	assert.NotNil(t, assignShards(backends, testShards))
+}
+
+func TestHandleInfluxSharded(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+	h.shards, _ = newShardRing(ShardKeySeries, testShards)
+
+	posters := make(map[string]*fakePoster)
+	for _, name := range []string{"a1", "a2", "b1", "c1", "all"} {
+		posters[name] = &fakePoster{}
+		h.backends = append(h.backends, &httpBackend{poster: posters[name], name: name, shard: -1})
+	}
+	assert.Nil(t, assignShards(h.backends, testShards))
+
+	lines := "cpu,host=a value=1 1\ncpu,host=b value=2 2\ncpu,host=c value=3 3\ncpu,host=d value=4 4\n"
+	influxBody.buf = bytes.NewBuffer([]byte(lines))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&report=true", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(func() {
+		h.handleStandard(w, r, ti)
+	})
+	// The report waits for every output
+	assert.Equal(t, http.StatusOK, w.code)
+
+	// Every point went to exactly one shard, replicated to each of its outputs
+	assert.Equal(t, []string{lines}, posters["all"].writes)
+	assert.Equal(t, posters["a1"].writes, posters["a2"].writes)
+
+	var sharded string
+	for _, name := range []string{"a1", "b1", "c1"} {
+		assert.True(t, len(posters[name].writes) <= 1)
+		sharded += strings.Join(posters[name].writes, "")
+	}
+	assert.Equal(t, len(lines), len(sharded))
+}
+
+func TestHandlePromSharded(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+	h.shards, _ = newShardRing(ShardKeySeries, testShards)
+
+	posters := make(map[string]*fakePoster)
+	for _, name := range []string{"a1", "a2", "b1", "c1", "all"} {
+		posters[name] = &fakePoster{}
+		h.backends = append(h.backends, &httpBackend{poster: posters[name], name: name, shard: -1, endpoints: config.HTTPEndpointConfig{Write: "write"}})
+	}
+	assert.Nil(t, assignShards(h.backends, testShards))
+
+	promBody.buf = bytes.NewBuffer(encodePromWrite(t, promRequest))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/api/v1/prom/write?db=test&report=true", promBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureOutput(func() {
+		h.handleProm(w, r, ti)
+	})
+	assert.Equal(t, http.StatusOK, w.code)
+
+	// The samples are routed like the points of the line protocol writes
+	assert.Equal(t, []string{promLines}, posters["all"].writes)
+	assert.Equal(t, posters["a1"].writes, posters["a2"].writes)
+
+	var sharded string
+	for _, name := range []string{"a1", "b1", "c1"} {
+		assert.True(t, len(posters[name].writes) <= 1)
+		sharded += strings.Join(posters[name].writes, "")
+	}
+	assert.Equal(t, len(promLines), len(sharded))
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"github.com/influxdata/influxdb/models"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+// transforms rewrite the points, in order
+type transforms []*config.Transform
+
+// globalTransforms returns the transforms applying to every output
+func globalTransforms(ts config.Transforms) transforms {
+	var res transforms
+	for i := range ts {
+		if len(ts[i].Outputs) == 0 {
+			res = append(res, &ts[i])
+		}
+	}
+	return res
+}
+
+// outputTransforms returns the transforms applying to the output
+func outputTransforms(ts config.Transforms, name string) transforms {
+	var res transforms
+	for i := range ts {
+		for _, output := range ts[i].Outputs {
+			if output == name {
+				res = append(res, &ts[i])
+				break
+			}
+		}
+	}
+	return res
+}
+
+// apply returns the points rewritten by the transforms,
+// the points left without any field are dropped
+func (ts transforms) apply(points models.Points) models.Points {
+	if len(ts) == 0 {
+		return points
+	}
+
+	res := make(models.Points, 0, len(points))
+	for _, p := range points {
+		if p, ok := ts.applyPoint(p); ok {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (ts transforms) applyPoint(p models.Point) (models.Point, bool) {
+	name := string(p.Name())
+
+	var (
+		tags    map[string]string
+		fields  models.Fields
+		changed bool
+	)
+
+	for _, t := range ts {
+		if t.MeasurementRegexp != nil && !t.MeasurementRegexp.MatchString(name) {
+			continue
+		}
+
+		if !changed {
+			var err error
+			if fields, err = p.Fields(); err != nil {
+				return p, true
+			}
+			tags = p.Tags().Map()
+			changed = true
+		}
+
+		for _, k := range t.DropTags {
+			delete(tags, k)
+		}
+		for k, nk := range t.RenameTags {
+			if v, ok := tags[k]; ok {
+				delete(tags, k)
+				tags[nk] = v
+			}
+		}
+		for k, v := range t.AddTags {
+			tags[k] = v
+		}
+
+		for _, k := range t.DropFields {
+			delete(fields, k)
+		}
+		for k, nk := range t.RenameFields {
+			if v, ok := fields[k]; ok {
+				delete(fields, k)
+				fields[nk] = v
+			}
+		}
+
+		if t.MeasurementReplace != "" {
+			name = t.MeasurementRegexp.ReplaceAllString(name, t.MeasurementReplace)
+		}
+	}
+
+	if !changed {
+		return p, true
+	} else if name == "" {
+		return nil, false
+	}
+
+	// The point is invalid without any field, or with an empty measurement
+	np, err := models.NewPoint(name, models.NewTags(tags), fields, p.Time())
+	if err != nil {
+		return nil, false
+	}
+	return np, true
+}
@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+)
+
+func transformLines(t *testing.T, ts config.Transforms, lines string) string {
+	assert.Nil(t, ts.LoadRegexps())
+
+	points, err := models.ParsePointsString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writePoints(&buf, globalTransforms(ts).apply(points), "")
+	return buf.String()
+}
+
+func TestTransforms(t *testing.T) {
+	ts := config.Transforms{
+		{
+			DropTags:     []string{"request_id"},
+			RenameTags:   map[string]string{"host": "hostname"},
+			AddTags:      map[string]string{"region": "eu"},
+			DropFields:   []string{"debug"},
+			RenameFields: map[string]string{"val": "value"},
+		},
+		{
+			MeasurementExpression: "^legacy_(.*)$",
+			MeasurementReplace:    "$1",
+			AddTags:               map[string]string{"legacy": "true"},
+		},
+	}
+
+	assert.Equal(t, "cpu,hostname=a,region=eu value=1 1\nmem,legacy=true,region=eu value=2 2\n",
+		transformLines(t, ts, "cpu,host=a,request_id=x val=1,debug=2 1\nlegacy_mem value=2 2"))
+
+	// The points without any field left are dropped
+	ts = config.Transforms{{MeasurementExpression: "^debug$", DropFields: []string{"value"}}}
+	assert.Equal(t, "cpu value=1 1\n", transformLines(t, ts, "debug value=1 1\ncpu value=1 1"))
+
+	// The points of other outputs are untouched
+	ts = config.Transforms{{AddTags: map[string]string{"region": "eu"}, Outputs: []string{"other"}}}
+	assert.Equal(t, "cpu value=1 1\n", transformLines(t, ts, "cpu value=1 1"))
+	assert.Equal(t, 1, len(outputTransforms(ts, "other")))
+
+	for _, ts := range []config.Transforms{
+		{{MeasurementReplace: "$1"}},
+		{{MeasurementExpression: "("}},
+		{{AddTags: map[string]string{"region": ""}}},
+		{{RenameFields: map[string]string{"val": ""}}},
+	} {
+		assert.NotNil(t, ts.LoadRegexps())
+	}
+}
+
+func TestHandleStandardTransforms(t *testing.T) {
+	defer resetWriter()
+	h := createHTTP(t, emptyConfig, false)
+
+	ts := config.Transforms{
+		{RenameTags: map[string]string{"host": "hostname"}},
+		{AddTags: map[string]string{"copy": "true"}, Outputs: []string{"copy"}},
+		{MeasurementExpression: "^cpu$", DropFields: []string{"value"}, Outputs: []string{"empty"}},
+	}
+	assert.Nil(t, ts.LoadRegexps())
+	h.transforms = globalTransforms(ts)
+
+	posters := map[string]*fakePoster{"main": {}, "copy": {}, "empty": {}}
+	for _, name := range []string{"main", "copy", "empty"} {
+		b := stateBackend(name, posters[name])
+		b.transforms = outputTransforms(ts, name)
+		h.backends = append(h.backends, b)
+	}
+
+	influxBody.buf = bytes.NewBuffer([]byte("cpu,host=a value=1 1\n"))
+	r, err := http.NewRequest(http.MethodPost, ValidServer.URL+"/write?db=test&consistency=all", influxBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handleStandard(w, r, ti)
+	assert.Equal(t, http.StatusNoContent, w.code)
+	assert.Equal(t, []string{"cpu,hostname=a value=1 1\n"}, posters["main"].writes)
+	assert.Equal(t, []string{"cpu,copy=true,hostname=a value=1 1\n"}, posters["copy"].writes)
+	assert.Equal(t, 0, len(posters["empty"].writes))
+}
+
+func TestHandleStandardConcurrentTransforms(t *testing.T) {
+	h := createHTTP(t, emptyConfig, false)
+
+	ts := config.Transforms{{AddTags: map[string]string{"copy": "true"}, Outputs: []string{"copy"}}}
+	assert.Nil(t, ts.LoadRegexps())
+
+	// The transforms copy the points of the requests while the
+	// buffers of the previous requests are reused
+	f := &fakePoster{}
+	b := stateBackend("copy", f)
+	b.transforms = outputTransforms(ts, "copy")
+	h.backends = append(h.backends, b)
+
+	var expected []string
+	for _, line := range concurrentWrites(t, h) {
+		expected = append(expected, strings.Replace(line, "cpu,", "cpu,copy=true,", 1))
+	}
+	sort.Strings(expected)
+	assert.Equal(t, expected, sortedWrites(f))
+}
@@ -3,7 +3,6 @@ package relay
 import (
 	"bytes"
 	"errors"
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -12,12 +11,20 @@ import (
 	"github.com/influxdata/influxdb/models"
 
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 )
 
 const (
 	defaultMTU = 1024
 )
 
+// Defaults of the reading of the UDP packets
+const (
+	DefaultUDPReaders   = 1
+	DefaultUDPWorkers   = 1
+	DefaultUDPQueueSize = 1024
+)
+
 // UDP is a relay for UDP influxdb writes
 type UDP struct {
 	addr      string
@@ -25,37 +32,82 @@ type UDP struct {
 	precision string
 
 	closing int64
-	l       *net.UDPConn
+	ls      []*net.UDPConn
 	c       *net.UDPConn
 
+	// Goroutines parsing and forwarding the packets,
+	// and number of packets waiting for them
+	workers   int
+	queueSize int
+
 	backends []*udpBackend
+
+	// Backends the points are written to over HTTP, in batches
+	httpBackends []*batchBackend
+
+	// Transforms of the points sent to every backend
+	transforms transforms
+
+	logger *logging.Logger
 }
 
 // NewUDP -TODO-
-func NewUDP(config config.UDPConfig) (Relay, error) {
+func NewUDP(config config.UDPConfig, fs config.Filters, ts config.Transforms) (Relay, error) {
+	return newUDP(config, fs, ts, nil)
+}
+
+// Reload creates the relay of a new configuration, once u is stopped, sharing
+// the retry buffers of the HTTP outputs whose name and buffer settings did not
+// change
+func (u *UDP) Reload(config config.UDPConfig, fs config.Filters, ts config.Transforms) (Relay, error) {
+	var previous []*httpBackend
+	for _, b := range u.httpBackends {
+		previous = append(previous, b.httpBackend)
+	}
+	return newUDP(config, fs, ts, previous)
+}
+
+func newUDP(config config.UDPConfig, fs config.Filters, ts config.Transforms, previous []*httpBackend) (_ Relay, err error) {
 	u := new(UDP)
 
+	// The sockets and the retry buffers created for a rejected configuration
+	// are closed, so that the previous relay can be brought back
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		u.closeListeners()
+		if u.c != nil {
+			u.c.Close()
+		}
+		handOver(previous, httpBackendsOf(u))
+	}()
+
 	u.name = config.Name
 	u.addr = config.Addr
 	u.precision = config.Precision
+	u.logger = logging.Default().With("relay", u.Name())
+	u.transforms = globalTransforms(ts)
 
-	l, err := net.ListenPacket("udp", u.addr)
-	if err != nil {
-		return nil, err
+	readers := DefaultUDPReaders
+	if config.Readers > 0 {
+		readers = config.Readers
 	}
 
-	ul, ok := l.(*net.UDPConn)
-	if !ok {
-		return nil, errors.New("problem listening for UDP")
+	u.workers = DefaultUDPWorkers
+	if config.Workers > 0 {
+		u.workers = config.Workers
 	}
 
-	if config.ReadBuffer != 0 {
-		if err = ul.SetReadBuffer(config.ReadBuffer); err != nil {
-			return nil, err
-		}
+	u.queueSize = DefaultUDPQueueSize
+	if config.QueueSize > 0 {
+		u.queueSize = config.QueueSize
 	}
 
-	u.l = ul
+	if err = u.listen(config, readers); err != nil {
+		return nil, err
+	}
 
 	// UDP doesn't really "listen", this just gets us a socket with
 	// the local UDP address set to something random
@@ -70,6 +122,22 @@ func NewUDP(config config.UDPConfig) (Relay, error) {
 			cfg.Name = cfg.Location
 		}
 
+		if isHTTPLocation(cfg.Location) {
+			var prev *httpBackend
+			for _, b := range previous {
+				if b.name == cfg.Name {
+					prev = b
+				}
+			}
+
+			b, err := newBatchBackend(u.batchRelay(), cfg, fs, ts, prev)
+			if err != nil {
+				return nil, err
+			}
+			u.httpBackends = append(u.httpBackends, b)
+			continue
+		}
+
 		if cfg.MTU == 0 {
 			cfg.MTU = defaultMTU
 		}
@@ -79,7 +147,7 @@ func NewUDP(config config.UDPConfig) (Relay, error) {
 			return nil, err
 		}
 
-		u.backends = append(u.backends, &udpBackend{u, cfg.Name, addr, cfg.MTU})
+		u.backends = append(u.backends, &udpBackend{u, cfg.Name, addr, cfg.MTU, outputTransforms(ts, cfg.Name)})
 	}
 
 	return u, nil
@@ -93,6 +161,11 @@ func (u *UDP) Name() string {
 	return u.name
 }
 
+// batchRelay returns the relay written by the HTTP outputs
+func (u *UDP) batchRelay() batchRelay {
+	return batchRelay{name: u.Name(), precision: u.precision, logger: u.logger}
+}
+
 // udpPool is used to reuse and auto-size payload buffers, if incoming packets
 // are never larger than 2K, then none of the buffers will be larger than that.
 // This prevents having to manually tune the UDP buffer size, or having every
@@ -116,85 +189,191 @@ type packet struct {
 
 // Run -TODO-
 func (u *UDP) Run() error {
+	queue := make(chan packet, u.queueSize)
+
+	var workers sync.WaitGroup
+	for i := 0; i < u.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for p := range queue {
+				u.post(&p)
+			}
+		}()
+	}
 
-	// buffer that can hold the largest possible UDP payload
-	var buf [65536]byte
+	// The batches of the HTTP backends are sent in the background
+	stop := make(chan struct{})
+	var batches sync.WaitGroup
+	for _, b := range u.httpBackends {
+		batches.Add(1)
+		go func(b *batchBackend) {
+			defer batches.Done()
+			b.run(stop)
+		}(b)
+	}
 
-	// arbitrary queue size for now
-	queue := make(chan packet, 1024)
+	u.logger.Info("starting relay", "schema", "udp", "addr", u.ls[0].LocalAddr(), "readers", len(u.ls), "workers", u.workers)
+
+	// The first reader failing stops the others
+	var (
+		readers sync.WaitGroup
+		once    sync.Once
+		err     error
+	)
+	for _, l := range u.ls {
+		readers.Add(1)
+		go func(l *net.UDPConn) {
+			defer readers.Done()
+			if rerr := u.read(l, queue); rerr != nil {
+				once.Do(func() {
+					err = rerr
+					atomic.StoreInt64(&u.closing, 1)
+					u.closeListeners()
+				})
+			}
+		}(l)
+	}
 
-	var wg sync.WaitGroup
+	readers.Wait()
+	close(queue)
+	workers.Wait()
+	u.c.Close()
 
-	go func() {
-		for p := range queue {
-			u.post(&p)
-			wg.Done()
-		}
-	}()
+	// Send the last batches
+	close(stop)
+	batches.Wait()
+	return err
+}
 
-	log.Printf("starting UDP relay %q on %v", u.Name(), u.l.LocalAddr())
+// read queues the packets received by a socket until it is closed, the
+// packets received while the queue is full are dropped
+func (u *UDP) read(l *net.UDPConn, queue chan<- packet) error {
+	// buffer that can hold the largest possible UDP payload
+	var buf [65536]byte
 
 	for {
-		n, remote, err := u.l.ReadFromUDP(buf[:])
+		n, remote, err := l.ReadFromUDP(buf[:])
 		if err != nil {
 			if atomic.LoadInt64(&u.closing) == 0 {
-				log.Printf("Error reading packet in relay %q from %v: %v", u.name, remote, err)
-			} else {
-				err = nil
+				u.logger.Error("unable to read packet", "client", remote, "error", err)
+				return err
 			}
-			close(queue)
-			wg.Wait()
-			return err
+			return nil
 		}
 		start := time.Now()
-
-		wg.Add(1)
+		metricUDPPackets.add(1, u.Name())
 
 		// copy the data into a buffer and queue it for processing
 		b := getUDPBuf()
 		b.Grow(n)
 		// bytes.Buffer.Write always returns a nil error, and will panic if out of memory
 		_, _ = b.Write(buf[:n])
-		queue <- packet{start, b, remote}
+
+		select {
+		case queue <- packet{start, b, remote}:
+		default:
+			putUDPBuf(b)
+			metricUDPDropped.add(1, u.Name())
+			u.logger.Debug("queue full, dropping packet", "client", remote)
+		}
 	}
 }
 
 // Stop -TODO-
 func (u *UDP) Stop() error {
 	atomic.StoreInt64(&u.closing, 1)
-	return u.l.Close()
+	return u.closeListeners()
+}
+
+// listen opens the sockets of the relay, the first one choosing the
+// port when none is given and the others sharing it
+func (u *UDP) listen(config config.UDPConfig, readers int) error {
+	addr := u.addr
+	for i := 0; i < readers; i++ {
+		l, err := listenUDP(addr, readers > 1)
+		if err != nil {
+			return err
+		}
+		u.ls = append(u.ls, l)
+		addr = l.LocalAddr().String()
+
+		if config.ReadBuffer != 0 {
+			if err = l.SetReadBuffer(config.ReadBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeListeners closes the sockets receiving the packets
+func (u *UDP) closeListeners() error {
+	var err error
+	for _, l := range u.ls {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// listenUDPConn returns the UDP socket of a listener
+func listenUDPConn(l net.PacketConn, err error) (*net.UDPConn, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	ul, ok := l.(*net.UDPConn)
+	if !ok {
+		l.Close()
+		return nil, errors.New("problem listening for UDP")
+	}
+	return ul, nil
 }
 
 func (u *UDP) post(p *packet) {
 	points, err := models.ParsePointsWithPrecision(p.data.Bytes(), p.timestamp, u.precision)
 	if err != nil {
-		log.Printf("Error parsing packet in relay %q from %v: %v", u.Name(), p.from, err)
+		u.logger.Warn("unable to parse packet", "client", p.from, "error", err)
+		metricUDPParseErrors.add(1, u.Name())
 		putUDPBuf(p.data)
 		return
 	}
 
+	metricPointsReceived.add(float64(len(points)), u.Name())
+	metricBytesReceived.add(float64(p.data.Len()), u.Name())
+
+	points = u.transforms.apply(points)
+
 	out := getUDPBuf()
-	for _, pt := range points {
-		if _, err = out.WriteString(pt.PrecisionString(u.precision)); err != nil {
-			break
-		}
-		if err = out.WriteByte('\n'); err != nil {
-			break
+	writePoints(out, points, u.precision)
+
+	// The points refer to the packet until they are written
+	defer putUDPBuf(p.data)
+
+	for _, b := range u.backends {
+		data := out.Bytes()
+
+		// Rewrite the points for this backend only
+		if len(b.transforms) > 0 {
+			transformed := getUDPBuf()
+			writePoints(transformed, b.transforms.apply(points), u.precision)
+			data = transformed.Bytes()
+			defer putUDPBuf(transformed)
 		}
-	}
 
-	putUDPBuf(p.data)
+		if len(data) == 0 {
+			continue
+		}
 
-	if err != nil {
-		putUDPBuf(out)
-		log.Printf("Error writing points in relay %q: %v", u.Name(), err)
-		return
+		if err := b.post(data); err != nil {
+			u.logger.Error("unable to write points", "backend", b.name, "error", err)
+		}
 	}
 
-	for _, b := range u.backends {
-		if err := b.post(out.Bytes()); err != nil {
-			log.Printf("Error writing points in relay %q to backend %q: %v", u.Name(), b.name, err)
-		}
+	for _, b := range u.httpBackends {
+		b.add(points, p.timestamp)
 	}
 
 	putUDPBuf(out)
@@ -205,6 +384,9 @@ type udpBackend struct {
 	name string
 	addr *net.UDPAddr
 	mtu  int
+
+	// Transforms of the points sent to this backend only
+	transforms transforms
 }
 
 var errPacketTooLarge = errors.New("payload larger than MTU")
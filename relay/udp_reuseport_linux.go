@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP opens a socket receiving the packets sent to addr,
+// which may be shared by several sockets when reusePort is set
+func listenUDP(addr string, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return listenUDPConn(net.ListenPacket("udp", addr))
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return listenUDPConn(lc.ListenPacket(context.Background(), "udp", addr))
+}
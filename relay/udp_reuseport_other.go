@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// listenUDP opens a socket receiving the packets sent to addr, the
+// sockets cannot share their address as SO_REUSEPORT is not supported
+func listenUDP(addr string, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, errors.New("several UDP readers are only supported on Linux")
+	}
+	return listenUDPConn(net.ListenPacket("udp", addr))
+}
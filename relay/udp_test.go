@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
+)
+
+func TestUDPReaders(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("several UDP readers are only supported on Linux")
+	}
+
+	writes := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		writes <- string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := config.UDPConfig{
+		Addr:    "127.0.0.1:0",
+		Readers: 2,
+		Workers: 2,
+		Outputs: []config.UDPOutputConfig{
+			{Name: "http", Location: server.URL, DB: "udp", BatchInterval: "10ms"},
+		},
+	}
+	r, err := NewUDP(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := r.(*UDP)
+
+	// The sockets share the port chosen for the first one
+	assert.Equal(t, 2, len(u.ls))
+	assert.Equal(t, u.ls[0].LocalAddr().String(), u.ls[1].LocalAddr().String())
+	assert.Equal(t, 2, u.workers)
+	assert.Equal(t, DefaultUDPQueueSize, u.queueSize)
+
+	done := make(chan error)
+	go func() { done <- u.Run() }()
+
+	c, err := net.Dial("udp", u.ls[0].LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte("cpu value=1 1\n"))
+	assert.Nil(t, err)
+
+	select {
+	case write := <-writes:
+		assert.Equal(t, "cpu value=1 1\n", write)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write received")
+	}
+
+	assert.Nil(t, u.Stop())
+	assert.Nil(t, <-done)
+}
+
+func TestUDPQueueFull(t *testing.T) {
+	u := &UDP{name: "full", logger: logging.Default()}
+
+	l, err := listenUDP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ls = []*net.UDPConn{l}
+
+	// Nothing reads from the queue, the packets are dropped
+	done := make(chan error)
+	go func() { done <- u.read(l, make(chan packet)) }()
+
+	c, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dropped := func() float64 {
+		metricUDPDropped.mu.Lock()
+		defer metricUDPDropped.mu.Unlock()
+		return metricUDPDropped.get([]string{"full"}).value
+	}
+
+	for i := 0; i < 100 && dropped() == 0; i++ {
+		_, err = c.Write([]byte("cpu value=1 1\n"))
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, 0.0, dropped())
+
+	assert.Nil(t, u.Stop())
+	assert.Nil(t, <-done)
+}
+
+func TestUDPRejectedConfig(t *testing.T) {
+	l, err := listenUDP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	cfg := config.UDPConfig{
+		Addr: addr,
+		Outputs: []config.UDPOutputConfig{
+			{Name: "nodb", Location: "http://127.0.0.1:8086/"},
+		},
+	}
+	_, err = NewUDP(cfg, nil, nil)
+	assert.NotNil(t, err)
+
+	// The socket of the rejected relay is not left bound
+	l, err = listenUDP(addr, false)
+	assert.Nil(t, err)
+	l.Close()
+}
@@ -2,25 +2,65 @@ package relayservice
 
 import (
 	"fmt"
-	"log"
+	"reflect"
 	"sync"
 
 	"github.com/veepee-moc/influxdb-relay/config"
+	"github.com/veepee-moc/influxdb-relay/logging"
 	"github.com/veepee-moc/influxdb-relay/relay"
 )
 
 // Service is a map of relays
 type Service struct {
+	mu sync.Mutex
+	wg sync.WaitGroup
+
 	relays map[string]relay.Relay
+
+	// Configuration of the UDP and Graphite relays, to restart the ones which changed
+	udpConfigs      map[string]config.UDPConfig
+	graphiteConfigs map[string]config.GraphiteConfig
+
+	// Filters and transforms of the UDP and Graphite relays, which are restarted when they changed
+	udpFilters    config.Filters
+	udpTransforms config.Transforms
+
+	// Filters and transforms the UDP and Graphite relays run with,
+	// to bring them back when their new configuration is rejected
+	filters    config.Filters
+	transforms config.Transforms
+
+	running bool
+	reload  func() error
+}
+
+// configureLogging applies the log settings of a configuration,
+// the relays running with -v log their debug lines by default
+func configureLogging(cfg config.Config) error {
+	level, err := logging.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	if cfg.Log.Level == "" && cfg.Verbose {
+		level = logging.LevelDebug
+	}
+
+	return logging.Configure(cfg.Log.Format, level)
 }
 
 // New loads the different relays from the configuration file
-func New(config config.Config) (*Service, error) {
+func New(conf config.Config) (*Service, error) {
+	if err := configureLogging(conf); err != nil {
+		return nil, err
+	}
+
 	s := new(Service)
 	s.relays = make(map[string]relay.Relay)
+	s.udpConfigs = make(map[string]config.UDPConfig)
+	s.graphiteConfigs = make(map[string]config.GraphiteConfig)
 
-	for _, cfg := range config.HTTPRelays {
-		h, err := relay.NewHTTP(cfg, config.Verbose, config.Filters)
+	for _, cfg := range conf.HTTPRelays {
+		h, err := relay.NewHTTP(cfg, conf.Verbose, conf.Filters, conf.Transforms)
 		if err != nil {
 			return nil, err
 		}
@@ -30,8 +70,9 @@ func New(config config.Config) (*Service, error) {
 		s.relays[h.Name()] = h
 	}
 
-	for _, cfg := range config.UDPRelays {
-		u, err := relay.NewUDP(cfg)
+	for _, cfg := range conf.UDPRelays {
+		c := udpConfig(cfg)
+		u, err := relay.NewUDP(cfg, conf.Filters, conf.Transforms)
 		if err != nil {
 			return nil, err
 		}
@@ -39,35 +80,369 @@ func New(config config.Config) (*Service, error) {
 			return nil, fmt.Errorf("duplicate relay: %q", u.Name())
 		}
 		s.relays[u.Name()] = u
+		s.udpConfigs[u.Name()] = c
+	}
+
+	for _, cfg := range conf.GraphiteRelays {
+		c := graphiteConfig(cfg)
+		g, err := relay.NewGraphite(cfg, conf.Filters, conf.Transforms)
+		if err != nil {
+			return nil, err
+		}
+		if s.relays[g.Name()] != nil {
+			return nil, fmt.Errorf("duplicate relay: %q", g.Name())
+		}
+		s.relays[g.Name()] = g
+		s.graphiteConfigs[g.Name()] = c
 	}
+	s.udpFilters = filtersConfig(conf.Filters)
+	s.udpTransforms = transformsConfig(conf.Transforms)
+	s.filters, s.transforms = conf.Filters, conf.Transforms
 
 	return s, nil
 }
 
+// SetReloadFunc sets the function reloading the configuration
+// file, which the HTTP relays expose on /admin/reload
+func (s *Service) SetReloadFunc(f func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reload = f
+	for _, r := range s.relays {
+		if h, ok := r.(*relay.HTTP); ok {
+			h.SetReloadFunc(f)
+		}
+	}
+}
+
 // Run does run the service
 // Each relay is started and the service will wait
 // for them all to finish because finishing itself
 func (s *Service) Run() {
-	var wg sync.WaitGroup
-	wg.Add(len(s.relays))
-
+	s.mu.Lock()
+	s.running = true
 	for k := range s.relays {
-		relay := s.relays[k]
-		go func() {
-			defer wg.Done()
+		s.start(s.relays[k])
+	}
+	s.mu.Unlock()
 
-			if err := relay.Run(); err != nil {
-				log.Printf("Error running relay %q: %v", relay.Name(), err)
-			}
-		}()
+	s.wg.Wait()
+}
+
+func (s *Service) start(r relay.Relay) {
+	if h, ok := r.(*relay.HTTP); ok && s.reload != nil {
+		h.SetReloadFunc(s.reload)
+	}
+
+	if !s.running {
+		return
 	}
 
-	wg.Wait()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if err := r.Run(); err != nil {
+			logging.Error("unable to run relay", "relay", r.Name(), "error", err)
+		}
+	}()
+}
+
+// stop stops a relay, an HTTP relay only listens once it runs
+func (s *Service) stop(r relay.Relay) {
+	if _, ok := r.(*relay.HTTP); ok && !s.running {
+		return
+	}
+
+	if err := r.Stop(); err != nil {
+		logging.Error("unable to stop relay", "relay", r.Name(), "error", err)
+	}
 }
 
 // Stop does stop the service by stopping each relay
 func (s *Service) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, v := range s.relays {
 		v.Stop()
 	}
 }
+
+// httpName returns the name of the HTTP relay of a configuration
+func httpName(cfg config.HTTPConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+
+	if cfg.SSLCombinedPem != "" {
+		return "https://" + cfg.Addr
+	}
+	return "http://" + cfg.Addr
+}
+
+// udpConfig copies a configuration, as the outputs are completed by NewUDP
+func udpConfig(cfg config.UDPConfig) config.UDPConfig {
+	cfg.Outputs = append([]config.UDPOutputConfig(nil), cfg.Outputs...)
+	return cfg
+}
+
+// graphiteConfig copies a configuration, as the outputs are completed by NewGraphite
+func graphiteConfig(cfg config.GraphiteConfig) config.GraphiteConfig {
+	cfg.Outputs = append([]config.GraphiteOutputConfig(nil), cfg.Outputs...)
+	return cfg
+}
+
+// transformsConfig copies transforms without their compiled
+// regexps, so that they can be compared
+func transformsConfig(ts config.Transforms) config.Transforms {
+	res := make(config.Transforms, len(ts))
+	for i, t := range ts {
+		t.MeasurementRegexp = nil
+		res[i] = t
+	}
+	return res
+}
+
+// filtersConfig copies filters without their compiled
+// settings, so that they can be compared
+func filtersConfig(fs config.Filters) config.Filters {
+	res := make(config.Filters, len(fs))
+	for i, f := range fs {
+		res[i] = config.Filter{
+			Type:                      f.Type,
+			TagExpression:             f.TagExpression,
+			MeasurementExpression:     f.MeasurementExpression,
+			Tags:                      f.Tags,
+			FieldExpression:           f.FieldExpression,
+			DatabaseExpression:        f.DatabaseExpression,
+			RetentionPolicyExpression: f.RetentionPolicyExpression,
+			MaxAge:                    f.MaxAge,
+			Outputs:                   f.Outputs,
+		}
+	}
+	return res
+}
+
+// udpName returns the name of the UDP relay of a configuration
+func udpName(cfg config.UDPConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.Addr
+}
+
+// graphiteName returns the name of the Graphite relay of a configuration
+func graphiteName(cfg config.GraphiteConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.Addr
+}
+
+// discard closes the retry buffers the HTTP relays of a rejected
+// configuration do not share with the running relays
+func (s *Service) discard(https map[string]*relay.HTTP) {
+	for name, h := range https {
+		relay.HandOver(s.relays[name], h)
+	}
+}
+
+// Reload applies a new configuration: the relays which are not configured
+// anymore are stopped, the new ones started and the others updated. An HTTP
+// relay keeps serving on its listener unless its address or certificate
+// changed, and keeps the retry buffers of the outputs whose name and buffer
+// settings did not change, the other buffers being closed. A UDP or Graphite
+// relay is only restarted when its configuration changed, and keeps running
+// with its previous configuration when the new one is rejected
+func (s *Service) Reload(cfg config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Run must not return while the relays are replaced
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	if err := configureLogging(cfg); err != nil {
+		return err
+	}
+
+	// Prepare the HTTP relays first, so that an invalid
+	// configuration leaves the running relays untouched
+	https := make(map[string]*relay.HTTP)
+	for _, c := range cfg.HTTPRelays {
+		name := httpName(c)
+		if _, ok := https[name]; ok {
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+
+		var h *relay.HTTP
+		var err error
+		if old, ok := s.relays[name].(*relay.HTTP); ok {
+			h, err = old.Reload(c, cfg.Verbose, cfg.Filters, cfg.Transforms)
+		} else {
+			var r relay.Relay
+			r, err = relay.NewHTTP(c, cfg.Verbose, cfg.Filters, cfg.Transforms)
+			h, _ = r.(*relay.HTTP)
+		}
+
+		if err != nil {
+			s.discard(https)
+			return fmt.Errorf("relay %q: %v", name, err)
+		}
+		https[name] = h
+	}
+
+	udps := make(map[string]config.UDPConfig)
+	for _, c := range cfg.UDPRelays {
+		name := udpName(c)
+		if _, ok := https[name]; ok {
+			s.discard(https)
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		if _, ok := udps[name]; ok {
+			s.discard(https)
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		udps[name] = c
+	}
+
+	graphites := make(map[string]config.GraphiteConfig)
+	for _, c := range cfg.GraphiteRelays {
+		name := graphiteName(c)
+		if _, ok := https[name]; ok {
+			s.discard(https)
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		if _, ok := udps[name]; ok {
+			s.discard(https)
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		if _, ok := graphites[name]; ok {
+			s.discard(https)
+			return fmt.Errorf("duplicate relay: %q", name)
+		}
+		graphites[name] = c
+	}
+
+	// Stop the relays which are gone, or whose type changed
+	for name, r := range s.relays {
+		_, isHTTP := r.(*relay.HTTP)
+		_, isUDP := r.(*relay.UDP)
+		_, isGraphite := r.(*relay.Graphite)
+		_, inHTTP := https[name]
+		_, inUDP := udps[name]
+		_, inGraphite := graphites[name]
+		if (isHTTP && inHTTP) || (isUDP && inUDP) || (isGraphite && inGraphite) {
+			continue
+		}
+
+		logging.Info("stopping relay", "relay", name)
+		s.stop(r)
+		relay.HandOver(nil, r)
+		delete(s.relays, name)
+		delete(s.udpConfigs, name)
+		delete(s.graphiteConfigs, name)
+	}
+
+	for name, h := range https {
+		old, ok := s.relays[name].(*relay.HTTP)
+		if ok && old.Replace(h) {
+			continue
+		}
+
+		if ok {
+			logging.Info("restarting relay", "relay", name)
+			s.stop(old)
+		}
+		relay.HandOver(h, s.relays[name])
+		s.relays[name] = h
+		s.start(h)
+	}
+
+	// UDP and Graphite relays bind their socket when created, the previous
+	// relay has to be stopped to create the new one, and is brought back
+	// with its previous configuration when the new one is rejected
+	var errs []error
+	filters, transforms := filtersConfig(cfg.Filters), transformsConfig(cfg.Transforms)
+	same := reflect.DeepEqual(s.udpFilters, filters) && reflect.DeepEqual(s.udpTransforms, transforms)
+	s.udpFilters, s.udpTransforms = filters, transforms
+	prevFilters, prevTransforms := s.filters, s.transforms
+	s.filters, s.transforms = cfg.Filters, cfg.Transforms
+
+	for name, c := range udps {
+		old, ok := s.relays[name]
+		if ok && same && reflect.DeepEqual(s.udpConfigs[name], c) {
+			continue
+		}
+
+		// The retry buffers of the HTTP outputs are kept
+		var u relay.Relay
+		var err error
+		if prev, isUDP := old.(*relay.UDP); isUDP {
+			logging.Info("restarting relay", "relay", name)
+			s.stop(old)
+
+			if u, err = prev.Reload(udpConfig(c), cfg.Filters, cfg.Transforms); err != nil {
+				errs = append(errs, fmt.Errorf("relay %q: %v", name, err))
+				c = s.udpConfigs[name]
+				u, err = prev.Reload(udpConfig(c), prevFilters, prevTransforms)
+			}
+		} else {
+			u, err = relay.NewUDP(udpConfig(c), cfg.Filters, cfg.Transforms)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("relay %q: %v", name, err))
+			relay.HandOver(nil, old)
+			delete(s.relays, name)
+			delete(s.udpConfigs, name)
+			continue
+		}
+
+		relay.HandOver(u, old)
+		s.relays[name] = u
+		s.udpConfigs[name] = c
+		s.start(u)
+	}
+
+	for name, c := range graphites {
+		old, ok := s.relays[name]
+		if ok && same && reflect.DeepEqual(s.graphiteConfigs[name], c) {
+			continue
+		}
+
+		// The retry buffers of the outputs are kept
+		var g relay.Relay
+		var err error
+		if prev, isGraphite := old.(*relay.Graphite); isGraphite {
+			logging.Info("restarting relay", "relay", name)
+			s.stop(old)
+
+			if g, err = prev.Reload(graphiteConfig(c), cfg.Filters, cfg.Transforms); err != nil {
+				errs = append(errs, fmt.Errorf("relay %q: %v", name, err))
+				c = s.graphiteConfigs[name]
+				g, err = prev.Reload(graphiteConfig(c), prevFilters, prevTransforms)
+			}
+		} else {
+			g, err = relay.NewGraphite(graphiteConfig(c), cfg.Filters, cfg.Transforms)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("relay %q: %v", name, err))
+			relay.HandOver(nil, old)
+			delete(s.relays, name)
+			delete(s.graphiteConfigs, name)
+			continue
+		}
+
+		relay.HandOver(g, old)
+		s.relays[name] = g
+		s.graphiteConfigs[name] = c
+		s.start(g)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}